@@ -1,15 +1,18 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/go-pkgz/auth/token"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/launcher"
 	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
 	"github.com/wix-system/tfResDif/v3/apiv2"
 	"io/ioutil"
 	"log"
@@ -53,10 +56,12 @@ func RunShWebsocket(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	//Tagged lines are sent as JSON objects, so the streams and the steps can be told apart
+	structured := r.URL.Query().Get(misc.ApiFormatKey) == misc.OutputFormatLines
 	bt := tm.Get(taskId)
 	if bt == nil {
 		//Try to search for a completed tasks
-		err := writeCompletedTaskToWS(w, r, taskId)
+		err := writeCompletedTaskToWS(w, r, taskId, structured)
 		if err == nil {
 			return
 		}
@@ -70,8 +75,8 @@ func RunShWebsocket(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if bt.GetStatus() == misc.DONE || bt.GetStatus() == misc.FAILED || bt.GetStatus() == misc.TIMEOUT {
-		err := writeCompletedTaskToWS(w, r, taskId)
+	if launcher.IsCompleted(bt) {
+		err := writeCompletedTaskToWS(w, r, taskId, structured)
 		if err != nil {
 			misc.Debugf("Cannot display task %d output. Error: %s", bt.GetId(), err)
 		}
@@ -83,7 +88,12 @@ func RunShWebsocket(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	lineReader, err := launcher.GetTaskLineReader(bt.GetId())
+	var lineReader chan string
+	if structured {
+		lineReader, err = launcher.GetTaskOutputLineReader(bt.GetId())
+	} else {
+		lineReader, err = launcher.GetTaskLineReader(bt.GetId())
+	}
 	if err != nil {
 		erm := fmt.Sprintf("Cannot get line reader from the . Error: %s", err)
 		log.Println(erm)
@@ -111,8 +121,14 @@ func RunShWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func writeCompletedTaskToWS(w http.ResponseWriter, r *http.Request, taskId int) error {
-	output, err := launcher.GetCompletedTaskOutput(taskId)
+func writeCompletedTaskToWS(w http.ResponseWriter, r *http.Request, taskId int, structured bool) error {
+	var output []string
+	var err error
+	if structured {
+		output, err = completedTaskOutputLines(taskId)
+	} else {
+		output, err = launcher.GetCompletedTaskOutput(taskId)
+	}
 	if err != nil {
 		return err
 	}
@@ -127,6 +143,23 @@ func writeCompletedTaskToWS(w http.ResponseWriter, r *http.Request, taskId int)
 	return nil
 }
 
+//completedTaskOutputLines returns JSON encoded tagged output lines of the task
+func completedTaskOutputLines(taskId int) ([]string, error) {
+	lines, err := storer.ReadTaskLines(taskId)
+	if err != nil {
+		return nil, err
+	}
+	var output []string
+	for i := range lines {
+		data, err := json.Marshal(&lines[i])
+		if err != nil {
+			return nil, fmt.Errorf("cannot serialize output line of task %d. Error: %w", taskId, err)
+		}
+		output = append(output, string(data))
+	}
+	return output, nil
+}
+
 func prepareWebSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
@@ -183,11 +216,6 @@ func RunShPost(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Parsed command struct %v", rgp)
 		log.Printf("Command computed hash %s", hash)
 	}
-	envVars := make(map[string]string)
-	//Explicitly Disable progress bar fo tfResDif
-	envVars["TFRESDIF_NOPB"] = "true"
-	//Explicitly disable notification of tfChek to avoid endless loop
-	envVars["NOTIFY_TFCHEK"] = "false"
 	cmd, err := rgp.GetHashedCommand(hash)
 	if err != nil {
 		em := fmt.Sprintf("Cannot create background task. Error: %s", err.Error())
@@ -198,10 +226,14 @@ func RunShPost(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	bt, err := submitCommand(cmd, &envVars, rgp.GetTimeout())
+	bt, err := submitCommand(cmd, nil, rgp.GetTimeout())
 	if err != nil {
 		em := fmt.Sprintf("Cannot create background task. Error: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		if errors.Is(err, launcher.ErrDispatcherStopped) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		_, e := w.Write([]byte(em))
 		if e != nil {
 			log.Printf("Cannot respond with message '%s' Error: %s", err, e)
@@ -217,39 +249,74 @@ func RunShPost(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//WtfPost creates a wtf task. Retried requests get the task created by the first one.
+//The request is identified by Idempotency-Key header or by the payload hash if the header is absent
 func WtfPost(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	dec := json.NewDecoder(r.Body)
+	msg, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Cannot read body message")
+		handleReqErr(err, w)
+		return
+	}
+	key := r.Header.Get(misc.IdempotencyKeyHeader)
+	if key == "" {
+		key, err = misc.GetPayloadHash(msg, misc.PAYLOADHASH_SHA512)
+		if err != nil {
+			w.WriteHeader(http.StatusNotImplemented)
+			em := fmt.Sprintf("Cannot compute hash of the message. Error: %s", err.Error())
+			_, e := w.Write([]byte(em))
+			if e != nil {
+				log.Printf("Cannot respond with message '%s' Error: %s", err, e)
+			}
+			return
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
 	dec.DisallowUnknownFields()
-	var taskDef *apiv2.TaskDefinition
+	var taskDef *launcher.WtfTaskDefinition
 	//for dec.More() {
-	err := dec.Decode(&taskDef)
+	err = dec.Decode(&taskDef)
 	if err != nil {
 		handleReqErr(err, w)
 		misc.Debugf("could not parse json")
 		return
 	}
+	err = taskDef.Validate()
+	if err != nil {
+		handleReqErr(err, w)
+		misc.Debugf("invalid wtf task definition. Error: %s", err)
+		return
+	}
 	misc.Debugf("the posted command is %q", taskDef.Context.FullCommand)
 	////misc.Debugf("parsed command struct %v", taskDef)
-	//taskDef.Context.ExtraEnv["TFRESDIF_NOPB"] = "true"
-	////Explicitly disable notification of tfChek to avoid endless loop
-	//taskDef.Context.ExtraEnv["NOTIFY_TFCHEK"] = "false"
 
 	//Register task
 	tm := launcher.GetWtfTaskManager()
-	tid, err := tm.AddWtfTask(taskDef)
+	tid, created, err := tm.AddWtfTask(taskDef, key)
 	if err != nil {
 		em := fmt.Sprintf("cannot create background task. Error: %s", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		if errors.Is(err, launcher.ErrDispatcherStopped) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 		_, e := w.Write([]byte(em))
 		if e != nil {
 			log.Printf("cannot respond with message '%s' Error: %s", err, e)
 		}
 	} else {
-
-		w.WriteHeader(http.StatusCreated)
-		//TODO: Remove hardcode here (Perhaps task status should be returned as well. Need to discuss it)
-		sr := &apiv2.StatusResponse{TaskId: tid, Action: apiv2.StatusAction, Status: launcher.GetStatusString(misc.OPEN)}
+		status := launcher.TaskStatus(misc.OPEN)
+		code := http.StatusCreated
+		if !created {
+			code = http.StatusOK
+			status, err = launcher.GetTaskStatus(tid)
+			if err != nil {
+				misc.Debugf("cannot get status of task %d. Error: %s", tid, err)
+			}
+		}
+		w.WriteHeader(code)
+		sr := &apiv2.StatusResponse{TaskId: tid, Action: apiv2.StatusAction, Status: launcher.GetStatusString(status)}
 		respEncoder := json.NewEncoder(w)
 		err := respEncoder.Encode(sr)
 		//_, err = w.Write([]byte(strconv.Itoa(tid)))
@@ -260,6 +327,49 @@ func WtfPost(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//TerraformPost accepts plain terraform or terragrunt runs, which do not need run.sh
+func TerraformPost(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	var taskDef launcher.TerraformTaskDefinition
+	err := dec.Decode(&taskDef)
+	if err != nil {
+		handleReqErr(err, w)
+		misc.Debugf("could not parse json")
+		return
+	}
+	err = taskDef.Validate()
+	if err != nil {
+		handleReqErr(err, w)
+		misc.Debugf("invalid terraform task definition. Error: %s", err)
+		return
+	}
+	misc.Debugf("the posted %s task is for %s in %q", taskDef.Tool, taskDef.Repository, taskDef.Directory)
+
+	tm := launcher.GetTerraformTaskManager()
+	tid, err := tm.AddTerraformTask(&taskDef)
+	if err != nil {
+		em := fmt.Sprintf("cannot create background task. Error: %s", err.Error())
+		if errors.Is(err, launcher.ErrDispatcherStopped) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		_, e := w.Write([]byte(em))
+		if e != nil {
+			log.Printf("cannot respond with message '%s' Error: %s", err, e)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	sr := &apiv2.StatusResponse{TaskId: tid, Action: apiv2.StatusAction, Status: launcher.GetStatusString(misc.OPEN)}
+	err = json.NewEncoder(w).Encode(sr)
+	if err != nil {
+		log.Printf("Cannot write response. Error: %s", err)
+	}
+}
+
 func FormatIdParam() string {
 	return fmt.Sprintf("{%s}", misc.IdParam)
 }
@@ -298,10 +408,15 @@ func Cancel(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	err = tm.Cancel(bt.GetId())
+	err = tm.Cancel(bt.GetId(), getRequester(r))
 	if err != nil {
 		log.Printf("Cannot cancel task by id: %d Error: %s", taskId, err)
-		w.WriteHeader(404)
+		var se *launcher.StateError
+		if errors.As(err, &se) {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(404)
+		}
 		_, err := w.Write([]byte(fmt.Sprintf("Cannot cancel task by id: %d", taskId)))
 		if err != nil {
 			log.Printf("Cannot find cancel by id: %d Error: %s", taskId, err)
@@ -311,10 +426,19 @@ func Cancel(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(202)
 }
 
+//getRequester returns the name of the authenticated user or the remote address for anonymous requests
+func getRequester(r *http.Request) string {
+	user, err := token.GetUserInfo(r)
+	if err == nil && user.Name != "" {
+		return user.Name
+	}
+	return fmt.Sprintf("anonymous (%s)", r.RemoteAddr)
+}
+
 func RunShWebHook(w http.ResponseWriter, r *http.Request) {
 	tm := launcher.GetTaskManager()
 	hook, _ := github.New(github.Options.Secret(viper.GetString(misc.WebHookSecretKey)))
-	payload, err := hook.Parse(r, github.PushEvent)
+	payload, err := hook.Parse(r, github.PushEvent, github.PullRequestEvent, github.PullRequestReviewEvent)
 	if err != nil {
 		if err == github.ErrEventNotFound {
 			// ok event wasn't one of the ones asked to be parsed
@@ -341,6 +465,12 @@ func RunShWebHook(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	switch payload.(type) {
+	case github.PullRequestPayload:
+		pullRequestPayload := payload.(github.PullRequestPayload)
+		handlePullRequest(w, &pullRequestPayload)
+	case github.PullRequestReviewPayload:
+		reviewPayload := payload.(github.PullRequestReviewPayload)
+		handlePullRequestReview(w, &reviewPayload)
 	case github.PushPayload:
 		pushPayload := payload.(github.PushPayload)
 		if pushPayload.Created {
@@ -391,7 +521,11 @@ func RunShWebHook(w http.ResponseWriter, r *http.Request) {
 					if err != nil {
 						errmsg := fmt.Sprintf("Cannot launch task id %d. Error: %s", taskId, err)
 						log.Println(errmsg)
-						w.WriteHeader(400)
+						if errors.Is(err, launcher.ErrQueueFull) || errors.Is(err, launcher.ErrDispatcherStopped) {
+							w.WriteHeader(http.StatusServiceUnavailable)
+						} else {
+							w.WriteHeader(400)
+						}
 						_, err = w.Write([]byte(errmsg))
 						if err != nil {
 							log.Printf("Cannot post message '%s' Error: %s", errmsg, err)
@@ -501,13 +635,13 @@ func GetTaskIdByHash(w http.ResponseWriter, r *http.Request) {
 
 func submitCommand(cmd *launcher.RunShCmd, envVars *map[string]string, timeout time.Duration) (launcher.Task, error) {
 	tm := launcher.GetTaskManager()
-	ctx, cancel := context.WithTimeout(
+	ctx, cancel := context.WithCancel(
 		context.WithValue(
 			context.Background(),
-			misc.EnvVarsKey, envVars),
-		timeout)
-	bt, err := tm.AddRunSh(cmd, ctx)
+			misc.EnvVarsKey, envVars))
+	bt, err := tm.AddRunSh(cmd, ctx, timeout)
 	if err != nil {
+		cancel()
 		return bt, err
 	} else {
 		if viper.GetBool("debug") {
@@ -518,10 +652,12 @@ func submitCommand(cmd *launcher.RunShCmd, envVars *map[string]string, timeout t
 		err = tm.RegisterCancel(bt.GetId(), cancel)
 		if err != nil {
 			log.Printf("ERROR! Cannot register cancel function. Task (id: %d) will be impossible to cancel. Error: %s", bt.GetId(), err)
+			cancel()
 			return nil, err
 		}
 		return bt, nil
 	} else {
+		cancel()
 		log.Print("ERROR! Cannot register cancel function of nil task. This should never happen!")
 		return nil, errors.New("Cannot register cancel function of nil task. This should never happen!")
 	}
@@ -82,7 +82,7 @@ func DeleteCIBranch(w http.ResponseWriter, r *http.Request) {
 	if bok {
 		s := strings.Split(branch, "-")
 		if len(s) != 2 {
-			misc.Debugf("failed to split branch %s name onto 2 parts. Falling through to next parameter")
+			misc.Debugf("failed to split branch %s name onto 2 parts. Falling through to next parameter", branch)
 		} else {
 			taskId, err = strconv.Atoi(s[1])
 			if err != nil {
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/wix-playground/tfChek/launcher"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//StateLockInfo is the state lock representation returned by the lock API
+type StateLockInfo struct {
+	*storer.StateLockRecord
+	//Stale lock has not been renewed in time. Its holder has likely gone
+	Stale bool `json:"stale"`
+}
+
+//ListStateLocks returns the state locks held by the tasks of all the replicas
+func ListStateLocks(w http.ResponseWriter, r *http.Request) {
+	locks, err := launcher.GetStateLocks()
+	if err != nil {
+		misc.Debugf("cannot list state locks. Error: %s", err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	infos := []*StateLockInfo{}
+	for _, l := range locks {
+		infos = append(infos, &StateLockInfo{StateLockRecord: l, Stale: l.IsStale(now)})
+	}
+	respondTaskJson(w, infos, http.StatusOK)
+}
+
+//BreakStateLock frees the state lock left by a gone task. Lock of a live task is freed only if force=true is given
+func BreakStateLock(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)[misc.LockNameParam]
+	force := false
+	if v := r.URL.Query().Get(misc.ApiForceKey); v != "" {
+		var err error
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("wrong %s value %q", misc.ApiForceKey, v)}, http.StatusBadRequest)
+			return
+		}
+	}
+	err := launcher.BreakStateLock(name, getRequester(r), force)
+	if err != nil {
+		if errors.Is(err, launcher.ErrInternalStateLock) {
+			respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, storer.ErrStateLockNotFound) {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("state lock %s is not held", name)}, http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storer.ErrStateLockHeld) {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("state lock %s is not stale. Use %s=true to break it anyway", name, misc.ApiForceKey)}, http.StatusConflict)
+			return
+		}
+		misc.Debugf("cannot break state lock %s. Error: %s", name, err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wix-playground/tfChek/launcher"
+	"github.com/wix-playground/tfChek/misc"
+	"gopkg.in/go-playground/webhooks.v5/github"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const reviewApproved = "approved"
+
+//handlePullRequest plans pull requests of Apply -> Push flow when they are opened or get new commits
+func handlePullRequest(w http.ResponseWriter, payload *github.PullRequestPayload) {
+	pr := &launcher.PullRequest{Repository: payload.Repository.FullName, Number: int(payload.Number),
+		Branch: payload.PullRequest.Head.Ref, Sha: payload.PullRequest.Head.Sha, Author: payload.PullRequest.User.Login}
+	if !isReviewable(pr, payload.PullRequest.Head.Repo.FullName) {
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("PR #%d is not eligible for Apply -> Push flow", pr.Number))
+		return
+	}
+	tm := launcher.GetTaskManager()
+	switch payload.Action {
+	case "opened", "reopened", "synchronize":
+		tasks, err := launcher.PlanPullRequest(tm, pr)
+		respondReviewTasks(w, pr, tasks, err)
+	case "closed":
+		//Nothing should be applied after the pull request is closed
+		pr.Sha = ""
+		launcher.CancelPullRequest(tm, pr, fmt.Sprintf("tfChek (PR #%d closed)", pr.Number))
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("active tasks of PR #%d have been cancelled", pr.Number))
+	default:
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("action %s of PR #%d is ignored", payload.Action, pr.Number))
+	}
+}
+
+//handlePullRequestReview applies the head commit of the approved pull request
+func handlePullRequestReview(w http.ResponseWriter, payload *github.PullRequestReviewPayload) {
+	pr := &launcher.PullRequest{Repository: payload.Repository.FullName, Number: int(payload.PullRequest.Number),
+		Branch: payload.PullRequest.Head.Ref, Sha: payload.PullRequest.Head.Sha, Author: payload.PullRequest.User.Login}
+	if !isReviewable(pr, payload.PullRequest.Head.Repo.FullName) {
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("PR #%d is not eligible for Apply -> Push flow", pr.Number))
+		return
+	}
+	if payload.Action != "submitted" || !strings.EqualFold(payload.Review.State, reviewApproved) {
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("review of PR #%d is not an approval", pr.Number))
+		return
+	}
+	reviewer := payload.Review.User.Login
+	allowed, err := launcher.CanApprovePullRequest(pr, reviewer)
+	if err != nil {
+		errmsg := fmt.Sprintf("Cannot check permission of %s to approve PR #%d of %s. Error: %s", reviewer, pr.Number, pr.Repository, err)
+		log.Println(errmsg)
+		respondWebhook(w, http.StatusInternalServerError, errmsg)
+		return
+	}
+	if !allowed {
+		log.Printf("Approval of PR #%d of %s by %s is ignored, because %s has no write access", pr.Number, pr.Repository, reviewer, reviewer)
+		respondWebhook(w, http.StatusOK, fmt.Sprintf("%s is not allowed to apply PR #%d", reviewer, pr.Number))
+		return
+	}
+	log.Printf("PR #%d of %s has been approved by %s", pr.Number, pr.Repository, reviewer)
+	tasks, err := launcher.ApplyPullRequest(launcher.GetTaskManager(), pr)
+	respondReviewTasks(w, pr, tasks, err)
+}
+
+//isReviewable skips pull requests created by tfChek itself and the ones from forks, which branches are not in the repository
+func isReviewable(pr *launcher.PullRequest, headRepository string) bool {
+	if strings.HasPrefix(pr.Branch, misc.TaskPrefix) {
+		return false
+	}
+	return strings.EqualFold(headRepository, pr.Repository)
+}
+
+func respondReviewTasks(w http.ResponseWriter, pr *launcher.PullRequest, tasks []launcher.Task, err error) {
+	var ids []string
+	for _, t := range tasks {
+		ids = append(ids, strconv.Itoa(t.GetId()))
+	}
+	if err != nil {
+		errmsg := fmt.Sprintf("Cannot process PR #%d of %s (tasks created: %v). Error: %s", pr.Number, pr.Repository, ids, err)
+		log.Println(errmsg)
+		var se *launcher.StateError
+		switch {
+		case errors.Is(err, launcher.ErrNoPullRequestCheck):
+			respondWebhook(w, http.StatusOK, errmsg)
+		case errors.As(err, &se):
+			respondWebhook(w, http.StatusConflict, errmsg)
+		case errors.Is(err, launcher.ErrQueueFull) || errors.Is(err, launcher.ErrDispatcherStopped):
+			respondWebhook(w, http.StatusServiceUnavailable, errmsg)
+		default:
+			respondWebhook(w, http.StatusInternalServerError, errmsg)
+		}
+		return
+	}
+	respondWebhook(w, http.StatusAccepted, strings.Join(ids, ","))
+}
+
+func respondWebhook(w http.ResponseWriter, status int, msg string) {
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(msg))
+	if err != nil {
+		log.Printf("Cannot post message '%s' Error: %s", msg, err)
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/wix-playground/tfChek/launcher"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTasksLimit = 50
+	maxTasksLimit     = 500
+)
+
+//TaskInfo is the task representation returned by the task API
+type TaskInfo struct {
+	Id           int                    `json:"id"`
+	Kind         string                 `json:"kind"`
+	Command      string                 `json:"command"`
+	Status       string                 `json:"status"`
+	StateLock    string                 `json:"state_lock"`
+	Authors      []string               `json:"authors"`
+	Origins      []string               `json:"origins"`
+	Created      time.Time              `json:"created"`
+	Updated      time.Time              `json:"updated"`
+	PullRequests []storer.GitHubRef     `json:"pull_requests"`
+	Issues       []storer.GitHubRef     `json:"issues"`
+	History      []*TaskTransition      `json:"history"`
+	Ref          string                 `json:"ref,omitempty"`
+	RerunOf      int                    `json:"rerun_of,omitempty"`
+	CancelledBy  string                 `json:"cancelled_by,omitempty"`
+	Drift        string                 `json:"drift,omitempty"`
+	Review       *storer.PullRequestRef `json:"review,omitempty"`
+	Expired      bool                   `json:"expired,omitempty"`
+	Run          *storer.RunRecord      `json:"run,omitempty"`
+	LockToken    int64                  `json:"lock_token,omitempty"`
+	Labels       map[string]string      `json:"labels"`
+}
+
+//TaskOutput is the output of the task split into lines tagged with their streams, steps and timestamps
+type TaskOutput struct {
+	Id    int                 `json:"id"`
+	Run   *storer.RunRecord   `json:"run,omitempty"`
+	Lines []storer.OutputLine `json:"lines"`
+}
+
+//RerunForm is an optional body of the re-run request. The branch of the original task is used when ref is empty
+type RerunForm struct {
+	Ref string `json:"ref"`
+}
+
+type TaskTransition struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type TaskListResponse struct {
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	Tasks  []*TaskInfo `json:"tasks"`
+}
+
+type TaskErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func NewTaskInfo(rec *storer.TaskRecord) *TaskInfo {
+	ti := &TaskInfo{Id: rec.Id, Kind: rec.Kind, Command: rec.Command, Status: launcher.GetStatusString(launcher.TaskStatus(rec.Status)),
+		StateLock: rec.StateLock, Authors: rec.Authors, Origins: rec.Origins, Created: rec.Created, Updated: rec.Updated,
+		PullRequests: rec.PullRequests, Issues: rec.Issues, Ref: rec.Ref, RerunOf: rec.RerunOf, CancelledBy: rec.CancelledBy, Drift: rec.Drift, Review: rec.Review,
+		Expired: rec.Expired, Run: rec.Run, LockToken: rec.LockToken, Labels: rec.Labels}
+	if ti.Authors == nil {
+		ti.Authors = []string{}
+	}
+	if ti.Origins == nil {
+		ti.Origins = []string{}
+	}
+	if ti.PullRequests == nil {
+		ti.PullRequests = []storer.GitHubRef{}
+	}
+	if ti.Issues == nil {
+		ti.Issues = []storer.GitHubRef{}
+	}
+	if ti.Labels == nil {
+		ti.Labels = map[string]string{}
+	}
+	ti.History = []*TaskTransition{}
+	for _, st := range rec.History {
+		ti.History = append(ti.History, &TaskTransition{Status: launcher.GetStatusString(launcher.TaskStatus(st.Status)), Time: st.Time, Reason: st.Reason})
+	}
+	return ti
+}
+
+//ListTasks returns the tasks known to tfChek, the newest first.
+//Supported query parameters are status (may be repeated or comma separated), lock, author, label, expired, since, until, offset and limit.
+//Label is either key=value or just key to match any value. It may be repeated to require several labels
+func ListTasks(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTaskFilter(r.URL.Query())
+	if err != nil {
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+		return
+	}
+	records, total, err := launcher.FindTaskRecords(filter)
+	if err != nil {
+		misc.Debugf("cannot list tasks. Error: %s", err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	resp := &TaskListResponse{Total: total, Offset: filter.Offset, Limit: filter.Limit, Tasks: []*TaskInfo{}}
+	for _, rec := range records {
+		resp.Tasks = append(resp.Tasks, NewTaskInfo(rec))
+	}
+	respondTaskJson(w, resp, http.StatusOK)
+}
+
+//GetTask returns the task by its id. It works for completed tasks as well as for the active ones
+func GetTask(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)[misc.IdParam]
+	taskId, err := strconv.Atoi(id)
+	if err != nil {
+		respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot parse task id %q", id)}, http.StatusBadRequest)
+		return
+	}
+	rec, err := launcher.GetTaskRecord(taskId)
+	if err != nil {
+		if errors.Is(err, storer.ErrTaskRecordNotFound) {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot find task by id: %d", taskId)}, http.StatusNotFound)
+			return
+		}
+		misc.Debugf("cannot load task %d. Error: %s", taskId, err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	respondTaskJson(w, NewTaskInfo(rec), http.StatusOK)
+}
+
+//GetTaskOutput returns tagged output lines of the task together with its run record.
+//Lines of the running task are the ones written so far
+func GetTaskOutput(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)[misc.IdParam]
+	taskId, err := strconv.Atoi(id)
+	if err != nil {
+		respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot parse task id %q", id)}, http.StatusBadRequest)
+		return
+	}
+	rec, err := launcher.GetTaskRecord(taskId)
+	if err != nil {
+		if errors.Is(err, storer.ErrTaskRecordNotFound) {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot find task by id: %d", taskId)}, http.StatusNotFound)
+			return
+		}
+		misc.Debugf("cannot load task %d. Error: %s", taskId, err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	lines, err := storer.ReadTaskLines(taskId)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("task %d has no output lines", taskId)}, http.StatusNotFound)
+			return
+		}
+		misc.Debugf("cannot read task %d output lines. Error: %s", taskId, err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	if lines == nil {
+		lines = []storer.OutputLine{}
+	}
+	respondTaskJson(w, &TaskOutput{Id: taskId, Run: rec.Run, Lines: lines}, http.StatusOK)
+}
+
+//RerunTask creates a new task from the definition of the completed one and puts it to the queue
+func RerunTask(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)[misc.IdParam]
+	taskId, err := strconv.Atoi(id)
+	if err != nil {
+		respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot parse task id %q", id)}, http.StatusBadRequest)
+		return
+	}
+	var form RerunForm
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&form)
+		if err != nil && err != io.EOF {
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("could not parse json. Error: %s", err)}, http.StatusBadRequest)
+			return
+		}
+	}
+	t, err := launcher.RerunTask(launcher.GetTaskManager(), taskId, strings.TrimSpace(form.Ref))
+	if err != nil {
+		var se *launcher.StateError
+		switch {
+		case errors.Is(err, storer.ErrTaskRecordNotFound):
+			respondTaskJson(w, &TaskErrorResponse{Error: fmt.Sprintf("cannot find task by id: %d", taskId)}, http.StatusNotFound)
+		case errors.As(err, &se):
+			respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusConflict)
+		case errors.Is(err, launcher.ErrQueueFull), errors.Is(err, launcher.ErrDispatcherStopped):
+			respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusServiceUnavailable)
+		default:
+			misc.Debugf("cannot re-run task %d. Error: %s", taskId, err)
+			respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		}
+		return
+	}
+	rec, err := launcher.GetTaskRecord(t.GetId())
+	if err != nil {
+		misc.Debugf("cannot load task %d. Error: %s", t.GetId(), err)
+		respondTaskJson(w, &TaskErrorResponse{Error: err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	respondTaskJson(w, NewTaskInfo(rec), http.StatusCreated)
+}
+
+func parseTaskFilter(query url.Values) (*launcher.TaskFilter, error) {
+	filter := &launcher.TaskFilter{StateLock: query.Get("lock"), Author: query.Get("author"), Limit: defaultTasksLimit}
+	for _, sv := range query["status"] {
+		for _, name := range strings.Split(sv, ",") {
+			if name == "" {
+				continue
+			}
+			status, err := launcher.ParseTaskStatus(name)
+			if err != nil {
+				return nil, err
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	for _, lv := range query["label"] {
+		kv := strings.SplitN(lv, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("label %q has to be key=value or key", lv)
+		}
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[kv[0]] = ""
+		if len(kv) == 2 {
+			filter.Labels[kv[0]] = kv[1]
+		}
+	}
+	var err error
+	if e := query.Get("expired"); e != "" {
+		filter.Expired, err = strconv.ParseBool(e)
+		if err != nil {
+			return nil, fmt.Errorf("expired %q has to be a boolean", e)
+		}
+	}
+	if filter.Since, err = parseTaskTime(query.Get("since")); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = parseTaskTime(query.Get("until")); err != nil {
+		return nil, err
+	}
+	if o := query.Get("offset"); o != "" {
+		filter.Offset, err = strconv.Atoi(o)
+		if err != nil || filter.Offset < 0 {
+			return nil, fmt.Errorf("offset %q has to be a non negative integer", o)
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		filter.Limit, err = strconv.Atoi(l)
+		if err != nil || filter.Limit <= 0 {
+			return nil, fmt.Errorf("limit %q has to be a positive integer", l)
+		}
+		if filter.Limit > maxTasksLimit {
+			filter.Limit = maxTasksLimit
+		}
+	}
+	return filter, nil
+}
+
+//parseTaskTime accepts Unix time or RFC3339 date. Empty value means no restriction
+func parseTaskTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if matched, _ := regexp.MatchString("^[0-9]+$", value); matched {
+		st, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("cannot convert unix time %q to integer. Error: %w", value, err)
+		}
+		return time.Unix(st, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse RFC3339 date %q. Error: %w", value, err)
+	}
+	return t, nil
+}
+
+func respondTaskJson(w http.ResponseWriter, resp interface{}, status int) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		misc.Debugf("cannot marshal response %v. Error: %s", resp, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(misc.ContentTypeKey, misc.ContentTypeJson)
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	if err != nil {
+		misc.Debugf("cannot send a response. Error: %s", err)
+	}
+}
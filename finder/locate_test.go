@@ -1,6 +1,9 @@
 package finder
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestLocateTerrafrom(t *testing.T) {
 	type args struct {
@@ -30,6 +33,9 @@ func TestLocateTerrafrom(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			if _, err := os.Stat(tt.want); !tt.wantErr && err != nil {
+				t.Skipf("%s is not available", tt.want)
+			}
 			got, err := LocateTerrafrom(tt.args.workdir)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("LocateTerrafrom() error = %v, wantErr %v", err, tt.wantErr)
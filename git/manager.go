@@ -30,6 +30,8 @@ type Manager interface {
 	Checkout(ref string) error
 	Pull() error
 	SwitchTo(branch string) error
+	//CheckoutCommit checks out the commit of the branch switched to. It fails if the commit is not there
+	CheckoutCommit(sha string) error
 	Clone() error
 	Open() error
 	GetPath() string
@@ -38,6 +40,8 @@ type Manager interface {
 	WaitForWebhook(branch string, timeout int) error
 	UnlockWebhookLock(branch string) error
 	RegisterWebhookLock(branch string) error
+	//ReleaseWebhookLock drops the lock of the branch, which webhook is not expected anymore
+	ReleaseWebhookLock(branch string) error
 }
 
 type BuiltInManager struct {
@@ -45,7 +49,7 @@ type BuiltInManager struct {
 	repoPath     string
 	remote       *git.Remote
 	repo         *git.Repository
-	webhookLocks map[string]chan string
+	webhookLocks *github.WebhookLocks
 }
 
 func (b *BuiltInManager) GetRemote() string {
@@ -75,45 +79,29 @@ func (b *BuiltInManager) IsCloned() bool {
 	}
 }
 
+//WaitForWebhook blocks until the webhook of the branch comes. The timeout is handled according to the webhook wait policy of the repository
 func (b *BuiltInManager) WaitForWebhook(branch string, timeout int) error {
 	if timeout < 0 {
 		return fmt.Errorf("timeout value cannot be negative")
 	}
-	if c, ok := b.webhookLocks[branch]; ok {
-		if c != nil {
-			select {
-			case branchName := <-c:
-				if branchName != branch {
-					if len(branchName) > 0 {
-						misc.Debugf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
-						return fmt.Errorf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
-					} else {
-						misc.Debugf("warning. empty branch name in webhook wait at %s branch %s", b.repoPath, branch)
-					}
-				} else {
-					delete(b.webhookLocks, branch)
-					misc.Debugf("webhook lock has been successfully consumed for branch %s", branch)
-				}
-			case <-time.After(time.Duration(timeout) * time.Second):
-				misc.Debugf("webhook lock timeout reached after %d seconds for branch %s", timeout, branch)
-				//Here I will not return an error, giving  chance eto fetch and checkout needed branch anyway.
-				//return fmt.Errorf("webhook lock timeout reached after %d seconds for task %d", timeout,taskId)
-			}
-		} else {
-			misc.Debugf("webhook lock for branch %s is nil", branch)
-			return fmt.Errorf("webhook lock for branch %s is nil", branch)
-		}
-	} else {
+	c, ok := b.webhookLocks.Get(branch)
+	if !ok {
 		misc.Debugf("no lock for a branch %s in repo %s exists", branch, b.repoPath)
 		return fmt.Errorf("no lock for a branch %s in repo %s exists", branch, b.repoPath)
 	}
-	return nil
+	if c == nil {
+		misc.Debugf("webhook lock for branch %s is nil", branch)
+		return fmt.Errorf("webhook lock for branch %s is nil", branch)
+	}
+	err := github.AwaitWebhook(c, b.remoteUrl, branch, timeout)
+	//Nobody waits for the webhook anymore
+	b.webhookLocks.Remove(branch)
+	return err
 }
 
 //Locks fetching from the remote repository until corresponding webhook notifies about branch existence
 func (b *BuiltInManager) RegisterWebhookLock(branch string) error {
-	if _, ok := b.webhookLocks[branch]; !ok {
-		b.webhookLocks[branch] = make(chan string, 1)
+	if b.webhookLocks.Register(branch) {
 		misc.Debugf("webhook lock for a branch %s in repo %s has been successfully registered", branch, b.repoPath)
 	} else {
 		return fmt.Errorf("git manager for %s already has locking channel for the branch %s", b.repoPath, branch)
@@ -122,12 +110,17 @@ func (b *BuiltInManager) RegisterWebhookLock(branch string) error {
 }
 
 func (b *BuiltInManager) UnlockWebhookLock(branch string) error {
-	if bl, ok := b.webhookLocks[branch]; ok {
-		bl <- branch
-		close(bl)
-	} else {
+	if !b.webhookLocks.Unlock(branch) {
+		return fmt.Errorf("webhook for branch %s has not been registered", branch)
+	}
+	return nil
+}
+
+func (b *BuiltInManager) ReleaseWebhookLock(branch string) error {
+	if !b.webhookLocks.Remove(branch) {
 		return fmt.Errorf("webhook for branch %s has not been registered", branch)
 	}
+	misc.Debugf("webhook lock for a branch %s in repo %s has been released", branch, b.repoPath)
 	return nil
 }
 
@@ -161,7 +154,7 @@ func GetManager(url, tfState string, apiVersion int) (Manager, error) {
 				repoName = strings.Replace(repoName, ".git", "", 1)
 			}
 
-			whl := make(map[string]chan string)
+			whl := github.NewWebhookLocks()
 			if viper.GetBool(misc.GitHubDownload) && apiVersion > 1 {
 				repoPath := path.Join(viper.GetString(misc.RepoDirKey), misc.RepomanagerPathSuffix, repoName, tfState)
 				misc.Debugf("requesting new github based git repository manager for path %s and url %s", repoPath, url)
@@ -267,6 +260,27 @@ func (b *BuiltInManager) Checkout(branchName string) error {
 	return nil
 }
 
+func (b *BuiltInManager) CheckoutCommit(sha string) error {
+	if b.repo == nil {
+		return errors.New("the repository has been not cloned yet")
+	}
+	gwt, err := b.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("cannot get worktree of git repository %s. Error: %w", b.repoPath, err)
+	}
+	hash := plumbing.NewHash(sha)
+	_, err = b.repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("commit %s is not found in git repository %s. Error: %w", sha, b.repoPath, err)
+	}
+	misc.Debugf("trying to checkout commit %s at %s", sha, b.repoPath)
+	err = gwt.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+	if err != nil {
+		return fmt.Errorf("cannot checkout commit %s at %s. Error: %w", sha, b.repoPath, err)
+	}
+	return nil
+}
+
 //Deprecated
 func (b *BuiltInManager) Pull() error {
 	gitRef, err := b.repo.Head()
@@ -2,11 +2,19 @@ package git
 
 import (
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestBuiltInManager_Clone(t *testing.T) {
+	if os.Getenv("SSH_AUTH_SOCK") == "" {
+		t.Skip("ssh agent is not available")
+	}
 	type fields struct {
 		remote   string
 		repoPath string
@@ -120,3 +128,58 @@ func TestBuiltInManager_Clone(t *testing.T) {
 //		})
 //	}
 //}
+
+func TestBuiltInManager_CheckoutCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) plumbing.Hash {
+		if err := ioutil.WriteFile(filepath.Join(dir, "main.tf"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add("main.tf"); err != nil {
+			t.Fatal(err)
+		}
+		h, err := wt.Commit(content, &git.CommitOptions{Author: &object.Signature{Name: "tfChek", When: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	reviewed := commit("reviewed")
+	commit("pushed after review")
+	b := &BuiltInManager{repoPath: dir, repo: repo}
+	tests := []struct {
+		name    string
+		sha     string
+		want    string
+		wantErr bool
+	}{
+		{name: "reviewed commit", sha: reviewed.String(), want: "reviewed"},
+		{name: "unknown commit", sha: "0123456789012345678901234567890123456789", want: "reviewed", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := b.CheckoutCommit(tt.sha); (err != nil) != tt.wantErr {
+				t.Errorf("CheckoutCommit() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			content, err := ioutil.ReadFile(filepath.Join(dir, "main.tf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("checked out content = %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
@@ -8,26 +8,36 @@ import (
 	"github.com/wix-playground/tfChek/misc"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 )
 import "golang.org/x/oauth2"
 
 type Client interface {
-	CreatePR(branch string) (*int, error)
-	CreateIssue(branch string, assignees *[]string) (*int, error)
+	//CreatePR opens a pull request of the branch. Task labels are listed in its body
+	CreatePR(branch string, labels map[string]string) (*int, error)
+	CreateIssue(branch string, assignees *[]string, labels map[string]string) (*int, error)
+	//ReportDrift comments the open tfChek issue with the given title or creates a new one. It returns the issue number and whether the issue is new
+	ReportDrift(title, body string) (int, bool, error)
 	RequestReview(number int, reviewers *[]string) error
 	Review(number int, comment string) error
 	Close(number int) error
 	Comment(number int, comment *string) error
-	Merge(number int, message string) (*string, error)
+	//Merge squashes the pull request if its head is still at the given commit. The current head is merged if sha is empty
+	Merge(number int, sha, message string) (*string, error)
 	DeleteBranch(number int) error
 	CleanupBranches(before *time.Time, mergedOnly bool) (map[string]bool, error)
 	//TODO: add cleanup Issues capability
 	//DeleteIssue()
 	//CleanupIssues()
 	GetArchiveLink(ref string) (*url.URL, error)
+	//HasBranch checks that the branch has been pushed to the repository
+	HasBranch(branch string) (bool, error)
+	//CanWrite checks that the user is allowed to push to the repository
+	CanWrite(user string) (bool, error)
 }
 
 type ClientRunSH struct {
@@ -56,11 +66,57 @@ func (c *ClientRunSH) GetArchiveLink(ref string) (*url.URL, error) {
 	return link, nil
 }
 
+func (c *ClientRunSH) HasBranch(branch string) (bool, error) {
+	_, response, err := c.client.Git.GetRef(c.context, c.Owner, c.Repository, "heads/"+branch)
+	if err != nil {
+		if response != nil && response.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get branch %s. Error: %w", branch, err)
+	}
+	return true, nil
+}
+
+func (c *ClientRunSH) CanWrite(user string) (bool, error) {
+	level, _, err := c.client.Repositories.GetPermissionLevel(c.context, c.Owner, c.Repository, user)
+	if err != nil {
+		return false, fmt.Errorf("failed to get permission of %s. Error: %w", user, err)
+	}
+	switch level.GetPermission() {
+	case "admin", "maintain", "write":
+		return true, nil
+	}
+	return false, nil
+}
+
 func wrapComment(data string) *string {
 	code := fmt.Sprintf("Command output:\n```%s```", data)
 	return &code
 }
 
+//withLabels appends the task labels to the body as a markdown list sorted by the keys
+func withLabels(body string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return body
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var builder strings.Builder
+	builder.WriteString(body)
+	builder.WriteString("\n\n**Labels:**\n")
+	for _, k := range keys {
+		if labels[k] == "" {
+			builder.WriteString(fmt.Sprintf("- `%s`\n", k))
+		} else {
+			builder.WriteString(fmt.Sprintf("- `%s`: %s\n", k, labels[k]))
+		}
+	}
+	return builder.String()
+}
+
 func (c *ClientRunSH) getHeadSHA(number int) (string, error) {
 	pullRequest, _, err := c.client.PullRequests.Get(c.context, c.Owner, c.Repository, number)
 	if err != nil {
@@ -199,7 +255,7 @@ func (c *ClientRunSH) CleanupBranches(before *time.Time, mergedOnly bool) (map[s
 			misc.Debugf("Skip not merged PR %d", pr.ID)
 			continue
 		} else {
-			misc.Debugf("abotu to delete branch %s from PR %d", ref, *pr.Title)
+			misc.Debugf("about to delete branch %s from PR %d", ref, pr.GetNumber())
 		}
 		parts := strings.Split(ref, "/")
 		branch := parts[len(parts)-1]
@@ -251,11 +307,14 @@ func (c *ClientRunSH) CleanupBranches(before *time.Time, mergedOnly bool) (map[s
 }
 
 //Returns merge SHA commit hash and error
-func (c *ClientRunSH) Merge(number int, message string) (*string, error) {
-	sha, err := c.getHeadSHA(number)
-	if err != nil {
-		log.Printf("Failed to get SHA of the head commit. Error: %s", err)
-		return nil, err
+func (c *ClientRunSH) Merge(number int, sha, message string) (*string, error) {
+	if sha == "" {
+		head, err := c.getHeadSHA(number)
+		if err != nil {
+			log.Printf("Failed to get SHA of the head commit. Error: %s", err)
+			return nil, err
+		}
+		sha = head
 	}
 	pro := &github.PullRequestOptions{CommitTitle: message, SHA: sha, MergeMethod: "squash"}
 	mergeResult, _, err := c.client.PullRequests.Merge(c.context, c.Owner, c.Repository, number, message, pro)
@@ -267,9 +326,9 @@ func (c *ClientRunSH) Merge(number int, message string) (*string, error) {
 	return mergeResult.SHA, nil
 }
 
-func (c *ClientRunSH) CreateIssue(branch string, assignees *[]string) (*int, error) {
+func (c *ClientRunSH) CreateIssue(branch string, assignees *[]string, labels map[string]string) (*int, error) {
 	newIssue := &github.IssueRequest{Title: github.String(fmt.Sprintf("Cannot merge branch %s", branch)),
-		Body: github.String("_This pull request was automatically generated by tfChek_\nPlease fix this issue"), Labels: &[]string{misc.IssueLabel}}
+		Body: github.String(withLabels("_This pull request was automatically generated by tfChek_\nPlease fix this issue", labels)), Labels: &[]string{misc.IssueLabel}}
 	if assignees != nil && len(*assignees) > 0 {
 		a := *assignees
 		newIssue.Assignee = &a[0]
@@ -295,6 +354,51 @@ func (c *ClientRunSH) CreateIssue(branch string, assignees *[]string) (*int, err
 	return issue.Number, nil
 }
 
+func (c *ClientRunSH) findOpenIssue(title string) (*github.Issue, error) {
+	listOptions := &github.IssueListByRepoOptions{State: "open", Labels: []string{misc.IssueLabel}, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		iss, response, err := c.client.Issues.ListByRepo(c.context, c.Owner, c.Repository, listOptions)
+		if err != nil {
+			if response != nil {
+				misc.Debugf("Response status %d %s. Body: %s", response.StatusCode, response.Status, response.Body)
+			}
+			return nil, fmt.Errorf("cannot list issues labelled %s, Error: %w", misc.IssueLabel, err)
+		}
+		for _, issue := range iss {
+			if !issue.IsPullRequest() && issue.GetTitle() == title {
+				return issue, nil
+			}
+		}
+		if response.NextPage == 0 {
+			return nil, nil
+		}
+		listOptions.Page = response.NextPage
+	}
+}
+
+func (c *ClientRunSH) ReportDrift(title, body string) (int, bool, error) {
+	issue, err := c.findOpenIssue(title)
+	if err != nil {
+		return 0, false, err
+	}
+	if issue != nil {
+		err = c.Comment(issue.GetNumber(), &body)
+		if err != nil {
+			return issue.GetNumber(), false, fmt.Errorf("cannot comment issue %d, Error: %w", issue.GetNumber(), err)
+		}
+		log.Printf("issue has been updated %s", issue.GetHTMLURL())
+		return issue.GetNumber(), false, nil
+	}
+	newIssue := &github.IssueRequest{Title: &title, Body: &body, Labels: &[]string{misc.IssueLabel}}
+	issue, _, err = c.client.Issues.Create(c.context, c.Owner, c.Repository, newIssue)
+	if err != nil {
+		log.Printf("Cannot create new issue. Error: %s", err)
+		return 0, false, err
+	}
+	log.Printf("issue has been created %s", issue.GetHTMLURL())
+	return issue.GetNumber(), true, nil
+}
+
 func NewClientRunSH(repository, owner, token string) *ClientRunSH {
 	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
@@ -317,12 +421,12 @@ func (c *ClientRunSH) Comment(number int, comment *string) error {
 	return nil
 }
 
-func (c *ClientRunSH) CreatePR(branch string) (*int, error) {
+func (c *ClientRunSH) CreatePR(branch string, labels map[string]string) (*int, error) {
 
 	newPR := &github.NewPullRequest{Title: github.String("Automatic"),
 		Head:                github.String(branch),
 		Base:                github.String("master"),
-		Body:                github.String("tfChek generated pull request"),
+		Body:                github.String(withLabels("tfChek generated pull request", labels)),
 		MaintainerCanModify: github.Bool(true)}
 	pr, _, err := c.client.PullRequests.Create(c.context, c.Owner, c.Repository, newPR)
 	if err != nil {
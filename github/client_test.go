@@ -1,13 +1,26 @@
 package github
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
 var num int = 1
 
+//requireToken skips tests which talk to the real GitHub API
+func requireToken(t *testing.T) {
+	if os.Getenv("TFCHEK_TOKEN") == "" {
+		t.Skip("TFCHEK_TOKEN is not set")
+	}
+}
+
 func TestClientRunSH_CreatePR(t *testing.T) {
+	requireToken(t)
 	type fields struct {
 		Repository string
 		Owner      string
@@ -39,7 +52,7 @@ func TestClientRunSH_CreatePR(t *testing.T) {
 			//	Token:      tt.fields.Token,
 			//}
 			c := NewClientRunSH(tt.fields.Repository, tt.fields.Owner, tt.fields.Token)
-			n, err := c.CreatePR(tt.args.branch)
+			n, err := c.CreatePR(tt.args.branch, nil)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CreatePR() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -51,6 +64,7 @@ func TestClientRunSH_CreatePR(t *testing.T) {
 }
 
 func TestClientRunSH_RequestReview(t *testing.T) {
+	requireToken(t)
 	type fields struct {
 		Repository string
 		Owner      string
@@ -95,6 +109,7 @@ func TestClientRunSH_RequestReview(t *testing.T) {
 }
 
 func TestClientRunSH_Review(t *testing.T) {
+	requireToken(t)
 	type fields struct {
 		Repository string
 		Owner      string
@@ -130,6 +145,7 @@ func TestClientRunSH_Review(t *testing.T) {
 }
 
 func TestClientRunSH_Comment(t *testing.T) {
+	requireToken(t)
 	cmnt := "test tfChek ------------ long comment"
 	type fields struct {
 		Repository string
@@ -166,6 +182,7 @@ func TestClientRunSH_Comment(t *testing.T) {
 }
 
 func TestClientRunSH_Close(t *testing.T) {
+	requireToken(t)
 	type fields struct {
 		Repository string
 		Owner      string
@@ -198,3 +215,65 @@ func TestClientRunSH_Close(t *testing.T) {
 		})
 	}
 }
+
+func Test_withLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"No labels", nil, "body"},
+		{"Sorted labels", map[string]string{"jira": "OPS-1", "ci": "https://ci.example.com/job/42", "hotfix": ""},
+			"body\n\n**Labels:**\n- `ci`: https://ci.example.com/job/42\n- `hotfix`\n- `jira`: OPS-1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withLabels("body", tt.labels); got != tt.want {
+				t.Errorf("withLabels() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientRunSH_CanWrite(t *testing.T) {
+	permissions := map[string]string{"owner": "admin", "maintainer": "maintain", "developer": "write", "reader": "read", "outsider": "none"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/wix-system/infra/collaborators/"), "/permission")
+		p, ok := permissions[user]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"permission": %q}`, p)
+	}))
+	defer srv.Close()
+	c := NewClientRunSH("infra", "wix-system", "")
+	base, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.BaseURL = base
+	tests := []struct {
+		user    string
+		want    bool
+		wantErr bool
+	}{
+		{"owner", true, false},
+		{"maintainer", true, false},
+		{"developer", true, false},
+		{"reader", false, false},
+		{"outsider", false, false},
+		{"unknown", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			got, err := c.CanWrite(tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CanWrite() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CanWrite() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
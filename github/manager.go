@@ -1,10 +1,12 @@
 package github
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/viper"
 	"github.com/whilp/git-urls"
 	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
 	"log"
 	"regexp"
 	"strconv"
@@ -15,7 +17,13 @@ var ml sync.Mutex
 var managers map[string]*Manager = make(map[string]*Manager)
 
 type Manager struct {
-	data       chan *TaskResult
+	data chan *TaskResult
+	done chan struct{}
+	//closing is closed together with setting stopped, so the senders waiting for the room in data give up
+	closing chan struct{}
+	//senders are the Send calls in progress. Data is closed once they are over
+	senders    sync.WaitGroup
+	lock       sync.RWMutex
 	client     Client
 	stopped    bool
 	started    bool
@@ -24,20 +32,56 @@ type Manager struct {
 
 type TaskResult struct {
 	taskId     int
+	branch     string
 	successful bool
-	log        *string
-	authors    *[]string
+	cancelled  bool
+	//drift is the title of the issue, which reports the drift found by the scheduled plan
+	drift string
+	//review is the pull request of Apply -> Push flow. The result is commented there instead of creating a new pull request
+	review *storer.PullRequestRef
+	//merge the reviewed pull request
+	merge   bool
+	log     *string
+	authors *[]string
+	//labels of the task are shown in the pull request or issue body
+	labels map[string]string
 }
 
 func NewTaskResult(taskId int, successful bool, output *string, authors *[]string) *TaskResult {
-	return &TaskResult{log: output, successful: successful, taskId: taskId, authors: authors}
+	return NewBranchTaskResult(taskId, misc.TaskPrefix+strconv.Itoa(taskId), successful, output, authors)
+}
+
+//NewBranchTaskResult is used for the tasks, which have been run against a branch other than their own one (re-runs for example)
+func NewBranchTaskResult(taskId int, branch string, successful bool, output *string, authors *[]string) *TaskResult {
+	return &TaskResult{log: output, successful: successful, taskId: taskId, branch: branch, authors: authors}
+}
+
+//NewCancelledTaskResult is used for the tasks, which have been cancelled by a user while running. Neither PR nor issue is created for them
+func NewCancelledTaskResult(taskId int, branch string, output *string, authors *[]string) *TaskResult {
+	return &TaskResult{log: output, successful: false, cancelled: true, taskId: taskId, branch: branch, authors: authors}
+}
+
+//NewDriftTaskResult is used for the scheduled plans, which have found a drift of the infrastructure from the code
+func NewDriftTaskResult(taskId int, branch, title string, output *string) *TaskResult {
+	return &TaskResult{log: output, successful: true, taskId: taskId, branch: branch, drift: title}
+}
+
+//NewReviewTaskResult is used for the plans and applies of the pull request. The pull request is merged only if merge is set
+func NewReviewTaskResult(taskId int, branch string, review *storer.PullRequestRef, successful, merge bool, output *string, authors *[]string) *TaskResult {
+	return &TaskResult{log: output, successful: successful, taskId: taskId, branch: branch, authors: authors, review: review, merge: merge}
+}
+
+//WithLabels sets the labels of the task, which are rendered to the pull request or issue body
+func (r *TaskResult) WithLabels(labels map[string]string) *TaskResult {
+	r.labels = labels
+	return r
 }
 
 func InitManager(repository, owner, token string) {
 	ml.Lock()
 	s := make(chan *TaskResult, 20)
 	c := NewClientRunSH(extractRepoName(repository), owner, token)
-	managers[repository] = &Manager{data: s, client: c, stopped: false, started: false, Repository: repository}
+	managers[repository] = &Manager{data: s, done: make(chan struct{}), closing: make(chan struct{}), client: c, stopped: false, started: false, Repository: repository}
 	ml.Unlock()
 	return
 }
@@ -46,14 +90,15 @@ func extractRepoName(repository string) string {
 	parsed, err := giturls.Parse(repository)
 	if err != nil {
 		if viper.GetBool(misc.DebugKey) {
-			log.Printf("Cannot parse URL: '%s' falling back to original")
+			log.Printf("Cannot parse URL: '%s' falling back to original", repository)
 		}
 		return repository
 	}
-	re, err := regexp.Compile(".*/(.*?)(\\.git)*$")
+	pattern := ".*/(.*?)(\\.git)*$"
+	re, err := regexp.Compile(pattern)
 	if err != nil {
 		if viper.GetBool(misc.DebugKey) {
-			log.Printf("Cannot compile regex '%s' falling back to original")
+			log.Printf("Cannot compile regex '%s' falling back to original", pattern)
 		}
 		return repository
 	}
@@ -68,7 +113,9 @@ func extractRepoName(repository string) string {
 }
 
 func GetManager(repository string) *Manager {
+	ml.Lock()
 	m := managers[repository]
+	ml.Unlock()
 	if m == nil {
 		if viper.GetBool(misc.DebugKey) {
 			log.Printf("No GitHub manager for the repository %s. You might want to initialize this manager first", repository)
@@ -78,6 +125,8 @@ func GetManager(repository string) *Manager {
 }
 
 func GetAllManagers() []*Manager {
+	ml.Lock()
+	defer ml.Unlock()
 	var mgrs []*Manager
 	for _, v := range managers {
 		mgrs = append(mgrs, v)
@@ -86,6 +135,8 @@ func GetAllManagers() []*Manager {
 }
 
 func (m *Manager) Start() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if !m.started {
 		m.started = true
 		go m.starter()
@@ -93,12 +144,14 @@ func (m *Manager) Start() {
 }
 
 func (m *Manager) starter() {
+	defer close(m.done)
 	for {
-		if m.stopped {
-			break
-		}
 		log.Println("Waiting for a new taskResult to create pull request")
-		taskResult := <-m.data
+		taskResult, ok := <-m.data
+		if !ok {
+			//Manager has been closed and all the accepted results are processed
+			return
+		}
 		if taskResult != nil {
 			process(m, taskResult)
 		}
@@ -106,14 +159,28 @@ func (m *Manager) starter() {
 }
 
 func process(m *Manager, prd *TaskResult) {
-	branch := misc.TaskPrefix + strconv.Itoa(prd.taskId)
+	branch := prd.branch
+	if prd.cancelled {
+		//Cancelled run is not a failure, so there is nothing to report with an issue
+		log.Printf("Task %d has been cancelled. Skipping creation of GitHub issue for branch %s", prd.taskId, branch)
+		return
+	}
+	if prd.drift != "" {
+		processDrift(m, prd)
+		return
+	}
+	if prd.review != nil {
+		processReview(m, prd)
+		return
+	}
 	switch prd.successful {
 	case true:
-		number, err := m.client.CreatePR(branch)
+		number, err := m.client.CreatePR(branch, prd.labels)
 		if err != nil {
 			log.Printf("Failed to create GitHub PR Error: %s", err)
 		} else {
 			log.Printf("New PR #%d has been created", *number)
+			recordTaskReference(m, prd.taskId, *number, false)
 			err = m.client.RequestReview(*number, prd.authors)
 			if err != nil {
 				log.Println("Failed to assign reviewers")
@@ -132,7 +199,7 @@ func process(m *Manager, prd *TaskResult) {
 				log.Printf("Automatic merging of branch %s is disabled due to %s option set to true", branch, misc.Fuse)
 			} else {
 				message := fmt.Sprintf("Automatically merged by tfChek (Authors %v)", *prd.authors)
-				sha, err := m.client.Merge(*number, message)
+				sha, err := m.client.Merge(*number, "", message)
 				if err != nil {
 					log.Printf("Cannot merge branch %s, Error: %s", branch, err)
 				} else {
@@ -141,11 +208,12 @@ func process(m *Manager, prd *TaskResult) {
 			}
 		}
 	case false:
-		number, err := m.client.CreateIssue(branch, prd.authors)
+		number, err := m.client.CreateIssue(branch, prd.authors, prd.labels)
 		if err != nil {
 			log.Printf("Failed to create GitHub Issue Error: %s", err)
 		} else {
 			log.Printf("New Issue #%d has been created", *number)
+			recordTaskReference(m, prd.taskId, *number, true)
 			err = m.client.Comment(*number, wrapComment(*prd.log))
 			if err != nil {
 				log.Printf("Cannot comment issue %d Error: %s", number, err)
@@ -154,22 +222,158 @@ func process(m *Manager, prd *TaskResult) {
 	}
 }
 
-func (m *Manager) GetChannel() chan<- *TaskResult {
-	return m.data
+//processReview comments the pull request with the output. Approved pull request gets merged after the successful apply.
+//Failed apply is reported with an issue like in Push -> Apply flow
+func processReview(m *Manager, prd *TaskResult) {
+	number := prd.review.Number
+	result := "has succeeded"
+	if !prd.successful {
+		result = "has failed"
+	}
+	comment := fmt.Sprintf("tfChek %s (task %d) of commit %s %s\n%s", prd.review.Stage, prd.taskId, prd.review.Sha, result, *wrapComment(*prd.log))
+	err := m.client.Comment(number, &comment)
+	if err != nil {
+		log.Printf("Cannot comment PR %d Error: %s", number, err)
+	} else {
+		recordTaskReference(m, prd.taskId, number, false)
+	}
+	if prd.review.Stage != storer.StageApply {
+		return
+	}
+	if !prd.successful {
+		issue, err := m.client.CreateIssue(prd.branch, prd.authors, prd.labels)
+		if err != nil {
+			log.Printf("Failed to create GitHub Issue Error: %s", err)
+			return
+		}
+		log.Printf("New Issue #%d has been created", *issue)
+		recordTaskReference(m, prd.taskId, *issue, true)
+		err = m.client.Comment(*issue, wrapComment(*prd.log))
+		if err != nil {
+			log.Printf("Cannot comment issue %d Error: %s", *issue, err)
+		}
+		return
+	}
+	if !prd.merge {
+		return
+	}
+	if viper.GetBool(misc.Fuse) {
+		log.Printf("Automatic merging of PR #%d is disabled due to %s option set to true", number, misc.Fuse)
+		return
+	}
+	message := fmt.Sprintf("Applied and merged by tfChek (Authors %v)", *prd.authors)
+	//GitHub rejects the merge if the head has moved away from the applied commit
+	sha, err := m.client.Merge(number, prd.review.Sha, message)
+	if err != nil {
+		log.Printf("Cannot merge PR #%d, Error: %s", number, err)
+	} else {
+		log.Printf("PR #%d has been merged. Merge commit hash %s", number, *sha)
+	}
+}
+
+//processDrift keeps a single open issue per drift. Every new drift is added to the issue as a comment
+func processDrift(m *Manager, prd *TaskResult) {
+	body := fmt.Sprintf("_This issue was automatically generated by tfChek_\nScheduled plan (task %d) of %s shows changes\n%s", prd.taskId, prd.branch, *wrapComment(*prd.log))
+	number, created, err := m.client.ReportDrift(prd.drift, body)
+	if err != nil {
+		log.Printf("Failed to report drift of task %d. Error: %s", prd.taskId, err)
+		return
+	}
+	if created {
+		log.Printf("New Issue #%d has been created", number)
+	} else {
+		log.Printf("Issue #%d has been updated", number)
+	}
+	recordTaskReference(m, prd.taskId, number, true)
 }
 
 func (m *Manager) GetClient() Client {
 	return m.client
 }
 
+//Send passes the task result for processing. Results sent after the manager has been closed are dropped.
+//The lock is not held while waiting for the room in the queue, so Close is not blocked by the full queue
+func (m *Manager) Send(result *TaskResult) bool {
+	m.lock.RLock()
+	if m.stopped {
+		m.lock.RUnlock()
+		log.Printf("GitHub manager for %s is closed. Result of task %d will not be reported", m.Repository, result.taskId)
+		return false
+	}
+	m.senders.Add(1)
+	m.lock.RUnlock()
+	defer m.senders.Done()
+	select {
+	case m.data <- result:
+		return true
+	case <-m.closing:
+		log.Printf("GitHub manager for %s has been closed while waiting. Result of task %d will not be reported", m.Repository, result.taskId)
+		return false
+	}
+}
+
+//Close stops accepting new task results. The results accepted before are still processed
 func (m *Manager) Close() {
+	m.lock.Lock()
+	if m.stopped {
+		m.lock.Unlock()
+		return
+	}
 	m.stopped = true
+	close(m.closing)
+	m.lock.Unlock()
+	m.senders.Wait()
 	close(m.data)
 }
 
+//Flush waits until all the accepted task results are processed. The manager has to be closed first
+func (m *Manager) Flush(ctx context.Context) error {
+	m.lock.RLock()
+	started := m.started
+	m.lock.RUnlock()
+	if !started {
+		return nil
+	}
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("GitHub manager for %s has not processed all the task results in time %w", m.Repository, ctx.Err())
+	}
+}
+
 func CloseAll() {
-	for repo, manager := range managers {
-		log.Printf("Stopping GitHub manager for git repository %s", repo)
+	for _, manager := range GetAllManagers() {
+		log.Printf("Stopping GitHub manager for git repository %s", manager.Repository)
 		manager.Close()
 	}
 }
+
+//FlushAll closes all the managers and waits until they create pull requests and issues for the results accepted before
+func FlushAll(ctx context.Context) error {
+	CloseAll()
+	var lastErr error
+	for _, manager := range GetAllManagers() {
+		err := manager.Flush(ctx)
+		if err != nil {
+			log.Printf("Cannot flush GitHub manager for git repository %s. Error: %s", manager.Repository, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+//recordTaskReference saves the number of created pull request or issue to the task record, so it can be queried via API
+func recordTaskReference(m *Manager, taskId, number int, issue bool) {
+	ref := storer.GitHubRef{Repository: m.Repository, Number: number}
+	err := storer.UpdateTaskRecord(taskId, func(rec *storer.TaskRecord) {
+		if issue {
+			rec.Issues = append(rec.Issues, ref)
+		} else {
+			rec.PullRequests = append(rec.PullRequests, ref)
+		}
+	})
+	if err != nil {
+		misc.Debugf("cannot save GitHub reference #%d of task %d. Error: %s", number, taskId, err)
+	}
+}
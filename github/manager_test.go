@@ -0,0 +1,42 @@
+package github
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManager_CloseWhileSending(t *testing.T) {
+	m := &Manager{data: make(chan *TaskResult, 1), done: make(chan struct{}), closing: make(chan struct{}), Repository: "git@github.com:wix-system/manager.git"}
+	if !m.Send(NewTaskResult(1, true, nil, nil)) {
+		t.Fatalf("Send() to the open manager has been dropped")
+	}
+	//The queue is full and nothing processes it, so the sender waits
+	sent := make(chan bool)
+	go func() {
+		sent <- m.Send(NewTaskResult(2, true, nil, nil))
+	}()
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() is blocked by the waiting sender")
+	}
+	if <-sent {
+		t.Errorf("Send() waiting for the room has to be dropped on Close()")
+	}
+	if m.Send(NewTaskResult(3, true, nil, nil)) {
+		t.Errorf("Send() to the closed manager has to be dropped")
+	}
+	//The accepted result is still processed
+	if r, ok := <-m.data; !ok || r.taskId != 1 {
+		t.Errorf("accepted result has been lost")
+	}
+	if _, ok := <-m.data; ok {
+		t.Errorf("queue of the closed manager has to be closed")
+	}
+	m.Close()
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/misc"
 	"os"
-	"time"
 )
 
 type RepoManager struct {
@@ -15,10 +14,10 @@ type RepoManager struct {
 	cloned        bool
 	Reference     string
 	githubManager *Manager
-	webhookLocks  map[string]chan string
+	webhookLocks  *WebhookLocks
 }
 
-func NewRepomanager(path, remote string, webhookLocks map[string]chan string) *RepoManager {
+func NewRepomanager(path, remote string, webhookLocks *WebhookLocks) *RepoManager {
 	rm := RepoManager{path: path, remote: remote, webhookLocks: webhookLocks, basePath: path}
 	rm.githubManager = GetManager(remote)
 	if rm.githubManager == nil {
@@ -83,6 +82,14 @@ func (r *RepoManager) SwitchTo(branch string) error {
 	return r.Checkout(branch)
 }
 
+//CheckoutCommit downloads the archive of the commit instead of the branch head
+func (r *RepoManager) CheckoutCommit(sha string) error {
+	if sha == r.Reference {
+		return nil
+	}
+	return r.SwitchTo(sha)
+}
+
 func (r *RepoManager) Clone() error {
 	return r.Checkout("master")
 }
@@ -108,54 +115,43 @@ func (r *RepoManager) IsCloned() bool {
 	return r.cloned
 }
 
+//WaitForWebhook blocks until the webhook of the branch comes. The timeout is handled according to the webhook wait policy of the repository
 func (r *RepoManager) WaitForWebhook(branch string, timeout int) error {
 	if timeout < 0 {
 		return fmt.Errorf("timeout value cannot be negative")
 	}
-	if c, ok := r.webhookLocks[branch]; ok {
-		if c != nil {
-			select {
-			case branchName := <-c:
-				if branchName != branch {
-					if len(branchName) > 0 {
-						misc.Debugf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
-						return fmt.Errorf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
-					} else {
-						misc.Debugf("warning. empty branch name in webhook wait at %s branch %s", r.path, branch)
-					}
-				} else {
-					delete(r.webhookLocks, branch)
-					misc.Debugf("webhook lock has been successfully consumed for branch %s", branch)
-				}
-			case <-time.After(time.Duration(timeout) * time.Second):
-				misc.Debugf("webhook lock timeout reached after %d seconds for branch %s", timeout, branch)
-				//Here I will not return an error, giving  chance eto fetch and checkout needed branch anyway.
-				//return fmt.Errorf("webhook lock timeout reached after %d seconds for task %d", timeout,taskId)
-			}
-		} else {
-			misc.Debugf("webhook lock for branch %s is nil", branch)
-			return fmt.Errorf("webhook lock for branch %s is nil", branch)
-		}
-	} else {
+	c, ok := r.webhookLocks.Get(branch)
+	if !ok {
 		misc.Debugf("no lock for a branch %s in repo %s exists", branch, r.path)
 		return fmt.Errorf("no lock for a branch %s in repo %s exists", branch, r.path)
 	}
-	return nil
+	if c == nil {
+		misc.Debugf("webhook lock for branch %s is nil", branch)
+		return fmt.Errorf("webhook lock for branch %s is nil", branch)
+	}
+	err := AwaitWebhook(c, r.remote, branch, timeout)
+	//Nobody waits for the webhook anymore
+	r.webhookLocks.Remove(branch)
+	return err
 }
 
 func (r *RepoManager) UnlockWebhookLock(branch string) error {
-	if bl, ok := r.webhookLocks[branch]; ok {
-		bl <- branch
-		close(bl)
-	} else {
+	if !r.webhookLocks.Unlock(branch) {
+		return fmt.Errorf("webhook for branch %s has not been registered", branch)
+	}
+	return nil
+}
+
+func (r *RepoManager) ReleaseWebhookLock(branch string) error {
+	if !r.webhookLocks.Remove(branch) {
 		return fmt.Errorf("webhook for branch %s has not been registered", branch)
 	}
+	misc.Debugf("webhook lock for a branch %s in repo %s has been released", branch, r.path)
 	return nil
 }
 
 func (r *RepoManager) RegisterWebhookLock(branch string) error {
-	if _, ok := r.webhookLocks[branch]; !ok {
-		r.webhookLocks[branch] = make(chan string, 1)
+	if r.webhookLocks.Register(branch) {
 		misc.Debugf("webhook lock for a branch %s in repo %s has been successfully registered", branch, r.path)
 	} else {
 		return fmt.Errorf("git manager for %s already has locking channel for the branch %s", r.path, branch)
@@ -0,0 +1,169 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/whilp/git-urls"
+	"github.com/wix-playground/tfChek/misc"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Policies of the task, which webhook has not come in time
+const (
+	//WebhookWaitStrict fails the task
+	WebhookWaitStrict = "strict"
+	//WebhookWaitLenient lets the task fetch and check out the branch anyway
+	WebhookWaitLenient = "lenient"
+	//WebhookWaitPoll asks GitHub for the branch while waiting and fails the task if the branch does not appear
+	WebhookWaitPoll = "poll"
+)
+
+var ErrWebhookTimeout = errors.New("webhook has not come in time")
+
+//branchPollInterval is how often GitHub is asked for the branch by the poll policy
+var branchPollInterval = 10 * time.Second
+
+//branchExists is replaced in tests
+var branchExists = func(remote, branch string) (bool, error) {
+	m := GetManager(remote)
+	if m == nil {
+		return false, fmt.Errorf("no GitHub manager for the repository %s", remote)
+	}
+	return m.GetClient().HasBranch(branch)
+}
+
+//WebhookLocks are the channels the tasks wait on for the webhooks of their branches.
+//They are shared by the git managers of the same repository and are accessed by the tasks, the webhook handler and the reaper
+type WebhookLocks struct {
+	lock     sync.Mutex
+	channels map[string]chan string
+}
+
+func NewWebhookLocks() *WebhookLocks {
+	return &WebhookLocks{channels: make(map[string]chan string)}
+}
+
+//Register adds the lock of the branch. It returns false if the branch is locked already
+func (w *WebhookLocks) Register(branch string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.channels[branch]; ok {
+		return false
+	}
+	w.channels[branch] = make(chan string, 1)
+	return true
+}
+
+//Get returns the channel the webhook of the branch is sent to
+func (w *WebhookLocks) Get(branch string) (chan string, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	c, ok := w.channels[branch]
+	return c, ok
+}
+
+//Unlock passes the webhook to the task waiting for the branch. It returns false if the branch is not locked
+func (w *WebhookLocks) Unlock(branch string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	c, ok := w.channels[branch]
+	if !ok {
+		return false
+	}
+	c <- branch
+	close(c)
+	return true
+}
+
+//Remove drops the lock of the branch. It returns false if the branch is not locked
+func (w *WebhookLocks) Remove(branch string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, ok := w.channels[branch]; !ok {
+		return false
+	}
+	delete(w.channels, branch)
+	return true
+}
+
+//GetWebhookWaitPolicy returns the policy of the repository. Policies are configured per full repository name or remote URL
+func GetWebhookWaitPolicy(remote string) string {
+	policy := viper.GetString(misc.WebhookWaitPolicyKey)
+	fullName := repoFullName(remote)
+	for repo, p := range viper.GetStringMapString(misc.WebhookPoliciesKey) {
+		if strings.EqualFold(repo, fullName) || strings.EqualFold(repo, remote) {
+			policy = p
+			break
+		}
+	}
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	switch policy {
+	case WebhookWaitStrict, WebhookWaitLenient, WebhookWaitPoll:
+		return policy
+	default:
+		log.Printf("Unknown webhook wait policy '%s' of %s. Falling back to %s", policy, remote, WebhookWaitLenient)
+		return WebhookWaitLenient
+	}
+}
+
+//AwaitWebhook waits for the branch name sent to the webhook lock. What happens on timeout is decided by the policy of the repository
+func AwaitWebhook(lock <-chan string, remote, branch string, timeout int) error {
+	policy := GetWebhookWaitPolicy(remote)
+	deadline := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer deadline.Stop()
+	var poll <-chan time.Time
+	if policy == WebhookWaitPoll {
+		ticker := time.NewTicker(branchPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case branchName := <-lock:
+			if branchName != branch {
+				if len(branchName) > 0 {
+					misc.Debugf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
+					return fmt.Errorf("webhook lock for branch %s received wrong value %s in its bucket. It should be the same. This should never happen. Please contact developers", branch, branchName)
+				}
+				misc.Debugf("warning. empty branch name in webhook wait at %s branch %s", remote, branch)
+				return nil
+			}
+			misc.Debugf("webhook lock has been successfully consumed for branch %s", branch)
+			return nil
+		case <-poll:
+			found, err := branchExists(remote, branch)
+			if err != nil {
+				misc.Debugf("cannot check branch %s at %s. Error: %s", branch, remote, err)
+				continue
+			}
+			if found {
+				misc.Debugf("branch %s has been found at %s without a webhook", branch, remote)
+				return nil
+			}
+		case <-deadline.C:
+			misc.Debugf("webhook lock timeout reached after %d seconds for branch %s (policy %s)", timeout, branch, policy)
+			switch policy {
+			case WebhookWaitLenient:
+				//Giving chance to fetch and checkout needed branch anyway
+				return nil
+			case WebhookWaitPoll:
+				return fmt.Errorf("%w: branch %s has not appeared at %s in %d seconds", ErrWebhookTimeout, branch, remote, timeout)
+			default:
+				return fmt.Errorf("%w: no push of branch %s to %s has been notified in %d seconds", ErrWebhookTimeout, branch, remote, timeout)
+			}
+		}
+	}
+}
+
+//repoFullName returns owner/name of the repository or the remote itself if it cannot be parsed
+func repoFullName(remote string) string {
+	parsed, err := giturls.Parse(remote)
+	if err != nil {
+		return remote
+	}
+	return strings.TrimSuffix(strings.Trim(parsed.Path, "/"), ".git")
+}
@@ -0,0 +1,123 @@
+package github
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetWebhookWaitPolicy(t *testing.T) {
+	defer viper.Reset()
+	tests := []struct {
+		name     string
+		fallback string
+		policies map[string]string
+		remote   string
+		want     string
+	}{
+		{name: "default", fallback: WebhookWaitLenient, remote: "git@github.com:wix-system/tfChek.git", want: WebhookWaitLenient},
+		{name: "repository over default", fallback: WebhookWaitLenient, policies: map[string]string{"wix-system/tfchek": WebhookWaitStrict},
+			remote: "git@github.com:wix-system/tfChek.git", want: WebhookWaitStrict},
+		{name: "https remote", fallback: WebhookWaitStrict, policies: map[string]string{"wix-system/tfChek": WebhookWaitPoll},
+			remote: "https://github.com/wix-system/tfChek.git", want: WebhookWaitPoll},
+		{name: "other repository", fallback: WebhookWaitStrict, policies: map[string]string{"wix-system/other": WebhookWaitPoll},
+			remote: "git@github.com:wix-system/tfChek.git", want: WebhookWaitStrict},
+		{name: "unknown policy", fallback: "eventually", remote: "git@github.com:wix-system/tfChek.git", want: WebhookWaitLenient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			viper.Set(misc.WebhookWaitPolicyKey, tt.fallback)
+			if tt.policies != nil {
+				viper.Set(misc.WebhookPoliciesKey, tt.policies)
+			}
+			if got := GetWebhookWaitPolicy(tt.remote); got != tt.want {
+				t.Errorf("GetWebhookWaitPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAwaitWebhook(t *testing.T) {
+	defer viper.Reset()
+	defer func(f func(string, string) (bool, error), i time.Duration) {
+		branchExists = f
+		branchPollInterval = i
+	}(branchExists, branchPollInterval)
+	branchPollInterval = 10 * time.Millisecond
+	const remote = "git@github.com:wix-system/tfChek.git"
+	tests := []struct {
+		name    string
+		policy  string
+		webhook string
+		pushed  bool
+		wantErr bool
+		timeout bool
+	}{
+		{name: "webhook", policy: WebhookWaitStrict, webhook: "tfci-1"},
+		{name: "wrong branch", policy: WebhookWaitLenient, webhook: "tfci-2", wantErr: true},
+		{name: "lenient timeout", policy: WebhookWaitLenient},
+		{name: "strict timeout", policy: WebhookWaitStrict, wantErr: true, timeout: true},
+		{name: "branch found by poll", policy: WebhookWaitPoll, pushed: true},
+		{name: "poll timeout", policy: WebhookWaitPoll, wantErr: true, timeout: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			viper.Set(misc.WebhookWaitPolicyKey, tt.policy)
+			branchExists = func(r, b string) (bool, error) {
+				return tt.pushed && r == remote && b == "tfci-1", nil
+			}
+			lock := make(chan string, 1)
+			if tt.webhook != "" {
+				lock <- tt.webhook
+				close(lock)
+			}
+			err := AwaitWebhook(lock, remote, "tfci-1", 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AwaitWebhook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrWebhookTimeout) != tt.timeout {
+				t.Errorf("AwaitWebhook() error = %v, timeout %v", err, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestWebhookLocks(t *testing.T) {
+	locks := NewWebhookLocks()
+	var wg sync.WaitGroup
+	//Tasks, webhooks and the reaper use the locks at the same time
+	for i := 0; i < 20; i++ {
+		branch := "tfci-" + strconv.Itoa(i)
+		if !locks.Register(branch) {
+			t.Fatalf("Register(%s) = false, want true", branch)
+		}
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			if c, ok := locks.Get(branch); ok && c == nil {
+				t.Errorf("Get(%s) returned nil channel", branch)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			locks.Unlock(branch)
+		}()
+		go func() {
+			defer wg.Done()
+			locks.Remove(branch)
+		}()
+	}
+	wg.Wait()
+	if !locks.Register("tfci-0") || locks.Register("tfci-0") {
+		t.Errorf("Register() must add the lock of the branch once")
+	}
+	if !locks.Remove("tfci-0") || locks.Remove("tfci-0") || locks.Unlock("tfci-0") {
+		t.Errorf("removed lock must not be used anymore")
+	}
+}
@@ -0,0 +1,61 @@
+package launcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"os/exec"
+	"strings"
+)
+
+//Names of the execution backends
+const (
+	BackendLocal      = "local"
+	BackendDocker     = "docker"
+	BackendKubernetes = "kubernetes"
+)
+
+//ExecutionBackend runs processes of the task executors. The command is built by exec.Command with its directory and environment set.
+//The backend runs it as the current step of the workspace output, writes the output there and records how the step has finished.
+//It has to stop the process when the context is done
+type ExecutionBackend interface {
+	Name() string
+	Run(ctx context.Context, ws *Workspace, command *exec.Cmd) error
+}
+
+//getExecutionBackend returns the configured backend
+func getExecutionBackend() (ExecutionBackend, error) {
+	switch name := strings.ToLower(viper.GetString(misc.ExecutionBackendKey)); name {
+	case BackendLocal, "":
+		return localBackend{}, nil
+	case BackendDocker:
+		return newDockerBackend()
+	case BackendKubernetes:
+		return newKubernetesBackend()
+	default:
+		return nil, fmt.Errorf("unknown execution backend %q", name)
+	}
+}
+
+//runOnBackend runs the command with the configured backend
+func runOnBackend(ctx context.Context, ws *Workspace, command *exec.Cmd) error {
+	backend, err := getExecutionBackend()
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return err
+	}
+	misc.Debugf("running %s of task %d on %s backend", command.Args[0], ws.TaskId, backend.Name())
+	return backend.Run(ctx, ws, command)
+}
+
+//localBackend runs the process as the child of the server
+type localBackend struct{}
+
+func (localBackend) Name() string {
+	return BackendLocal
+}
+
+func (localBackend) Run(ctx context.Context, ws *Workspace, command *exec.Cmd) error {
+	return runProcess(ctx, ws, command)
+}
@@ -0,0 +1,245 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetExecutionBackend(t *testing.T) {
+	defer func() {
+		for _, k := range []string{misc.ExecutionBackendKey, misc.BackendImageKey, misc.KubeApiKey, misc.KubeVolumeClaimKey} {
+			viper.Set(k, nil)
+		}
+	}()
+	tests := []struct {
+		name    string
+		config  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: BackendLocal},
+		{name: "docker", config: map[string]string{misc.ExecutionBackendKey: "Docker", misc.BackendImageKey: "tools"}, want: BackendDocker},
+		{name: "docker without image", config: map[string]string{misc.ExecutionBackendKey: "docker"}, wantErr: true},
+		{name: "kubernetes", config: map[string]string{misc.ExecutionBackendKey: "kubernetes", misc.BackendImageKey: "tools",
+			misc.KubeApiKey: "https://k8s", misc.KubeVolumeClaimKey: "workspaces"}, want: BackendKubernetes},
+		{name: "kubernetes without claim", config: map[string]string{misc.ExecutionBackendKey: "kubernetes", misc.BackendImageKey: "tools",
+			misc.KubeApiKey: "https://k8s"}, wantErr: true},
+		{name: "unknown", config: map[string]string{misc.ExecutionBackendKey: "ssh"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{misc.ExecutionBackendKey, misc.BackendImageKey, misc.KubeApiKey, misc.KubeVolumeClaimKey} {
+				viper.Set(k, tt.config[k])
+			}
+			got, err := getExecutionBackend()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getExecutionBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name() != tt.want {
+				t.Errorf("getExecutionBackend() = %s, want %s", got.Name(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDockerBackendRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.OutDirKey, dir)
+	defer viper.Set(misc.OutDirKey, nil)
+	//Fake client prints its arguments and the value of the passed variable
+	docker := filepath.Join(dir, "docker")
+	err = ioutil.WriteFile(docker, []byte("#!/bin/sh\necho \"$@\"\necho \"secret=$TF_VAR_secret\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := storer.NewTaskFileSink(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := &Workspace{TaskId: 1, Root: filepath.Join(dir, "task-1"), Output: sink}
+	command := exec.Command("terraform", "plan")
+	command.Dir = filepath.Join(ws.Root, "production_42")
+	command.Env = []string{"PATH=/usr/bin:/bin", "TF_VAR_secret=hidden"}
+	b := &dockerBackend{docker: docker, image: "tools:1", args: []string{"--network", "host"}}
+	sink.StartStep("terraform")
+	err = b.Run(context.Background(), ws, command)
+	sink.Close()
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	out, err := storer.ReadTask(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--volume " + ws.Root + ":" + ws.Root + " --workdir " + command.Dir + " --env PATH --env TF_VAR_secret --network host tools:1 terraform plan\n"
+	if !strings.Contains(string(out), want) || !strings.Contains(string(out), "secret=hidden") {
+		t.Errorf("output %q does not contain %q and the secret", out, want)
+	}
+	if strings.Contains(strings.SplitN(string(out), "\n", 2)[0], "hidden") {
+		t.Errorf("secret is in the arguments %q", out)
+	}
+}
+
+//fakeKubernetes serves the job, the pod and its log
+type fakeKubernetes struct {
+	mu            sync.Mutex
+	job           map[string]interface{}
+	secret        map[string]interface{}
+	polls         int
+	deleted       bool
+	secretDeleted bool
+	//exitCode of the container or -1 to never start the pod
+	exitCode int
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	const ns = "/namespaces/tasks/"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1"+ns+"secrets":
+		json.NewDecoder(r.Body).Decode(&f.secret)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v1"+ns+"secrets/"):
+		f.secretDeleted = true
+	case r.Method == http.MethodPost && r.URL.Path == "/apis/batch/v1"+ns+"jobs":
+		json.NewDecoder(r.Body).Decode(&f.job)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1"+ns+"pods":
+		f.polls++
+		phase, state := "Pending", "{}"
+		if f.exitCode >= 0 && f.polls > 1 {
+			phase = "Running"
+			if f.polls > 2 {
+				phase = "Succeeded"
+				if f.exitCode != 0 {
+					phase = "Failed"
+				}
+				state = `{"terminated":{"exitCode":` + strconv.Itoa(f.exitCode) + `}}`
+			}
+		}
+		w.Write([]byte(`{"items":[{"metadata":{"name":"job-pod"},"status":{"phase":"` + phase + `","containerStatuses":[{"state":` + state + `}]}}]}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1"+ns+"pods/job-pod/log":
+		w.Write([]byte("Plan: 1 to add\n"))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/apis/batch/v1"+ns+"jobs/"):
+		f.deleted = true
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestKubernetesBackendRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.OutDirKey, dir)
+	defer viper.Set(misc.OutDirKey, nil)
+	viper.Set(misc.WorkspaceDirKey, filepath.Join(dir, "workspaces"))
+	defer viper.Set(misc.WorkspaceDirKey, nil)
+	defer func(interval time.Duration) { kubernetesPollInterval = interval }(kubernetesPollInterval)
+	kubernetesPollInterval = 10 * time.Millisecond
+	tests := []struct {
+		name     string
+		exitCode int
+		timeout  time.Duration
+		wantErr  bool
+		wantCode bool
+	}{
+		{name: "success", wantCode: true},
+		{name: "failure", exitCode: 2, wantErr: true, wantCode: true},
+		{name: "never started", exitCode: -1, timeout: 100 * time.Millisecond, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeKubernetes{exitCode: tt.exitCode}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			b := &kubernetesBackend{api: server.URL, namespace: "tasks", image: "tools:1", claim: "workspaces", client: server.Client()}
+			sink, err := storer.NewTaskFileSink(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := &Workspace{TaskId: i + 1, Root: filepath.Join(dir, "workspaces", "task-1"), Output: sink}
+			command := exec.Command("terraform", "plan")
+			command.Dir = ws.Root
+			command.Env = []string{"TF_INPUT=0"}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			sink.StartStep("terraform")
+			err = b.Run(ctx, ws, command)
+			sink.Close()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			run := sink.GetRunRecord()
+			if (run.ExitCode != nil) != tt.wantCode || (run.ExitCode != nil && *run.ExitCode != tt.exitCode) {
+				t.Errorf("exit code = %v, want %d", run.ExitCode, tt.exitCode)
+			}
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if !fake.deleted || !fake.secretDeleted {
+				t.Errorf("job deleted = %v, secret deleted = %v, want both deleted", fake.deleted, fake.secretDeleted)
+			}
+			spec, _ := json.Marshal(fake.job)
+			secret, _ := json.Marshal(fake.secret)
+			if strings.Contains(string(spec), "TF_INPUT") || !strings.Contains(string(secret), `"TF_INPUT":"0"`) {
+				t.Errorf("environment has to be passed with secret %s instead of job %s", secret, spec)
+			}
+			if !strings.Contains(string(spec), `"secretRef":{"name":"`+fake.secret["metadata"].(map[string]interface{})["name"].(string)+`"}`) {
+				t.Errorf("job %s does not refer to the secret", spec)
+			}
+			if !strings.Contains(string(spec), `"subPath":"task-1"`) || !strings.Contains(string(spec), `"claimName":"workspaces"`) {
+				t.Errorf("job %s does not mount the workspace", spec)
+			}
+			out, err := storer.ReadTask(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantCode && !strings.Contains(string(out), "Plan: 1 to add") {
+				t.Errorf("output %q does not contain the pod log", out)
+			}
+		})
+	}
+}
+
+func Test_jobName(t *testing.T) {
+	label := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	seen := make(map[string]bool)
+	for _, id := range []int{1, 1, 1, math.MaxInt64} {
+		name := jobName(id)
+		if len(name) > 63 || !label.MatchString(name) {
+			t.Errorf("jobName(%d) = %s is not a DNS label", id, name)
+		}
+		//Steps of the same task start back to back
+		if seen[name] {
+			t.Errorf("jobName(%d) = %s has been returned twice", id, name)
+		}
+		seen[name] = true
+	}
+}
@@ -0,0 +1,170 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrDispatcherStopped = errors.New("task dispatcher has been stopped")
+var ErrQueueFull = errors.New("task queue is full")
+
+//dispatcher keeps a queue per state lock and a worker reading it, so the tasks of the same state lock never run in parallel.
+//Queues and their workers are created on demand when a task is enqueued, there is no polling
+type dispatcher struct {
+	lock     sync.Mutex
+	queues   map[string]*taskQueue
+	qlength  int
+	pool     *workerPool
+	run      func(t Task)
+	started  bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+}
+
+//taskQueue holds pending tasks of a state lock. It is guarded by the dispatcher lock
+type taskQueue struct {
+	tasks []Task
+	//signal wakes the worker up when a task is added
+	signal chan struct{}
+}
+
+//newDispatcher creates a dispatcher, which accepts up to qlength pending tasks per state lock. Non positive qlength means no limit
+func newDispatcher(qlength int, pool *workerPool, run func(t Task)) *dispatcher {
+	return &dispatcher{queues: make(map[string]*taskQueue), qlength: qlength, pool: pool, run: run, stop: make(chan struct{})}
+}
+
+//start launches workers of the queues created so far. Queues created later get their workers immediately
+func (d *dispatcher) start() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.started {
+		return
+	}
+	d.started = true
+	for name, queue := range d.queues {
+		d.spawn(name, queue)
+	}
+}
+
+//enqueue puts the task to the queue of its state lock. It never blocks, ErrQueueFull is returned when the queue is full
+func (d *dispatcher) enqueue(t Task) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.isStopped() {
+		return ErrDispatcherStopped
+	}
+	name := t.SyncName()
+	queue, ok := d.queues[name]
+	if !ok {
+		queue = &taskQueue{signal: make(chan struct{}, 1)}
+		d.queues[name] = queue
+		if d.started {
+			d.spawn(name, queue)
+		}
+	}
+	if d.qlength > 0 && len(queue.tasks) >= d.qlength {
+		return fmt.Errorf("%d tasks of %s are pending already %w", len(queue.tasks), name, ErrQueueFull)
+	}
+	queue.tasks = append(queue.tasks, t)
+	select {
+	case queue.signal <- struct{}{}:
+	default:
+		//The worker has been notified already
+	}
+	return nil
+}
+
+func (d *dispatcher) next(queue *taskQueue) Task {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(queue.tasks) == 0 {
+		return nil
+	}
+	t := queue.tasks[0]
+	queue.tasks[0] = nil
+	queue.tasks = queue.tasks[1:]
+	return t
+}
+
+//remove takes the task out of its queue. It returns false if the task is not queued (it may be running already)
+func (d *dispatcher) remove(t Task) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	queue, ok := d.queues[t.SyncName()]
+	if !ok {
+		return false
+	}
+	for i, qt := range queue.tasks {
+		if qt.GetId() == t.GetId() {
+			queue.tasks = append(queue.tasks[:i], queue.tasks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//spawn has to be called under the lock
+func (d *dispatcher) spawn(name string, queue *taskQueue) {
+	d.workers.Add(1)
+	go d.worker(name, queue)
+}
+
+func (d *dispatcher) worker(name string, queue *taskQueue) {
+	defer d.workers.Done()
+	for {
+		t := d.next(queue)
+		if t == nil {
+			select {
+			case <-d.stop:
+				return
+			case <-queue.signal:
+				continue
+			}
+		}
+		release := d.pool.acquire(name)
+		//Do not start anything new while stopping. The task stays scheduled and is restored on the next start
+		if d.isStopped() {
+			release()
+			return
+		}
+		d.run(t)
+		release()
+	}
+}
+
+func (d *dispatcher) isStopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+//shutdown makes workers exit after the tasks they are running now. Queued tasks are left untouched
+func (d *dispatcher) shutdown() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+//wait blocks until all the workers exit
+func (d *dispatcher) wait() {
+	d.workers.Wait()
+}
+
+//waitContext blocks until all the workers exit or the context is done
+func (d *dispatcher) waitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,187 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeTask struct {
+	Task
+	id       int
+	syncName string
+}
+
+func (f *fakeTask) GetId() int {
+	return f.id
+}
+
+func (f *fakeTask) SyncName() string {
+	return f.syncName
+}
+
+func Test_dispatcherSerializesStateLock(t *testing.T) {
+	var lock sync.Mutex
+	running := make(map[string]bool)
+	var order []int
+	wg := &sync.WaitGroup{}
+	d := newDispatcher(10, newWorkerPool(0, nil), func(task Task) {
+		defer wg.Done()
+		lock.Lock()
+		if running[task.SyncName()] {
+			t.Errorf("tasks of %s run concurrently", task.SyncName())
+		}
+		running[task.SyncName()] = true
+		order = append(order, task.GetId())
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running[task.SyncName()] = false
+		lock.Unlock()
+	})
+	//Tasks enqueued before the start have to wait for it
+	wg.Add(1)
+	if err := d.enqueue(&fakeTask{id: 1, syncName: "prod/a"}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	d.start()
+	for i := 2; i <= 6; i++ {
+		wg.Add(1)
+		sn := "prod/a"
+		if i%2 == 0 {
+			sn = "prod/b"
+		}
+		if err := d.enqueue(&fakeTask{id: i, syncName: sn}); err != nil {
+			t.Fatalf("enqueue() error = %v", err)
+		}
+	}
+	wg.Wait()
+	if len(order) != 6 {
+		t.Errorf("%d tasks have been run, want 6", len(order))
+	}
+	d.shutdown()
+	d.wait()
+}
+
+func Test_dispatcherShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan int, 10)
+	d := newDispatcher(10, newWorkerPool(0, nil), func(task Task) {
+		started <- task.GetId()
+		<-release
+	})
+	d.start()
+	if err := d.enqueue(&fakeTask{id: 1, syncName: "a"}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	if err := d.enqueue(&fakeTask{id: 2, syncName: "a"}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	<-started
+	d.shutdown()
+	close(release)
+	done := make(chan struct{})
+	go func() {
+		d.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("workers have not been stopped")
+	}
+	select {
+	case id := <-started:
+		t.Errorf("task %d has been started after shutdown", id)
+	default:
+	}
+	if err := d.enqueue(&fakeTask{id: 3, syncName: "a"}); err != ErrDispatcherStopped {
+		t.Errorf("enqueue() after shutdown error = %v, want %v", err, ErrDispatcherStopped)
+	}
+}
+
+func Test_dispatcherQueueFull(t *testing.T) {
+	d := newDispatcher(2, newWorkerPool(0, nil), func(task Task) {})
+	//Nothing is consumed until the start
+	for i := 1; i <= 2; i++ {
+		if err := d.enqueue(&fakeTask{id: i, syncName: "a"}); err != nil {
+			t.Fatalf("enqueue() error = %v", err)
+		}
+	}
+	if err := d.enqueue(&fakeTask{id: 3, syncName: "a"}); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("enqueue() error = %v, want %v", err, ErrQueueFull)
+	}
+	if err := d.enqueue(&fakeTask{id: 4, syncName: "b"}); err != nil {
+		t.Errorf("queue of another state lock has to accept tasks. enqueue() error = %v", err)
+	}
+	d.shutdown()
+}
+
+func Test_dispatcherWaitContext(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan int, 1)
+	d := newDispatcher(10, newWorkerPool(0, nil), func(task Task) {
+		started <- task.GetId()
+		<-release
+	})
+	d.start()
+	if err := d.enqueue(&fakeTask{id: 1, syncName: "a"}); err != nil {
+		t.Fatalf("enqueue() error = %v", err)
+	}
+	<-started
+	d.shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := d.waitContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("waitContext() with running task error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.waitContext(ctx); err != nil {
+		t.Errorf("waitContext() error = %v", err)
+	}
+}
+
+func Test_dispatcherRemove(t *testing.T) {
+	var lock sync.Mutex
+	var run []int
+	d := newDispatcher(10, newWorkerPool(0, nil), func(task Task) {
+		lock.Lock()
+		run = append(run, task.GetId())
+		lock.Unlock()
+	})
+	for i := 1; i <= 3; i++ {
+		if err := d.enqueue(&fakeTask{id: i, syncName: "a"}); err != nil {
+			t.Fatalf("enqueue() error = %v", err)
+		}
+	}
+	if !d.remove(&fakeTask{id: 2, syncName: "a"}) {
+		t.Errorf("remove() of queued task = false, want true")
+	}
+	if d.remove(&fakeTask{id: 2, syncName: "a"}) {
+		t.Errorf("remove() of removed task = true, want false")
+	}
+	if d.remove(&fakeTask{id: 4, syncName: "b"}) {
+		t.Errorf("remove() of unknown task = true, want false")
+	}
+	d.start()
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		n := len(run)
+		lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.shutdown()
+	d.wait()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(run) != 2 || run[0] != 1 || run[1] != 3 {
+		t.Errorf("run tasks = %v, want [1 3]", run)
+	}
+}
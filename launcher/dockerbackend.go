@@ -0,0 +1,79 @@
+package launcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//dockerBackend runs the process in a container of the configured image by docker command line client.
+//The workspace is mounted at the same path, so the paths in the environment stay valid
+type dockerBackend struct {
+	docker string
+	image  string
+	args   []string
+}
+
+func newDockerBackend() (*dockerBackend, error) {
+	image := viper.GetString(misc.BackendImageKey)
+	if image == "" {
+		return nil, fmt.Errorf("%s has to be set for %s backend", misc.BackendImageKey, BackendDocker)
+	}
+	return &dockerBackend{docker: viper.GetString(misc.DockerCommandKey), image: image, args: viper.GetStringSlice(misc.DockerArgsKey)}, nil
+}
+
+func (b *dockerBackend) Name() string {
+	return BackendDocker
+}
+
+func (b *dockerBackend) Run(ctx context.Context, ws *Workspace, command *exec.Cmd) error {
+	name := fmt.Sprintf("%s-task-%d-%d", strings.ToLower(misc.APPNAME), ws.TaskId, time.Now().UnixNano())
+	docker := exec.Command(b.docker, b.runArgs(name, ws, command)...)
+	//Values are passed through the client environment to keep them out of the process list
+	docker.Env = append(append([]string{}, command.Env...), dockerClientEnv()...)
+	err := runProcess(ctx, ws, docker)
+	if ctx.Err() != nil {
+		//Docker client forwards the interrupt, but the container outlives the killed client
+		b.removeContainer(name)
+	}
+	return err
+}
+
+func (b *dockerBackend) runArgs(name string, ws *Workspace, command *exec.Cmd) []string {
+	args := []string{"run", "--rm", "--init", "--name", name, "--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}
+	if ws.Root != "" {
+		args = append(args, "--volume", ws.Root+":"+ws.Root)
+	}
+	if command.Dir != "" {
+		args = append(args, "--workdir", command.Dir)
+	}
+	for _, kv := range command.Env {
+		args = append(args, "--env", strings.SplitN(kv, "=", 2)[0])
+	}
+	args = append(args, b.args...)
+	args = append(args, b.image)
+	return append(args, command.Args...)
+}
+
+func (b *dockerBackend) removeContainer(name string) {
+	out, err := exec.Command(b.docker, "rm", "--force", name).CombinedOutput()
+	if err != nil {
+		misc.Debugf("cannot remove container %s. Error: %s Output: %s", name, err, out)
+	}
+}
+
+//dockerClientEnv returns variables of the server the docker client needs to reach the daemon
+func dockerClientEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "DOCKER_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
@@ -0,0 +1,91 @@
+package launcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultDriftBranch is the branch drift checks are run against if the check does not set one
+const DefaultDriftBranch = "master"
+
+var planSummary = regexp.MustCompile(`Plan: (\d+) to add, (\d+) to change, (\d+) to destroy`)
+
+//DriftCheck is a plan-only run.sh run of env/layer, which is done on schedule to find the infrastructure changed outside of the code
+type DriftCheck struct {
+	//Schedule is a cron expression
+	Schedule    string   `mapstructure:"schedule"`
+	Location    string   `mapstructure:"location"`
+	RepoSources []string `mapstructure:"repo_sources"`
+	Branch      string   `mapstructure:"branch"`
+	//Timeout of the run in seconds
+	Timeout string `mapstructure:"timeout"`
+}
+
+func (c *DriftCheck) GetBranch() string {
+	if c.Branch == "" {
+		return DefaultDriftBranch
+	}
+	return c.Branch
+}
+
+func (c *DriftCheck) launchConfig() *RunSHLaunchConfig {
+	location := strings.TrimSpace(c.Location)
+	return &RunSHLaunchConfig{RepoSources: c.RepoSources, FullCommand: fmt.Sprintf("./%s -n %s", misc.RunshExe, location),
+		CommandOptions: &RunSHOptions{YN: "n", Location: location, Timeout: c.Timeout}, Instant: time.Now().Unix()}
+}
+
+//AddDriftTask queues plan of the drift check. It does not wait for a webhook, because the branch is on GitHub already
+func AddDriftTask(tm TaskManager, check *DriftCheck) (Task, error) {
+	t, err := addRunShRefTask(tm, check.launchConfig(), check.GetBranch(), func(t *GitTask, cmd *RunShCmd) {
+		t.drift = cmd.Env
+		if cmd.Layer != "" {
+			t.drift = cmd.Env + "/" + cmd.Layer
+		}
+	})
+	if err != nil {
+		err = fmt.Errorf("drift check of %s failed to start. Error: %w", check.Location, err)
+		if t == nil {
+			return nil, err
+		}
+		return t, err
+	}
+	log.Printf("Task %d has been created as a drift check of %s against %s", t.GetId(), t.drift, t.ref)
+	return t, nil
+}
+
+//ClaimDriftRun makes sure the scheduled run of the check is launched by one replica only.
+//The claim is held for the half of the period till the next run, so the replicas may fire slightly apart
+func ClaimDriftRun(check *DriftCheck, scheduled, next time.Time) (bool, error) {
+	lease := next.Sub(scheduled) / 2
+	if lease < time.Second {
+		lease = time.Second
+	}
+	_, err := storer.GetStateLocker().Acquire(driftLockPrefix+check.Location+"@"+check.Schedule, instanceId, 0, lease)
+	if errors.Is(err, storer.ErrStateLocked) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//planHasChanges checks terraform plan summaries of the output. Any resource to add, change or destroy is a drift
+func planHasChanges(output string) bool {
+	for _, m := range planSummary.FindAllStringSubmatch(output, -1) {
+		for _, n := range m[1:] {
+			if c, err := strconv.Atoi(n); err == nil && c > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func driftIssueTitle(location string) string {
+	return fmt.Sprintf("Drift detected in %s", location)
+}
@@ -0,0 +1,38 @@
+package launcher
+
+import "testing"
+
+func Test_planHasChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{"No changes", "No changes. Infrastructure is up-to-date.", false},
+		{"Empty plan", "Plan: 0 to add, 0 to change, 0 to destroy.", false},
+		{"Resource to change", "Plan: 0 to add, 2 to change, 0 to destroy.", true},
+		{"Second layer drifted", "Plan: 0 to add, 0 to change, 0 to destroy.\nPlan: 0 to add, 0 to change, 1 to destroy.", true},
+		{"No plan", "Error: provider is not configured", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planHasChanges(tt.output); got != tt.want {
+				t.Errorf("planHasChanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriftCheck_launchConfig(t *testing.T) {
+	c := &DriftCheck{Location: " prod/core ", RepoSources: []string{"git@github.com:wix-system/production_42.git"}}
+	cmd, err := c.launchConfig().GetCommand()
+	if err != nil {
+		t.Fatalf("GetCommand() error = %v", err)
+	}
+	if !cmd.No || cmd.Yes || cmd.Env != "prod" || cmd.Layer != "core" {
+		t.Errorf("GetCommand() = %+v, want plan only run of prod/core", cmd)
+	}
+	if c.GetBranch() != DefaultDriftBranch {
+		t.Errorf("GetBranch() = %s, want %s", c.GetBranch(), DefaultDriftBranch)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/wix-playground/tfChek/storer"
 	"io"
 	"os"
+	"strings"
 )
 
 func GetTaskLineReader(taskId int) (chan string, error) {
@@ -18,6 +19,39 @@ func GetTaskLineReader(taskId int) (chan string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return followTaskFile(taskId, fPath)
+}
+
+//GetTaskOutputLineReader follows tagged output lines of the running task. Every line is JSON encoded storer.OutputLine
+func GetTaskOutputLineReader(taskId int) (chan string, error) {
+	fPath, err := storer.GetTaskLinesPath(taskId)
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := followTaskFile(taskId, fPath)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan string)
+	go func() {
+		defer close(output)
+		//Follower may read a line while it is being written, so the fragments are joined until the line end
+		var line strings.Builder
+		for f := range fragments {
+			line.WriteString(f)
+			if strings.HasSuffix(f, "\n") {
+				output <- strings.TrimSuffix(line.String(), "\n")
+				line.Reset()
+			}
+		}
+		if line.Len() > 0 {
+			output <- line.String()
+		}
+	}()
+	return output, nil
+}
+
+func followTaskFile(taskId int, fPath string) (chan string, error) {
 	tm := GetTaskManager()
 	task := tm.Get(taskId)
 	if task == nil {
@@ -35,7 +69,7 @@ func GetTaskLineReader(taskId int) (chan string, error) {
 			select {
 			case status, ok := <-tsc:
 				if !ok {
-					misc.Debugf("---logging errors of file %s watcher:")
+					misc.Debugf("---logging errors of file %s watcher:", fPath)
 					for lm := range errs {
 						if lm != nil {
 							misc.Debug(lm.Error())
@@ -54,6 +88,8 @@ func GetTaskLineReader(taskId int) (chan string, error) {
 						misc.Debugf("Starting follwer of task %d", taskId)
 						go follower.Follow(output, errs)
 					}
+				case misc.CANCELLED:
+					fallthrough
 				case misc.TIMEOUT:
 					fallthrough
 				case misc.FAILED:
@@ -121,23 +157,17 @@ func PullS3TaskOutput(taskId int) error {
 	task := tm.Get(taskId)
 	if task == nil {
 		misc.Debugf("failed to find task by id %d. Assuming it has been done before", taskId)
-		err := pullS3TaskOutputWithStatus(taskId, misc.DONE)
-		if err != nil {
-			misc.Debugf("failed to download task %d output from S3 in status %s. trying nex one... Error: %s", taskId, GetStatusString(misc.DONE), err)
-			err := pullS3TaskOutputWithStatus(taskId, misc.FAILED)
-			if err != nil {
-				misc.Debugf("failed to download task %d output from S3 in status %s. trying nex one... Error: %s", taskId, GetStatusString(misc.FAILED), err)
-				err := pullS3TaskOutputWithStatus(taskId, misc.TIMEOUT)
-				if err != nil {
-					misc.Debugf("failed to download task %d output from S3 in status %s.  Error: %s", taskId, GetStatusString(misc.TIMEOUT), err)
-					return fmt.Errorf("failed to download task %d output.  Error: %s", taskId, err)
-				}
+		var err error
+		for _, status := range []TaskStatus{misc.DONE, misc.FAILED, misc.TIMEOUT, misc.CANCELLED} {
+			err = pullS3TaskOutputWithStatus(taskId, status)
+			if err == nil {
+				return nil
 			}
+			misc.Debugf("failed to download task %d output from S3 in status %s. trying nex one... Error: %s", taskId, GetStatusString(status), err)
 		}
-	} else {
-		return pullS3TaskOutputWithStatus(taskId, task.GetStatus())
+		return fmt.Errorf("failed to download task %d output.  Error: %s", taskId, err)
 	}
-	return nil
+	return pullS3TaskOutputWithStatus(taskId, task.GetStatus())
 }
 
 func pullS3TaskOutputWithStatus(taskId int, status TaskStatus) error {
@@ -0,0 +1,172 @@
+package launcher
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+//EnvSet is a set of variables of the tasks running in the matching locations
+type EnvSet struct {
+	//Locations are patterns of env/layer (or env only to match all its layers) the set applies to
+	Locations []string `mapstructure:"locations"`
+	//Vars are NAME=value pairs. Configuration map keys would lose their case
+	Vars []string `mapstructure:"vars"`
+	//AWSAccount is the name of the account from aws_accounts, which credentials are given to the task
+	AWSAccount string `mapstructure:"aws_account"`
+}
+
+//AWSAccount is the credentials of the AWS account terraform works with
+type AWSAccount struct {
+	AccessKeyId     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	Profile         string `mapstructure:"profile"`
+	Region          string `mapstructure:"region"`
+}
+
+func (a *AWSAccount) vars() map[string]string {
+	vars := make(map[string]string)
+	for k, v := range map[string]string{misc.AwsAccessKeyVar: a.AccessKeyId, misc.AwsSecretKeyVar: a.SecretAccessKey,
+		"AWS_SESSION_TOKEN": a.SessionToken, "AWS_PROFILE": a.Profile, "AWS_REGION": a.Region, "AWS_DEFAULT_REGION": a.Region} {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+//taskEnvironment returns variables of the task running in the location. Only allowed variables of the server environment are passed.
+//Base variables, variable sets of the location, AWS credentials of their account and extra variables of the task are added
+//in this order, so the later ones win
+func taskEnvironment(location string, extra map[string]string) (map[string]string, error) {
+	env := make(map[string]string)
+	allowed := viper.GetStringSlice(misc.EnvAllowKey)
+	for _, kv := range os.Environ() {
+		k, v, err := splitEnvVar(kv)
+		if err == nil && envAllowed(k, allowed) {
+			env[k] = v
+		}
+	}
+	err := addEnvVars(env, viper.GetStringSlice(misc.EnvVarsListKey))
+	if err != nil {
+		return nil, fmt.Errorf("wrong %s configuration. Error: %w", misc.EnvVarsListKey, err)
+	}
+	var sets []EnvSet
+	err = viper.UnmarshalKey(misc.EnvSetsKey, &sets)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s configuration. Error: %w", misc.EnvSetsKey, err)
+	}
+	for _, set := range sets {
+		if !locationMatches(location, set.Locations) {
+			continue
+		}
+		err := addEnvVars(env, set.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("wrong variable set of %v. Error: %w", set.Locations, err)
+		}
+		if set.AWSAccount == "" {
+			continue
+		}
+		account, err := getAWSAccount(set.AWSAccount)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range account.vars() {
+			env[k] = v
+		}
+	}
+	for k, v := range extra {
+		env[k] = v
+	}
+	return env, nil
+}
+
+//withServerEnvCleared returns the variables of the process, which inherits the whole server environment.
+//Server variables not passed to the task are overridden with empty values, so their values do not leak to the process
+func withServerEnvCleared(env map[string]string) map[string]string {
+	cleared := make(map[string]string)
+	for _, kv := range os.Environ() {
+		k, _, err := splitEnvVar(kv)
+		if err == nil {
+			cleared[k] = ""
+		}
+	}
+	for k, v := range env {
+		cleared[k] = v
+	}
+	return cleared
+}
+
+func getAWSAccount(name string) (*AWSAccount, error) {
+	var accounts map[string]AWSAccount
+	err := viper.UnmarshalKey(misc.AWSAccountsKey, &accounts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s configuration. Error: %w", misc.AWSAccountsKey, err)
+	}
+	//Viper lowers the case of map keys
+	for n, a := range accounts {
+		if strings.EqualFold(n, name) {
+			return &a, nil
+		}
+	}
+	return nil, fmt.Errorf("AWS account %s is not configured", name)
+}
+
+//envList returns the variables as NAME=value sorted by name
+func envList(env map[string]string) []string {
+	var list []string
+	for k, v := range env {
+		list = append(list, k+"="+v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func addEnvVars(env map[string]string, vars []string) error {
+	for _, kv := range vars {
+		k, v, err := splitEnvVar(kv)
+		if err != nil {
+			return err
+		}
+		env[k] = v
+	}
+	return nil
+}
+
+func splitEnvVar(kv string) (string, string, error) {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("variable %q has to be NAME=value", kv)
+	}
+	return parts[0], parts[1], nil
+}
+
+func envAllowed(name string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if m, err := path.Match(pattern, name); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
+
+//locationMatches checks env/layer against the patterns. Pattern without a slash matches the env part only
+func locationMatches(location string, patterns []string) bool {
+	env := strings.SplitN(location, "/", 2)[0]
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		target := location
+		if !strings.Contains(pattern, "/") {
+			target = env
+		}
+		if m, err := path.Match(pattern, target); err == nil && m {
+			return true
+		}
+	}
+	return false
+}
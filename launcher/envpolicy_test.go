@@ -0,0 +1,86 @@
+package launcher
+
+import (
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTaskEnvironment(t *testing.T) {
+	os.Setenv("TFCHEK_TEST_ALLOWED", "yes")
+	os.Setenv("TFCHEK_TEST_SECRET", "leak")
+	defer os.Unsetenv("TFCHEK_TEST_ALLOWED")
+	defer os.Unsetenv("TFCHEK_TEST_SECRET")
+	viper.Set(misc.EnvAllowKey, []string{"TFCHEK_TEST_A*"})
+	viper.Set(misc.EnvVarsListKey, []string{"TFRESDIF_NOPB=true", "NOTIFY_TFCHEK=false"})
+	viper.Set(misc.EnvSetsKey, []interface{}{
+		map[string]interface{}{"locations": []string{"staging"}, "vars": []string{"Stage=all", "TFRESDIF_NOPB=false"}, "aws_account": "Staging"},
+		map[string]interface{}{"locations": []string{"production/dns*"}, "vars": []string{"LAYER=dns"}, "aws_account": "prod"},
+	})
+	viper.Set(misc.AWSAccountsKey, map[string]interface{}{
+		"staging": map[string]interface{}{"access_key_id": "AKIASTAGING", "secret_access_key": "s", "region": "us-east-1"},
+		"prod":    map[string]interface{}{"profile": "production"},
+	})
+	defer func() {
+		for _, k := range []string{misc.EnvAllowKey, misc.EnvVarsListKey, misc.EnvSetsKey, misc.AWSAccountsKey} {
+			viper.Set(k, nil)
+		}
+	}()
+	base := map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "TFRESDIF_NOPB": "true", "NOTIFY_TFCHEK": "false"}
+	tests := []struct {
+		name     string
+		location string
+		extra    map[string]string
+		want     map[string]string
+	}{
+		{name: "base", location: "development/web", want: base},
+		{name: "extra wins", location: "development/web", extra: map[string]string{"NOTIFY_TFCHEK": "true"},
+			want: map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "TFRESDIF_NOPB": "true", "NOTIFY_TFCHEK": "true"}},
+		{name: "env set with account", location: "staging/web",
+			want: map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "TFRESDIF_NOPB": "false", "NOTIFY_TFCHEK": "false", "Stage": "all",
+				misc.AwsAccessKeyVar: "AKIASTAGING", misc.AwsSecretKeyVar: "s", "AWS_REGION": "us-east-1", "AWS_DEFAULT_REGION": "us-east-1"}},
+		{name: "layer set", location: "production/dns_zones",
+			want: map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "TFRESDIF_NOPB": "true", "NOTIFY_TFCHEK": "false", "LAYER": "dns", "AWS_PROFILE": "production"}},
+		{name: "other layer", location: "production/web", want: base},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := taskEnvironment(tt.location, tt.extra)
+			if err != nil {
+				t.Fatalf("taskEnvironment() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("taskEnvironment() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	viper.Set(misc.EnvSetsKey, []interface{}{map[string]interface{}{"locations": []string{"*"}, "aws_account": "missing"}})
+	if _, err := taskEnvironment("staging/web", nil); err == nil {
+		t.Errorf("taskEnvironment() of unknown account error = nil")
+	}
+	viper.Set(misc.EnvSetsKey, []interface{}{map[string]interface{}{"locations": []string{"*"}, "vars": []string{"NOVALUE"}}})
+	if _, err := taskEnvironment("staging/web", nil); err == nil {
+		t.Errorf("taskEnvironment() of malformed variable error = nil")
+	}
+}
+
+func TestWithServerEnvCleared(t *testing.T) {
+	os.Setenv("TFCHEK_TEST_ALLOWED", "yes")
+	os.Setenv("TFCHEK_TEST_SECRET", "leak")
+	defer os.Unsetenv("TFCHEK_TEST_ALLOWED")
+	defer os.Unsetenv("TFCHEK_TEST_SECRET")
+	got := withServerEnvCleared(map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "LAYER": "dns"})
+	for k, want := range map[string]string{"TFCHEK_TEST_ALLOWED": "yes", "LAYER": "dns", "TFCHEK_TEST_SECRET": ""} {
+		if v, ok := got[k]; !ok || v != want {
+			t.Errorf("withServerEnvCleared()[%s] = %q, want %q", k, v, want)
+		}
+	}
+	for _, kv := range os.Environ() {
+		k, v, _ := splitEnvVar(kv)
+		if v != "" && got[k] != "" && k != "TFCHEK_TEST_ALLOWED" {
+			t.Errorf("server variable %s has not been cleared", k)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package launcher
+
+import (
+	"context"
+	"github.com/wix-playground/tfChek/storer"
+)
+
+//TaskExecutor runs the payload of a task. Git checkout, GitHub reporting, output storage and status handling
+//are done by the task, so an executor only has to run in the given workspace
+type TaskExecutor interface {
+	//Kind is stored with the task record to rebuild the executor after restart
+	Kind() string
+	//Command is a human readable form of what is run
+	Command() string
+	//StateLock is the terraform state the executor works with. Tasks with the same state lock never run in parallel
+	StateLock() string
+	//Origins are git remotes, which have to be checked out to the workspace
+	Origins() []string
+	//Definition is the original payload the executor has been created from
+	Definition() []byte
+	//GitApiVersion selects the git manager implementation for the origins
+	GitApiVersion() int
+	//Labels are free-form metadata of the task given by the client
+	Labels() map[string]string
+	//MainRepository returns the remote of the workspace repository, which failures are reported to
+	MainRepository(ws *Workspace) (string, error)
+	//Execute runs in the workspace and writes the output to the workspace output. It has to stop when the context is done
+	Execute(ctx context.Context, ws *Workspace) error
+}
+
+//Repository is a git remote checked out to the local directory
+type Repository struct {
+	Remote string
+	Path   string
+}
+
+//Workspace is the place the executor runs in
+type Workspace struct {
+	TaskId int
+	//Root is the private directory of the task. The repositories are inside of it
+	Root string
+	//Repositories are checked out to the task branch. They are in the same order as the executor origins
+	Repositories []Repository
+	Output       *storer.TaskFileSink
+	//Lock is the state lock held during the run. Its token is passed to the processes as the fencing token
+	Lock *storer.StateLockRecord
+}
+
+//GetPath returns the directory the remote is checked out to
+func (ws *Workspace) GetPath(remote string) string {
+	for _, r := range ws.Repositories {
+		if r.Remote == remote {
+			return r.Path
+		}
+	}
+	return ""
+}
+
+//GetPaths returns directories of all the repositories
+func (ws *Workspace) GetPaths() []string {
+	var paths []string
+	for _, r := range ws.Repositories {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
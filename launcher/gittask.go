@@ -0,0 +1,748 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/acarl005/stripansi"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/git"
+	"github.com/wix-playground/tfChek/github"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//GitTask runs its executor against the task branch pushed to GitHub and reports the result back to GitHub
+type GitTask struct {
+	id       int
+	executor TaskExecutor
+	//mu guards status, authors, subscribers, cancelledBy and the fields set by the run (workspace, lockToken and run).
+	//The task is run, cancelled and watched by different goroutines
+	mu          sync.Mutex
+	status      TaskStatus
+	authors     []string
+	subscribers []chan TaskStatus
+	hash        string
+	created     time.Time
+	history     statusHistory
+	//ref is checked out instead of the task own branch
+	ref         string
+	rerunOf     int
+	cancelledBy string
+	//drift is env/layer of the scheduled drift check. Plan changes are reported with an issue instead of a pull request
+	drift string
+	//review is the pull request of Apply -> Push flow the task plans or applies
+	review *storer.PullRequestRef
+	//expired task has never received its webhook
+	expired bool
+	//run is the exit status and the steps of the executor run
+	run *storer.RunRecord
+	//lockToken is the fencing token of the state lock the run has held
+	lockToken int64
+	//ctx is cancelled when the task is cancelled
+	ctx    context.Context
+	cancel context.CancelFunc
+	//timeout of the run. Zero means the context deadline only
+	timeout   time.Duration
+	workspace *Workspace
+}
+
+func newGitTask(ctx context.Context, timeout time.Duration, executor TaskExecutor) *GitTask {
+	tctx, cancel := context.WithCancel(ctx)
+	t := &GitTask{executor: executor, status: misc.OPEN, created: time.Now(), ctx: tctx, cancel: cancel, timeout: timeout}
+	t.history.add(misc.OPEN, "task has been created")
+	return t
+}
+
+func (t *GitTask) GetId() int {
+	return t.id
+}
+
+func (t *GitTask) setId(id int) {
+	t.id = id
+}
+
+func (t *GitTask) SyncName() string {
+	if sl := t.executor.StateLock(); sl != "" {
+		return sl
+	}
+	return t.executor.Command()
+}
+
+func (t *GitTask) GetOrigins() *[]string {
+	origins := t.executor.Origins()
+	return &origins
+}
+
+func (t *GitTask) SetAuthors(authors []string) {
+	t.mu.Lock()
+	t.authors = authors
+	t.mu.Unlock()
+	persistTask(t)
+}
+
+func (t *GitTask) GetAuthors() *[]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	authors := append([]string(nil), t.authors...)
+	return &authors
+}
+
+//getCancelledBy returns the user, who has cancelled the task. It is empty if the task has not been cancelled
+func (t *GitTask) getCancelledBy() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cancelledBy
+}
+
+func (t *GitTask) Run() error {
+	if t.GetStatus() != misc.SCHEDULED {
+		return errors.New("cannot run unscheduled task")
+	}
+	//Prepare github first
+	err := t.prepareGitHub()
+	if err != nil {
+		log.Printf("Cannot prepare GitHub repositories. Error: %s", err)
+		t.ForceFail(fmt.Sprintf("cannot prepare GitHub repositories. Error: %s", err))
+		return err
+	}
+	//Perform git routines
+	ws, err := t.prepareGit()
+	if err != nil {
+		log.Printf("Cannot prepare git repositories. Error: %s", err)
+		t.ForceFail(fmt.Sprintf("cannot prepare git repositories. Error: %s", err))
+		return err
+	}
+	defer releaseWorkspace(ws)
+	if t.GetStatus() == misc.CANCELLED {
+		log.Printf("Task %d has been cancelled by %s before the run", t.id, t.getCancelledBy())
+		return nil
+	}
+	if t.ctx.Err() != nil {
+		t.ForceFail("task has been interrupted before the run")
+		return fmt.Errorf("task %d has been interrupted before the run", t.id)
+	}
+	sink, err := storer.NewTaskFileSink(t.id)
+	if err != nil {
+		t.ForceFail(fmt.Sprintf("cannot create task output. Error: %s", err))
+		return err
+	}
+	ws.Output = sink
+	t.mu.Lock()
+	t.workspace = ws
+	t.mu.Unlock()
+	//The run is interrupted if the state lock gets lost
+	ctx, cancelRun := context.WithCancel(t.ctx)
+	defer cancelRun()
+	lease, err := acquireStateLock(ctx, t.SyncName(), ws, cancelRun)
+	if err != nil {
+		sink.Close()
+		if t.GetStatus() == misc.CANCELLED {
+			log.Printf("Task %d has been cancelled by %s while waiting for the state lock", t.id, t.getCancelledBy())
+			return nil
+		}
+		t.ForceFail(fmt.Sprintf("cannot acquire state lock. Error: %s", err))
+		return err
+	}
+	defer lease.release()
+	ws.Lock = lease.lock
+	t.mu.Lock()
+	t.lockToken = lease.lock.Token
+	t.mu.Unlock()
+
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	err = t.Start()
+	if err != nil {
+		sink.Close()
+		if t.GetStatus() == misc.CANCELLED {
+			log.Printf("Task %d has been cancelled by %s before the start", t.id, t.getCancelledBy())
+			return nil
+		}
+		log.Printf("Cannot change task state. Error: %s", err)
+		return err
+	}
+	log.Printf("Running %s task %d '%s' and waiting for it to finish...", t.executor.Kind(), t.id, t.executor.Command())
+	runErr := t.executor.Execute(ctx, ws)
+	sink.Close()
+	t.mu.Lock()
+	t.run = sink.GetRunRecord()
+	t.mu.Unlock()
+	//Stale holder must neither report to GitHub nor upload to S3, because the new holder may have changed the state already
+	err = lease.verify()
+	if errors.Is(err, storer.ErrStateLockLost) {
+		log.Printf("Task %d has lost state lock %s during the run. Error: %s", t.id, lease.lock.Name, err)
+		t.ForceFail(fmt.Sprintf("state lock has been lost during the run. Error: %s", err))
+		return err
+	}
+	if err != nil {
+		misc.Debugf("cannot verify state lock of task %d. Error: %s", t.id, err)
+	}
+	switch {
+	case runErr == nil:
+		err = t.Done()
+		misc.Debugf("task %d completed successfully", t.id)
+	case t.getCancelledBy() != "":
+		log.Printf("Task %d has been cancelled by %s: %s", t.id, t.getCancelledBy(), runErr)
+		err = t.interrupted()
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		log.Printf("Task %d timed out. Error: %s", t.id, runErr)
+		err = t.TimeoutFail()
+	default:
+		log.Printf("Task %d finished with error: %s", t.id, runErr)
+		err = t.Fail()
+	}
+	if err != nil {
+		log.Printf("Cannot change task state. Error: %s", err)
+	}
+	upload2s3(t.id, t.GetStatus())
+	return runErr
+}
+
+func (t *GitTask) Register() error {
+	if current, ok := t.changeStatusFrom(misc.REGISTERED, "task has been registered", misc.OPEN); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be scheduled registered, beacuse it is not open. Please make get request. Current state number is %d", current)}
+	}
+	return nil
+}
+
+func (t *GitTask) Schedule() error {
+	if current, ok := t.changeStatusFrom(misc.SCHEDULED, "task has been scheduled", misc.REGISTERED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be scheduled because it has been not registered. Please wait for a webhook. Current state number is %d", current)}
+	}
+	return nil
+}
+
+func (t *GitTask) launch() (TaskStatus, bool) {
+	return t.changeStatusFrom(misc.SCHEDULED, "task has been scheduled", misc.OPEN)
+}
+
+func (t *GitTask) Start() error {
+	if current, ok := t.changeStatusFrom(misc.STARTED, "task run has been started", misc.OPEN, misc.REGISTERED, misc.SCHEDULED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be Started because it is not in scheduled state. Current state number is %d", current)}
+	}
+	misc.Debugf("start of task %d", t.id)
+	return nil
+}
+
+func (t *GitTask) Done() error {
+	if current, ok := t.changeStatusFrom(misc.DONE, "task run has finished successfully", misc.STARTED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be done, because it has been not Started. Current state number is %d", current)}
+	}
+	if t.drift != "" {
+		return t.reportDrift()
+	}
+	if t.review != nil {
+		return t.reportReview(true)
+	}
+	for _, origin := range t.executor.Origins() {
+		misc.Debugf("processing GitHub manager of %s", origin)
+		t.report(origin, github.NewBranchTaskResult(t.id, t.getBranch(), true, t.getReportOutput(), t.GetAuthors()))
+	}
+	return nil
+}
+
+func (t *GitTask) Fail() error {
+	if current, ok := t.changeStatusFrom(misc.FAILED, "task run has failed", misc.STARTED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be failed, because it has been not Started. Current state number is %d", current)}
+	}
+	return t.reportFailure()
+}
+
+func (t *GitTask) TimeoutFail() error {
+	if current, ok := t.changeStatusFrom(misc.TIMEOUT, "task run has exceeded its timeout", misc.STARTED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be timed out, because it has been not Started. Current state number is %d", current)}
+	}
+	return t.reportFailure()
+}
+
+func (t *GitTask) Expire(reason string) error {
+	t.mu.Lock()
+	if t.status != misc.OPEN {
+		current := t.status
+		t.mu.Unlock()
+		return &StateError{msg: fmt.Sprintf("Task cannot be expired, because it is not open. Current state number is %d", current)}
+	}
+	t.expired = true
+	subscribers := t.setStatus(misc.FAILED, reason)
+	t.mu.Unlock()
+	t.notifySubscribers(subscribers, misc.FAILED)
+	return nil
+}
+
+func (t *GitTask) ForceFail(reason string) {
+	t.changeStatus(misc.FAILED, reason)
+}
+
+//Cancel checks and changes the status at once, so the task cannot be started between them
+func (t *GitTask) Cancel(by string) error {
+	t.mu.Lock()
+	current := t.status
+	if IsCompletedStatus(current) {
+		t.mu.Unlock()
+		return &StateError{msg: fmt.Sprintf("Task cannot be cancelled, because it has been completed already. Current state number is %d", current)}
+	}
+	t.cancelledBy = by
+	if current == misc.STARTED {
+		t.mu.Unlock()
+		//Run finishes the cancellation when the executor gets interrupted
+		persistTask(t)
+		return nil
+	}
+	subscribers := t.setStatus(misc.CANCELLED, fmt.Sprintf("task has been cancelled by %s", by))
+	t.mu.Unlock()
+	t.notifySubscribers(subscribers, misc.CANCELLED)
+	return nil
+}
+
+//interrupted completes the run cancelled by a user. Unlike failures it does not open a GitHub issue
+func (t *GitTask) interrupted() error {
+	if current, ok := t.changeStatusFrom(misc.CANCELLED, fmt.Sprintf("task run has been cancelled by %s", t.getCancelledBy()), misc.STARTED); !ok {
+		return &StateError{msg: fmt.Sprintf("Task cannot be interrupted, because it has been not Started. Current state number is %d", current)}
+	}
+	return t.reportMain(github.NewCancelledTaskResult(t.id, t.getBranch(), t.getReportOutput(), t.GetAuthors()))
+}
+
+//reportFailure opens an issue for the task branch. Failed drift checks have no branch to fix, so they are only logged
+func (t *GitTask) reportFailure() error {
+	if t.drift != "" {
+		log.Printf("Drift check %d of %s has not completed. Status: %s", t.id, t.drift, GetStatusString(t.GetStatus()))
+		return nil
+	}
+	if t.review != nil {
+		return t.reportReview(false)
+	}
+	return t.reportMain(github.NewBranchTaskResult(t.id, t.getBranch(), false, t.getReportOutput(), t.GetAuthors()))
+}
+
+//reportDrift opens or updates the drift issue if the plan shows changes
+func (t *GitTask) reportDrift() error {
+	out := t.GetCleanOut()
+	if !planHasChanges(out) {
+		log.Printf("Drift check %d has found no changes in %s", t.id, t.drift)
+		return nil
+	}
+	log.Printf("Drift check %d has found changes in %s", t.id, t.drift)
+	return t.reportMain(github.NewDriftTaskResult(t.id, t.getBranch(), driftIssueTitle(t.drift), &out))
+}
+
+//reportMain passes the result to the GitHub manager of the main repository of the workspace
+func (t *GitTask) reportMain(result *github.TaskResult) error {
+	t.mu.Lock()
+	ws := t.workspace
+	t.mu.Unlock()
+	if ws == nil {
+		return fmt.Errorf("task %d has no workspace", t.id)
+	}
+	remote, err := t.executor.MainRepository(ws)
+	if err != nil {
+		misc.Debugf("cannot get main repository of task %d. Error: %s", t.id, err)
+		return err
+	}
+	t.report(remote, result)
+	return nil
+}
+
+func (t *GitTask) report(remote string, result *github.TaskResult) {
+	manager := github.GetManager(remote)
+	if manager != nil {
+		manager.Send(result.WithLabels(t.executor.Labels()))
+	}
+}
+
+func (t *GitTask) getReportOutput() *string {
+	o := t.GetCleanOut()
+	if o == "" {
+		o = misc.NOOUTPUT
+	}
+	return &o
+}
+
+func (t *GitTask) GetStatus() TaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+func (t *GitTask) SetStatus(status TaskStatus) {
+	t.mu.Lock()
+	t.status = status
+	t.history.add(status, "")
+	t.mu.Unlock()
+	persistTask(t)
+}
+
+func (t *GitTask) changeStatus(status TaskStatus, reason string) {
+	t.mu.Lock()
+	subscribers := t.setStatus(status, reason)
+	t.mu.Unlock()
+	t.notifySubscribers(subscribers, status)
+}
+
+//changeStatusFrom changes the status only if the task is in one of the given ones. It returns the status the task has had
+func (t *GitTask) changeStatusFrom(status TaskStatus, reason string, from ...TaskStatus) (TaskStatus, bool) {
+	t.mu.Lock()
+	current := t.status
+	for _, s := range from {
+		if current == s {
+			subscribers := t.setStatus(status, reason)
+			t.mu.Unlock()
+			t.notifySubscribers(subscribers, status)
+			return current, true
+		}
+	}
+	t.mu.Unlock()
+	return current, false
+}
+
+//setStatus must be called with mu held. It returns the subscribers to notify once mu is released
+func (t *GitTask) setStatus(status TaskStatus, reason string) []chan TaskStatus {
+	t.status = status
+	t.history.add(status, reason)
+	subscribers := t.subscribers
+	//Remove all subscribers after notification that task is completed
+	if IsCompletedStatus(status) {
+		t.subscribers = nil
+	}
+	return subscribers
+}
+
+func (t *GitTask) GetHistory() []storer.StatusTransition {
+	return t.history.list()
+}
+
+func (t *GitTask) GetCreated() time.Time {
+	return t.created
+}
+
+func (t *GitTask) Subscribe() chan TaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sts := make(chan TaskStatus, 2)
+	sts <- t.status
+	//Add channel to subscribers if the task is active
+	if !IsCompletedStatus(t.status) {
+		t.subscribers = append(t.subscribers, sts)
+	}
+	return sts
+}
+
+func (t *GitTask) notifySubscribers(subscribers []chan TaskStatus, status TaskStatus) {
+	persistTask(t)
+	for _, sc := range subscribers {
+		sc <- status
+	}
+}
+
+func (t *GitTask) GetStdOut() io.Reader {
+	//TODO: Need closer
+	path, err := storer.GetTaskPath(t.id)
+	if err != nil {
+		misc.Debugf("cannot get task stdout. Error: %s", err)
+		return nil
+	}
+	taskFile, err := os.Open(path)
+	if err != nil {
+		misc.Debugf("cannot get task stdout. Error: %s", err)
+		return nil
+	}
+	return taskFile
+}
+
+//GetCleanOut function returns output without ANSI characters (Non colored out)
+func (t *GitTask) GetCleanOut() string {
+	path, err := storer.GetTaskPath(t.id)
+	if err != nil {
+		misc.Debugf("cannot get task clean out. Error: %s", err)
+		return ""
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		misc.Debugf("cannot get task stdout. failed to read file %s, Error: %s", path, err)
+		return ""
+	}
+	cleanOut := stripansi.Strip(string(content))
+	return strings.TrimSpace(cleanOut)
+}
+
+func (t *GitTask) GetStdErr() io.Reader {
+	//Is not available in this implementation. Both streams are written to the same output
+	return nil
+}
+
+func (t *GitTask) GetStdIn() io.Writer {
+	return nil
+}
+
+func (t *GitTask) record(rec *storer.TaskRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec.Kind = t.executor.Kind()
+	rec.Status = int(t.status)
+	rec.StateLock = t.executor.StateLock()
+	rec.Hash = t.hash
+	rec.Command = t.executor.Command()
+	rec.Authors = t.authors
+	rec.Origins = t.executor.Origins()
+	rec.Definition = t.executor.Definition()
+	rec.Created = t.created
+	rec.History = t.history.list()
+	rec.Ref = t.ref
+	rec.RerunOf = t.rerunOf
+	rec.CancelledBy = t.cancelledBy
+	rec.Drift = t.drift
+	rec.Review = t.review
+	rec.Expired = t.expired
+	rec.Run = t.run
+	rec.LockToken = t.lockToken
+	rec.Labels = t.executor.Labels()
+	rec.Owner = instanceId
+}
+
+func (t *GitTask) restore(rec *storer.TaskRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.authors = rec.Authors
+	if !rec.Created.IsZero() {
+		t.created = rec.Created
+	}
+	if len(rec.History) > 0 {
+		t.history.restore(rec.History)
+	}
+	t.ref = rec.Ref
+	t.rerunOf = rec.RerunOf
+	t.cancelledBy = rec.CancelledBy
+	t.drift = rec.Drift
+	t.review = rec.Review
+	t.expired = rec.Expired
+	t.run = rec.Run
+	t.lockToken = rec.LockToken
+}
+
+//getBranch returns the branch the task runs against
+func (t *GitTask) getBranch() string {
+	if t.ref != "" {
+		return t.ref
+	}
+	return fmt.Sprintf("%s%d", misc.TaskPrefix, t.id)
+}
+
+// Returns mapping of git manager to its URL
+func (t *GitTask) getGitManagers() (map[string]git.Manager, error) {
+	origins := t.executor.Origins()
+	if len(origins) == 0 {
+		return nil, fmt.Errorf("Cannot obtain a git manager. Task id %d contains no git remotes", t.id)
+	}
+	managers := make(map[string]git.Manager)
+	for _, gurl := range origins {
+		gitman, err := git.GetManager(gurl, t.executor.StateLock(), t.executor.GitApiVersion())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get git manager for task %d (url: %s) error: %w", t.id, gurl, err)
+		}
+		managers[gurl] = gitman
+	}
+	return managers, nil
+}
+
+func (t *GitTask) prepareGitHub() error {
+	gitManagers, err := t.getGitManagers()
+	if err != nil {
+		misc.Debugf("cannot prepare GitHub, because Git manager are not available. Error: %s", err)
+		return err
+	}
+	repoOwner := viper.GetString(misc.RepoOwnerKey)
+	token := viper.GetString(misc.TokenKey)
+	for _, gm := range gitManagers {
+		gitHubManager := github.GetManager(gm.GetRemote())
+		if gitHubManager == nil {
+			//Initialize GitHub manager
+			github.InitManager(gm.GetRemote(), repoOwner, token)
+			gitHubManager = github.GetManager(gm.GetRemote())
+		}
+		gitHubManager.Start()
+	}
+	return nil
+}
+
+//prepareGit checks out the task branch of all the origins and returns the workspace
+func (t *GitTask) prepareGit() (*Workspace, error) {
+	branch := t.getBranch()
+	gms, err := t.getGitManagers()
+	if err != nil {
+		return nil, err
+	}
+	gmwg := &sync.WaitGroup{}
+	errc := make(chan error)
+	for gurl, gitman := range gms {
+		gmwg.Add(1)
+		go func(gurl string, manager git.Manager, errChan chan<- error) {
+			defer gmwg.Done()
+			//Wait for corresponding webhook to come. Re-runs use the branch, which has been pushed already
+			if t.ref == "" {
+				misc.Debugf("Waiting for a webhook to come from %s repo for a task %d", manager.GetRemote(), t.id)
+				wht := viper.GetInt(misc.WebhookWaitTimeoutKey)
+				err := manager.WaitForWebhook(branch, wht)
+				if err != nil {
+					errChan <- fmt.Errorf("failed to wait for a webhook lock. Error: %w", err)
+					return
+				}
+			}
+			misc.Debugf("Preparing Git repo %s", gurl)
+
+			//Clone it if needed
+			if manager.IsCloned() {
+				err := manager.Open()
+				if err != nil {
+					log.Printf("Cannot open git repository. Error: %s", err)
+					errChan <- err
+					return
+				}
+			} else {
+				path := manager.GetPath()
+				_, err := os.Stat(path)
+				if os.IsNotExist(err) {
+					err := os.MkdirAll(path, 0755)
+					if err != nil {
+						log.Printf("Cannot create directory for git repository. Error: %s", err)
+						errChan <- err
+						return
+					}
+				}
+				err = manager.Clone()
+				if err != nil {
+					log.Printf("Cannot clone repository. Error: %s", err)
+					errChan <- err
+					return
+				}
+			}
+
+			//Switch the branch
+			err = manager.SwitchTo(branch)
+			if err != nil {
+				log.Printf("Cannot switch branch")
+				errChan <- err
+				return
+			}
+			//Review runs the reviewed commit exactly. A commit pushed to the branch meanwhile is neither planned nor applied by it
+			if t.review != nil && t.review.Sha != "" {
+				err = manager.CheckoutCommit(t.review.Sha)
+				if err != nil {
+					errChan <- fmt.Errorf("cannot checkout reviewed commit %s. Error: %w", t.review.Sha, err)
+					return
+				}
+			}
+		}(gurl, gitman, errc)
+	}
+	go func() {
+		gmwg.Wait()
+		close(errc)
+	}()
+	var gitErr error
+	for gme := range errc {
+		if gme != nil && gitErr == nil {
+			gitErr = gme
+		}
+	}
+	if gitErr != nil {
+		return nil, gitErr
+	}
+	misc.Debugf("preparation of git repositories succesfully finished for task %d", t.id)
+	//Checkouts are shared by the tasks of the same state lock, so the task runs in its own copy of them
+	var checkouts []Repository
+	for _, gurl := range t.executor.Origins() {
+		checkouts = append(checkouts, Repository{Remote: gurl, Path: gms[gurl].GetPath()})
+	}
+	return newTaskWorkspace(t.id, checkouts)
+}
+
+func (t *GitTask) AddWebhookLocks() error {
+	managers, err := t.getGitManagers()
+	if err != nil {
+		return fmt.Errorf("cannot get git managers for task %d %w", t.id, err)
+	}
+	branch := fmt.Sprintf("%s%d", misc.TaskPrefix, t.id)
+	for _, m := range managers {
+		err := m.RegisterWebhookLock(branch)
+		if err != nil {
+			return fmt.Errorf("cannot add webhook lock for task %d at %s, %w", t.id, m.GetPath(), err)
+		}
+	}
+	return nil
+}
+
+func (t *GitTask) UnlockWebhookRepoLock(fullName string) error {
+	managers, err := t.getGitManagers()
+	if err != nil {
+		return fmt.Errorf("cannot get git managers for task %d %w", t.id, err)
+	}
+	branch := fmt.Sprintf("%s%d", misc.TaskPrefix, t.id)
+	for _, m := range managers {
+		frn, err := git.GetFullRepoName(m.GetRemote())
+		if err != nil {
+			return fmt.Errorf("cannot get full repository name of %s %w", m.GetRemote(), err)
+		}
+		if frn == fullName {
+			err := m.UnlockWebhookLock(branch)
+			if err != nil {
+				return fmt.Errorf("cannot add webhook lock for task %d at %s, %w", t.id, m.GetPath(), err)
+			}
+			misc.Debugf("successfully unlocked task %d at %s", t.id, m.GetPath())
+		}
+	}
+	return nil
+}
+
+func (t *GitTask) ReleaseWebhookLocks() error {
+	managers, err := t.getGitManagers()
+	if err != nil {
+		return fmt.Errorf("cannot get git managers for task %d %w", t.id, err)
+	}
+	branch := fmt.Sprintf("%s%d", misc.TaskPrefix, t.id)
+	var lastErr error
+	for _, m := range managers {
+		err := m.ReleaseWebhookLock(branch)
+		if err != nil {
+			misc.Debugf("cannot release webhook lock of task %d at %s. Error: %s", t.id, m.GetPath(), err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func upload2s3(id int, status TaskStatus) {
+	bucketName := viper.GetString(misc.S3BucketName)
+	suffix := GetStatusString(status)
+	err := storer.S3UploadTaskWithSuffix(bucketName, id, &suffix)
+	if err != nil {
+		if viper.GetBool(misc.DebugKey) {
+			log.Printf("Failed to upload output of the task %d Error: %s", id, err)
+		}
+	} else {
+		if viper.GetBool(misc.DebugKey) {
+			log.Printf("Output of the task %d has been successfully stored at S3 bucket", id)
+		}
+	}
+	err = storer.S3UploadTaskLines(bucketName, id)
+	if err != nil {
+		misc.Debugf("failed to upload output lines of the task %d Error: %s", id, err)
+	}
+	rec, err := GetTaskRecord(id)
+	if err != nil {
+		misc.Debugf("cannot load task %d record for archiving. Error: %s", id, err)
+		return
+	}
+	err = storer.S3UploadTaskRecord(bucketName, rec)
+	if err != nil {
+		misc.Debugf("failed to upload record of the task %d Error: %s", id, err)
+	}
+}
@@ -0,0 +1,107 @@
+package launcher
+
+import (
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGitTask_CancelWhileStarting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-gittask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	for i := 0; i < 50; i++ {
+		task := newTerraformTask(&TerraformTaskDefinition{Repository: "git@github.com:wix-system/cancel.git", StateLock: "cancel", Tool: ToolTerraform})
+		task.setId(9100 + i)
+		task.SetStatus(misc.SCHEDULED)
+		statuses := task.Subscribe()
+		var startErr, cancelErr error
+		var wg sync.WaitGroup
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			startErr = task.Start()
+		}()
+		go func() {
+			defer wg.Done()
+			cancelErr = task.Cancel("tester")
+		}()
+		go func() {
+			defer wg.Done()
+			//Status is watched by the API while the task changes
+			task.GetStatus()
+			task.GetAuthors()
+			task.SetAuthors([]string{"tester"})
+		}()
+		wg.Wait()
+		if cancelErr != nil {
+			t.Fatalf("Cancel() error = %v", cancelErr)
+		}
+		status := task.GetStatus()
+		switch {
+		case startErr == nil && status == misc.STARTED:
+			//Run finishes the cancellation once the executor gets interrupted
+			if task.getCancelledBy() != "tester" {
+				t.Fatalf("started task has not been marked as cancelled")
+			}
+		case startErr != nil && status == misc.CANCELLED:
+		default:
+			t.Fatalf("Start() error = %v, status %s: cancelled task must not start", startErr, GetStatusString(status))
+		}
+		if got := <-statuses; got != misc.SCHEDULED {
+			t.Errorf("first notified status = %s, want %s", GetStatusString(got), GetStatusString(misc.SCHEDULED))
+		}
+		if got := <-statuses; got != status {
+			t.Errorf("notified status = %s, want %s", GetStatusString(got), GetStatusString(status))
+		}
+	}
+}
+
+func TestTaskManagerImpl_LaunchWhileCancelling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-gittask")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	tm := &TaskManagerImpl{dispatcher: newDispatcher(100, newWorkerPool(0, nil), func(task Task) {})}
+	for i := 0; i < 50; i++ {
+		task := newTerraformTask(&TerraformTaskDefinition{Repository: "git@github.com:wix-system/launch.git", StateLock: "launch", Tool: ToolTerraform})
+		task.setId(9200 + i)
+		var launchErr, cancelErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			launchErr = tm.Launch(task)
+		}()
+		go func() {
+			defer wg.Done()
+			cancelErr = task.Cancel("tester")
+		}()
+		wg.Wait()
+		if launchErr != nil || cancelErr != nil {
+			t.Fatalf("Launch() error = %v, Cancel() error = %v", launchErr, cancelErr)
+		}
+		//Cancel of the scheduled task completes it right away, so the cancellation must never be overwritten
+		if status := task.GetStatus(); status != misc.CANCELLED {
+			t.Fatalf("status = %s, want %s", GetStatusString(status), GetStatusString(misc.CANCELLED))
+		}
+	}
+	expired := newTerraformTask(&TerraformTaskDefinition{Repository: "git@github.com:wix-system/launch.git", StateLock: "launch", Tool: ToolTerraform})
+	expired.setId(9300)
+	if err := expired.Expire("tester"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Launch(expired); err == nil || expired.GetStatus() != misc.FAILED {
+		t.Errorf("Launch() of expired task error = %v, status %s, want it to stay failed", err, GetStatusString(expired.GetStatus()))
+	}
+}
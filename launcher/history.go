@@ -0,0 +1,32 @@
+package launcher
+
+import (
+	"github.com/wix-playground/tfChek/storer"
+	"sync"
+	"time"
+)
+
+//statusHistory keeps status transitions of a task in the order they have happened
+type statusHistory struct {
+	lock        sync.Mutex
+	transitions []storer.StatusTransition
+}
+
+func (h *statusHistory) add(status TaskStatus, reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.transitions = append(h.transitions, storer.StatusTransition{Status: int(status), Time: time.Now(), Reason: reason})
+}
+
+//restore replaces the history with the one loaded from the task store
+func (h *statusHistory) restore(transitions []storer.StatusTransition) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.transitions = append([]storer.StatusTransition(nil), transitions...)
+}
+
+func (h *statusHistory) list() []storer.StatusTransition {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]storer.StatusTransition(nil), h.transitions...)
+}
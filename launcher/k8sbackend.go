@@ -0,0 +1,324 @@
+package launcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//kubernetesPollInterval is the period of the job pod status checks
+var kubernetesPollInterval = 2 * time.Second
+
+//kubernetesBackend runs the process as a Kubernetes Job. The workspace directory has to be a persistent volume claim
+//shared with the server. The task workspace is mounted at the same path, so the paths in the environment stay valid
+type kubernetesBackend struct {
+	api       string
+	token     string
+	namespace string
+	image     string
+	claim     string
+	client    *http.Client
+}
+
+func newKubernetesBackend() (*kubernetesBackend, error) {
+	b := &kubernetesBackend{api: strings.TrimRight(viper.GetString(misc.KubeApiKey), "/"),
+		namespace: viper.GetString(misc.KubeNamespaceKey), image: viper.GetString(misc.BackendImageKey),
+		claim: viper.GetString(misc.KubeVolumeClaimKey), client: &http.Client{}}
+	if b.image == "" || b.claim == "" {
+		return nil, fmt.Errorf("%s and %s have to be set for %s backend", misc.BackendImageKey, misc.KubeVolumeClaimKey, BackendKubernetes)
+	}
+	//The server runs in the cluster unless the API is configured
+	if b.api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("%s has to be set outside of the cluster", misc.KubeApiKey)
+		}
+		b.api = "https://" + host + ":" + port
+	}
+	if tf := viper.GetString(misc.KubeTokenFileKey); tf != "" {
+		token, err := ioutil.ReadFile(tf)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read kubernetes token. Error: %w", err)
+		}
+		b.token = strings.TrimSpace(string(token))
+	}
+	if cf := viper.GetString(misc.KubeCAFileKey); cf != "" {
+		ca, err := ioutil.ReadFile(cf)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read kubernetes CA certificate. Error: %w", err)
+		}
+		if len(ca) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("cannot parse kubernetes CA certificate %s", cf)
+			}
+			b.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+	}
+	return b, nil
+}
+
+func (b *kubernetesBackend) Name() string {
+	return BackendKubernetes
+}
+
+//jobName is unique for every step of the task, because the job of the previous step may be still being deleted.
+//It is a DNS label, so it has to fit 63 characters: the app name, the task id and the nanoseconds take 51 at most
+func jobName(taskId int) string {
+	return fmt.Sprintf("%s-task-%d-%d", strings.ToLower(misc.APPNAME), taskId, time.Now().UnixNano())
+}
+
+//Run creates the job, streams the log of its pod to the task output and waits for the pod to finish.
+//The environment is passed with a secret of the same name, so credentials are not a part of the job spec. Both are deleted afterwards
+func (b *kubernetesBackend) Run(ctx context.Context, ws *Workspace, command *exec.Cmd) error {
+	name := jobName(ws.TaskId)
+	job, err := b.jobManifest(name, ws, command)
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return err
+	}
+	err = b.do(context.Background(), http.MethodPost, b.secretsPath(), secretManifest(name, ws, command), nil)
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return fmt.Errorf("cannot create secret %s. Error: %w", name, err)
+	}
+	defer b.deleteSecret(name)
+	err = b.do(context.Background(), http.MethodPost, b.jobsPath(), job, nil)
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return fmt.Errorf("cannot create job %s. Error: %w", name, err)
+	}
+	defer b.deleteJob(name)
+	pod, err := b.waitForPod(ctx, name, false)
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return err
+	}
+	err = b.streamLog(ctx, pod.Metadata.Name, ws)
+	if err != nil {
+		misc.Debugf("log of job %s of task %d has been interrupted. Error: %s", name, ws.TaskId, err)
+	}
+	pod, err = b.waitForPod(ctx, name, true)
+	if err != nil {
+		ws.Output.FinishStep(nil, "")
+		return err
+	}
+	code, reason := pod.exitCode()
+	ws.Output.FinishStep(code, "")
+	if code == nil {
+		return fmt.Errorf("job %s has not completed. Reason: %s", name, reason)
+	}
+	if *code != 0 {
+		return fmt.Errorf("job %s has failed with exit code %d", name, *code)
+	}
+	return nil
+}
+
+func (b *kubernetesBackend) jobManifest(name string, ws *Workspace, command *exec.Cmd) (map[string]interface{}, error) {
+	subPath, err := filepath.Rel(viper.GetString(misc.WorkspaceDirKey), ws.Root)
+	if err != nil || ws.Root == "" || strings.HasPrefix(subPath, "..") {
+		return nil, fmt.Errorf("workspace %s of task %d is not in %s", ws.Root, ws.TaskId, misc.WorkspaceDirKey)
+	}
+	labels := jobLabels(ws)
+	container := map[string]interface{}{
+		"name": "task", "image": b.image, "command": command.Args, "workingDir": command.Dir,
+		"envFrom":      []interface{}{map[string]interface{}{"secretRef": map[string]string{"name": name}}},
+		"volumeMounts": []map[string]string{{"name": "workspace", "mountPath": ws.Root, "subPath": subPath}},
+	}
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec": map[string]interface{}{
+			"backoffLimit": 0,
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers":    []interface{}{container},
+					"volumes": []interface{}{map[string]interface{}{"name": "workspace",
+						"persistentVolumeClaim": map[string]string{"claimName": b.claim}}},
+				},
+			},
+		},
+	}, nil
+}
+
+//secretManifest keeps the environment of the command, which may contain credentials
+func secretManifest(name string, ws *Workspace, command *exec.Cmd) map[string]interface{} {
+	env := make(map[string]string)
+	for _, kv := range command.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]interface{}{"name": name, "labels": jobLabels(ws)},
+		"type":       "Opaque",
+		"stringData": env,
+	}
+}
+
+func jobLabels(ws *Workspace) map[string]string {
+	return map[string]string{"app": strings.ToLower(misc.APPNAME), "task": strconv.Itoa(ws.TaskId)}
+}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string `json:"phase"`
+		Reason            string `json:"reason"`
+		ContainerStatuses []struct {
+			State struct {
+				Terminated *struct {
+					ExitCode int    `json:"exitCode"`
+					Reason   string `json:"reason"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+func (p *kubernetesPod) completed() bool {
+	return p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed"
+}
+
+func (p *kubernetesPod) exitCode() (*int, string) {
+	for _, cs := range p.Status.ContainerStatuses {
+		if t := cs.State.Terminated; t != nil {
+			code := t.ExitCode
+			return &code, t.Reason
+		}
+	}
+	return nil, p.Status.Reason
+}
+
+//waitForPod waits for the job pod to start or to complete
+func (b *kubernetesBackend) waitForPod(ctx context.Context, job string, completed bool) (*kubernetesPod, error) {
+	query := url.Values{"labelSelector": []string{"job-name=" + job}}
+	for {
+		var pods struct {
+			Items []kubernetesPod `json:"items"`
+		}
+		err := b.do(ctx, http.MethodGet, b.namespacePath("/api/v1", "pods")+"?"+query.Encode(), nil, &pods)
+		if err != nil && ctx.Err() == nil {
+			misc.Debugf("cannot get pods of job %s. Error: %s", job, err)
+		}
+		for i := range pods.Items {
+			p := &pods.Items[i]
+			if p.completed() || (!completed && p.Status.Phase == "Running") {
+				return p, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("job %s has been stopped. Reason: %w", job, ctx.Err())
+		case <-time.After(kubernetesPollInterval):
+		}
+	}
+}
+
+//streamLog copies the log of the pod to the output until the container exits. Kubernetes does not separate the streams
+func (b *kubernetesBackend) streamLog(ctx context.Context, pod string, ws *Workspace) error {
+	req, err := b.request(ctx, http.MethodGet, b.namespacePath("/api/v1", "pods", pod, "log")+"?follow=true&container=task", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	_, err = io.Copy(ws.Output.GetStdOut(), resp.Body)
+	return err
+}
+
+func (b *kubernetesBackend) deleteJob(name string) {
+	err := b.do(context.Background(), http.MethodDelete, b.jobsPath()+"/"+name+"?propagationPolicy=Background", nil, nil)
+	if err != nil {
+		misc.Debugf("cannot delete job %s. Error: %s", name, err)
+	}
+}
+
+func (b *kubernetesBackend) deleteSecret(name string) {
+	err := b.do(context.Background(), http.MethodDelete, b.secretsPath()+"/"+name, nil, nil)
+	if err != nil {
+		log.Printf("Cannot delete secret %s with the task environment. Error: %s", name, err)
+	}
+}
+
+func (b *kubernetesBackend) secretsPath() string {
+	return b.namespacePath("/api/v1", "secrets")
+}
+
+func (b *kubernetesBackend) jobsPath() string {
+	return b.namespacePath("/apis/batch/v1", "jobs")
+}
+
+func (b *kubernetesBackend) namespacePath(api string, elem ...string) string {
+	return strings.Join(append([]string{api, "namespaces", b.namespace}, elem...), "/")
+}
+
+func (b *kubernetesBackend) request(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.api+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(misc.ContentTypeKey, misc.ContentTypeJson)
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	return req, nil
+}
+
+func (b *kubernetesBackend) do(ctx context.Context, method, path string, body, result interface{}) error {
+	req, err := b.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s responded with %s: %s", method, path, resp.Status, msg)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
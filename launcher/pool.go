@@ -0,0 +1,80 @@
+package launcher
+
+import (
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+)
+
+//workerPool limits the number of tasks running at the same time.
+//Tasks of the same state lock are still serialized by their queue, the pool limits only the tasks of different state locks
+type workerPool struct {
+	//global is nil when the total number of running tasks is unlimited
+	global chan struct{}
+	limits []*poolLimit
+}
+
+//poolLimit restricts the number of running tasks, which state lock matches the pattern (prod/* for example)
+type poolLimit struct {
+	pattern string
+	slots   chan struct{}
+}
+
+func newWorkerPool(max int, limits map[string]int) *workerPool {
+	p := &workerPool{}
+	if max > 0 {
+		p.global = make(chan struct{}, max)
+	}
+	for pattern, limit := range limits {
+		if limit <= 0 {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("Concurrency limit pattern %q is malformed and will be ignored. Error: %s", pattern, err)
+			continue
+		}
+		p.limits = append(p.limits, &poolLimit{pattern: pattern, slots: make(chan struct{}, limit)})
+	}
+	//Slots have to be always acquired in the same order to avoid dead locks
+	sort.Slice(p.limits, func(i, j int) bool { return p.limits[i].pattern < p.limits[j].pattern })
+	return p
+}
+
+//newWorkerPoolFromConfig reads max_concurrency and concurrency_limits options.
+//Limits are set as a map of the state lock pattern to the maximal number of concurrently running tasks
+func newWorkerPoolFromConfig() *workerPool {
+	limits := make(map[string]int)
+	for pattern, value := range viper.GetStringMapString(misc.ConcurrencyLimitsKey) {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Concurrency limit %q of %q is not a number and will be ignored", value, pattern)
+			continue
+		}
+		limits[pattern] = limit
+	}
+	return newWorkerPool(viper.GetInt(misc.MaxConcurrencyKey), limits)
+}
+
+//acquire blocks until the task of the given state lock is allowed to run. Returned function releases the taken slots
+func (p *workerPool) acquire(syncName string) func() {
+	var taken []chan struct{}
+	//Take the narrow limits first, so a task waiting for them does not hold a global slot
+	for _, l := range p.limits {
+		if matched, _ := path.Match(l.pattern, syncName); matched {
+			l.slots <- struct{}{}
+			taken = append(taken, l.slots)
+		}
+	}
+	if p.global != nil {
+		p.global <- struct{}{}
+		taken = append(taken, p.global)
+	}
+	return func() {
+		for i := len(taken) - 1; i >= 0; i-- {
+			<-taken[i]
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package launcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_workerPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		limits    map[string]int
+		syncNames []string
+		want      int32
+	}{
+		{"Unlimited", 0, nil, []string{"a/1", "a/2", "a/3", "a/4"}, 4},
+		{"Global limit", 2, nil, []string{"a/1", "a/2", "a/3", "a/4"}, 2},
+		{"Environment limit", 0, map[string]int{"prod/*": 1}, []string{"prod/1", "prod/2", "prod/3"}, 1},
+		{"Environment limit does not affect others", 0, map[string]int{"prod/*": 1}, []string{"prod/1", "prod/2", "stg/1", "stg/2"}, 3},
+		{"Both limits", 3, map[string]int{"prod/*": 1}, []string{"prod/1", "prod/2", "stg/1", "stg/2", "stg/3"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newWorkerPool(tt.max, tt.limits)
+			var running, peak int32
+			wg := &sync.WaitGroup{}
+			for _, sn := range tt.syncNames {
+				wg.Add(1)
+				go func(syncName string) {
+					defer wg.Done()
+					release := p.acquire(syncName)
+					defer release()
+					r := atomic.AddInt32(&running, 1)
+					for {
+						pk := atomic.LoadInt32(&peak)
+						if r <= pk || atomic.CompareAndSwapInt32(&peak, pk, r) {
+							break
+						}
+					}
+					time.Sleep(50 * time.Millisecond)
+					atomic.AddInt32(&running, -1)
+				}(sn)
+			}
+			wg.Wait()
+			if peak != tt.want {
+				t.Errorf("peak of concurrently running tasks = %d, want %d", peak, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//outputDrainTimeout limits the wait for the output of the processes, which have left the process group with the pipes open
+const outputDrainTimeout = 5 * time.Second
+
+//interruptGracePeriod is the time the interrupted run has to exit before it gets killed
+func interruptGracePeriod() time.Duration {
+	return time.Duration(viper.GetInt(misc.InterruptGraceKey)) * time.Second
+}
+
+//runProcess runs the process of the current step of the workspace output and records its exit code.
+//The process gets its own process group, so terraform, plugins and other children it spawns are stopped together with it:
+//the group is interrupted when the context is done and killed if it does not exit in the grace period
+func runProcess(ctx context.Context, ws *Workspace, command *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		ws.Output.FinishStep(exitStatus(err))
+		return err
+	}
+	stdout, err := newProcessOutput(ws.Output.GetStdOut())
+	if err != nil {
+		return fmt.Errorf("cannot create stdout pipe. Error: %w", err)
+	}
+	stderr, err := newProcessOutput(ws.Output.GetStdErr())
+	if err != nil {
+		stdout.abort()
+		return fmt.Errorf("cannot create stderr pipe. Error: %w", err)
+	}
+	command.Stdout = stdout.w
+	command.Stderr = stderr.w
+	//I will write nothing to the command
+	command.Stdin = nil
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err = command.Start()
+	//The process has its own copies of the write ends
+	stdout.closeWriter()
+	stderr.closeWriter()
+	if err != nil {
+		stdout.drain(ws.TaskId)
+		stderr.drain(ws.TaskId)
+		ws.Output.FinishStep(exitStatus(err))
+		return err
+	}
+	pgid := command.Process.Pid
+	finished := make(chan struct{})
+	interrupted := make(chan struct{})
+	go func() {
+		defer close(interrupted)
+		interruptGroupOnDone(ctx, ws.TaskId, pgid, finished)
+	}()
+	err = command.Wait()
+	close(finished)
+	<-interrupted
+	ws.Output.FinishStep(exitStatus(err))
+	killLeftovers(ws, pgid)
+	stdout.drain(ws.TaskId)
+	stderr.drain(ws.TaskId)
+	return err
+}
+
+//interruptGroupOnDone sends interrupt signal to the process group when the context is done, so terraform can release its state lock.
+//The group is killed if the process does not exit in the grace period
+func interruptGroupOnDone(ctx context.Context, taskId, pgid int, finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+	misc.Debugf("interrupting process group %d of task %d. Reason: %s", pgid, taskId, ctx.Err())
+	grace := interruptGracePeriod()
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGKILL} {
+		err := syscall.Kill(-pgid, sig)
+		if err != nil {
+			misc.Debugf("cannot send %s to process group %d of task %d. Error: %s", sig, pgid, taskId, err)
+		}
+		select {
+		case <-finished:
+			return
+		case <-time.After(grace):
+			misc.Debugf("task %d has not exited in %s after %s signal", taskId, grace, sig)
+		}
+	}
+}
+
+//killLeftovers kills the processes of the group, which are still running after the main process has exited.
+//They are reported to the task output, because they may have held terraform state locks
+func killLeftovers(ws *Workspace, pgid int) {
+	leftovers := groupProcesses(pgid)
+	if len(leftovers) == 0 {
+		return
+	}
+	msg := fmt.Sprintf("processes left running by the task have been killed: %s", strings.Join(leftovers, ", "))
+	log.Printf("Task %d: %s", ws.TaskId, msg)
+	_, err := fmt.Fprintf(ws.Output.GetStdErr(), "\n%s: %s\n", misc.APPNAME, msg)
+	if err != nil {
+		misc.Debugf("cannot report leftover processes of task %d. Error: %s", ws.TaskId, err)
+	}
+	err = syscall.Kill(-pgid, syscall.SIGKILL)
+	if err != nil && !errors.Is(err, syscall.ESRCH) {
+		log.Printf("Cannot kill process group %d of task %d. Error: %s", pgid, ws.TaskId, err)
+	}
+}
+
+//groupProcesses returns live processes of the group as 'pid (command)'. The group itself is returned if /proc is not available
+func groupProcesses(pgid int) []string {
+	if syscall.Kill(-pgid, 0) != nil {
+		return nil
+	}
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return []string{fmt.Sprintf("process group %d", pgid)}
+	}
+	var processes []string
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		if p, ok := parseProcStat(string(stat), pgid); ok {
+			processes = append(processes, p)
+		}
+	}
+	return processes
+}
+
+//parseProcStat checks that the process of /proc/<pid>/stat is alive and belongs to the group
+func parseProcStat(stat string, pgid int) (string, bool) {
+	//Command is in parentheses and may contain spaces and parentheses itself
+	open, closing := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if open < 0 || closing < open {
+		return "", false
+	}
+	//Fields after the command are: state ppid pgrp
+	fields := strings.Fields(stat[closing+1:])
+	if len(fields) < 3 || fields[0] == "Z" || fields[2] != strconv.Itoa(pgid) {
+		return "", false
+	}
+	return fmt.Sprintf("%s %s", strings.TrimSpace(stat[:open]), stat[open:closing+1]), true
+}
+
+//processOutput copies the output of the process through OS pipe. Unlike the pipes made by exec package,
+//it lets to wait for the process exit while its children still hold the pipe open
+type processOutput struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+func newProcessOutput(dst io.Writer) (*processOutput, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	po := &processOutput{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		defer close(po.done)
+		_, err := io.Copy(dst, r)
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			misc.Debugf("cannot copy process output. Error: %s", err)
+		}
+	}()
+	return po, nil
+}
+
+func (po *processOutput) closeWriter() {
+	err := po.w.Close()
+	if err != nil {
+		misc.Debugf("cannot close process output pipe. Error: %s", err)
+	}
+}
+
+//drain waits for the rest of the output. The pipe is closed anyway after the timeout
+func (po *processOutput) drain(taskId int) {
+	select {
+	case <-po.done:
+	case <-time.After(outputDrainTimeout):
+		misc.Debugf("output of task %d is still open after %s. Closing it", taskId, outputDrainTimeout)
+	}
+	err := po.r.Close()
+	if err != nil {
+		misc.Debugf("cannot close process output pipe of task %d. Error: %s", taskId, err)
+	}
+	<-po.done
+}
+
+func (po *processOutput) abort() {
+	po.closeWriter()
+	po.r.Close()
+	<-po.done
+}
+
+//exitStatus returns the exit code and the terminating signal of the process by the error of its run.
+//Neither of them is known if the process has not been started
+func exitStatus(err error) (*int, string) {
+	if err == nil {
+		code := 0
+		return &code, ""
+	}
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return nil, ""
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return nil, ws.Signal().String()
+	}
+	code := ee.ExitCode()
+	return &code, ""
+}
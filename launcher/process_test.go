@@ -0,0 +1,136 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		run        func() error
+		wantCode   int
+		wantKnown  bool
+		wantSignal string
+	}{
+		{name: "success", run: func() error { return nil }, wantKnown: true},
+		{name: "exit code", run: func() error { return exec.Command("sh", "-c", "exit 3").Run() }, wantCode: 3, wantKnown: true},
+		{name: "signal", run: func() error { return exec.Command("sh", "-c", "kill -TERM $$").Run() }, wantSignal: "terminated"},
+		{name: "not started", run: func() error { return exec.Command("/nonexistent/tfchek-test").Run() }},
+		{name: "other error", run: func() error { return errors.New("failed") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, signal := exitStatus(tt.run())
+			if (code != nil) != tt.wantKnown {
+				t.Fatalf("exitStatus() code = %v, want known %v", code, tt.wantKnown)
+			}
+			if code != nil && *code != tt.wantCode {
+				t.Errorf("exitStatus() code = %d, want %d", *code, tt.wantCode)
+			}
+			if signal != tt.wantSignal {
+				t.Errorf("exitStatus() signal = %q, want %q", signal, tt.wantSignal)
+			}
+		})
+	}
+}
+
+func TestRunProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.OutDirKey, dir)
+	defer viper.Set(misc.OutDirKey, nil)
+	viper.Set(misc.InterruptGraceKey, 1)
+	defer viper.Set(misc.InterruptGraceKey, nil)
+	tests := []struct {
+		name string
+		//script is run by sh in its own process group
+		script     string
+		cancel     time.Duration
+		wantSignal string
+		wantOutput string
+	}{
+		{name: "exit", script: "echo done"},
+		{name: "interrupted tree", script: "sleep 30 & sleep 30; wait", cancel: 200 * time.Millisecond, wantSignal: "interrupt"},
+		{name: "interrupt ignored", script: `trap "" INT; sleep 30 & sleep 30; wait`, cancel: 200 * time.Millisecond, wantSignal: "killed"},
+		{name: "leftover", script: "sleep 30 & echo started", wantOutput: "processes left running by the task have been killed"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := storer.NewTaskFileSink(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ws := &Workspace{TaskId: i + 1, Output: sink}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel > 0 {
+				time.AfterFunc(tt.cancel, cancel)
+			}
+			command := exec.Command("sh", "-c", tt.script)
+			sink.StartStep("sh")
+			start := time.Now()
+			err = runProcess(ctx, ws, command)
+			sink.Close()
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("runProcess() took %s", elapsed)
+			}
+			if (err != nil) != (tt.wantSignal != "") {
+				t.Errorf("runProcess() error = %v, want signal %q", err, tt.wantSignal)
+			}
+			run := sink.GetRunRecord()
+			if run.Signal != tt.wantSignal {
+				t.Errorf("signal = %q, want %q", run.Signal, tt.wantSignal)
+			}
+			//Killed processes may stay zombies for a while, so only the live ones are checked
+			if left := groupProcesses(command.Process.Pid); len(left) > 0 {
+				syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+				t.Errorf("processes %v of group %d are still running", left, command.Process.Pid)
+			}
+			out, err := storer.ReadTask(i + 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(out), tt.wantOutput) {
+				t.Errorf("output %q does not contain %q", out, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		name   string
+		stat   string
+		pgid   int
+		want   string
+		wantOk bool
+	}{
+		{name: "member", stat: "42 (terraform) S 1 40 40 0 -1", pgid: 40, want: "42 (terraform)", wantOk: true},
+		{name: "command with spaces", stat: "43 (tmux: server) (1) S 1 40 40 0", pgid: 40, want: "43 (tmux: server) (1)", wantOk: true},
+		{name: "other group", stat: "44 (sleep) S 1 41 41 0", pgid: 40},
+		{name: "zombie", stat: "45 (sleep) Z 1 40 40 0", pgid: 40},
+		{name: "broken", stat: "46 sleep", pgid: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseProcStat(tt.stat, tt.pgid)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseProcStat() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package launcher
+
+import (
+	"fmt"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"sort"
+	"strings"
+	"time"
+)
+
+//TaskFilter selects stored task records. Zero values of the fields do not restrict the selection
+type TaskFilter struct {
+	Statuses  []TaskStatus
+	StateLock string
+	Author    string
+	Since     time.Time
+	Until     time.Time
+	Offset    int
+	Limit     int
+	//Expired selects only the tasks, which have never received their webhook
+	Expired bool
+	//Labels the task has to carry. Empty value matches any value of the label
+	Labels map[string]string
+}
+
+//ParseTaskStatus is the reverse of GetStatusString
+func ParseTaskStatus(name string) (TaskStatus, error) {
+	for _, status := range []TaskStatus{misc.OPEN, misc.REGISTERED, misc.SCHEDULED, misc.STARTED, misc.FAILED, misc.TIMEOUT, misc.DONE, misc.CANCELLED} {
+		if strings.EqualFold(GetStatusString(status), name) {
+			return status, nil
+		}
+	}
+	return misc.OPEN, fmt.Errorf("unknown task status %q", name)
+}
+
+func (f *TaskFilter) Match(rec *storer.TaskRecord) bool {
+	if len(f.Statuses) > 0 {
+		matched := false
+		for _, s := range f.Statuses {
+			if int(s) == rec.Status {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.StateLock != "" && f.StateLock != rec.StateLock {
+		return false
+	}
+	if f.Author != "" {
+		matched := false
+		for _, a := range rec.Authors {
+			if strings.EqualFold(a, f.Author) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.Expired && !rec.Expired {
+		return false
+	}
+	for k, v := range f.Labels {
+		rv, ok := rec.Labels[k]
+		if !ok || (v != "" && rv != v) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && rec.Created.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && rec.Created.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+//FindTaskRecords returns the requested page of stored task records matching the filter, the newest tasks go first.
+//The second returned value is the total number of matching records
+func FindTaskRecords(filter *TaskFilter) ([]*storer.TaskRecord, int, error) {
+	records, err := storer.GetTaskStore().List()
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read task store. Error: %w", err)
+	}
+	page, total := filterTaskRecords(records, filter)
+	return page, total, nil
+}
+
+func filterTaskRecords(records []*storer.TaskRecord, filter *TaskFilter) ([]*storer.TaskRecord, int) {
+	matched := []*storer.TaskRecord{}
+	for _, rec := range records {
+		if filter.Match(rec) {
+			matched = append(matched, rec)
+		}
+	}
+	total := len(matched)
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Id > matched[j].Id })
+	if filter.Offset >= total {
+		return []*storer.TaskRecord{}, total
+	}
+	matched = matched[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(matched) {
+		matched = matched[:filter.Limit]
+	}
+	return matched, total
+}
@@ -0,0 +1,69 @@
+package launcher
+
+import (
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_filterTaskRecords(t *testing.T) {
+	base := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []*storer.TaskRecord{
+		{Id: 1, Status: misc.DONE, StateLock: "prod/network", Authors: []string{"alice"}, Created: base, Labels: map[string]string{"jira": "OPS-1"}},
+		{Id: 2, Status: misc.FAILED, StateLock: "prod/network", Authors: []string{"bob"}, Created: base.Add(time.Hour), Expired: true},
+		{Id: 3, Status: misc.OPEN, StateLock: "staging/network", Authors: []string{"Alice", "bob"}, Created: base.Add(2 * time.Hour)},
+		{Id: 4, Status: misc.DONE, StateLock: "staging/db", Created: base.Add(3 * time.Hour), Labels: map[string]string{"jira": "OPS-2", "hotfix": ""}},
+	}
+	ids := func(recs []*storer.TaskRecord) []int {
+		res := []int{}
+		for _, r := range recs {
+			res = append(res, r.Id)
+		}
+		return res
+	}
+	tests := []struct {
+		name      string
+		filter    TaskFilter
+		wantIds   []int
+		wantTotal int
+	}{
+		{"No filter", TaskFilter{}, []int{4, 3, 2, 1}, 4},
+		{"Status", TaskFilter{Statuses: []TaskStatus{misc.DONE}}, []int{4, 1}, 2},
+		{"Several statuses", TaskFilter{Statuses: []TaskStatus{misc.OPEN, misc.FAILED}}, []int{3, 2}, 2},
+		{"State lock", TaskFilter{StateLock: "prod/network"}, []int{2, 1}, 2},
+		{"Author ignores case", TaskFilter{Author: "alice"}, []int{3, 1}, 2},
+		{"Expired", TaskFilter{Expired: true}, []int{2}, 1},
+		{"Label value", TaskFilter{Labels: map[string]string{"jira": "OPS-1"}}, []int{1}, 1},
+		{"Label of any value", TaskFilter{Labels: map[string]string{"jira": ""}}, []int{4, 1}, 2},
+		{"Several labels", TaskFilter{Labels: map[string]string{"jira": "", "hotfix": ""}}, []int{4}, 1},
+		{"Time range", TaskFilter{Since: base.Add(time.Hour), Until: base.Add(2 * time.Hour)}, []int{3, 2}, 2},
+		{"First page", TaskFilter{Limit: 3}, []int{4, 3, 2}, 4},
+		{"Second page", TaskFilter{Offset: 3, Limit: 3}, []int{1}, 4},
+		{"Beyond the last page", TaskFilter{Offset: 10, Limit: 3}, []int{}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total := filterTaskRecords(records, &tt.filter)
+			if !reflect.DeepEqual(ids(got), tt.wantIds) {
+				t.Errorf("filterTaskRecords() = %v, want %v", ids(got), tt.wantIds)
+			}
+			if total != tt.wantTotal {
+				t.Errorf("filterTaskRecords() total = %d, want %d", total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestParseTaskStatus(t *testing.T) {
+	for _, status := range []TaskStatus{misc.OPEN, misc.SCHEDULED, misc.STARTED, misc.DONE} {
+		got, err := ParseTaskStatus(GetStatusString(status))
+		if err != nil || got != status {
+			t.Errorf("ParseTaskStatus(%q) = %d, %v, want %d", GetStatusString(status), got, err, status)
+		}
+	}
+	if _, err := ParseTaskStatus("bogus"); err == nil {
+		t.Errorf("ParseTaskStatus() should fail on unknown status")
+	}
+}
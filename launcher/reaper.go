@@ -0,0 +1,129 @@
+package launcher
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"sync"
+	"time"
+)
+
+//reapInterval is how often open tasks are checked for expiration
+const reapInterval = time.Minute
+
+//pruneInterval is how often records of the completed tasks are checked for removal. Listing the records is expensive
+const pruneInterval = time.Hour
+
+//reaper expires open tasks, which webhooks never come (run.sh has died before pushing the branch for example).
+//It also removes task workspaces and task records, which retention period is over
+type reaper struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func (tm *TaskManagerImpl) startReaper() {
+	r := &reaper{stop: make(chan struct{}), done: make(chan struct{})}
+	tm.lock.Lock()
+	tm.reaper = r
+	tm.lock.Unlock()
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(reapInterval)
+		defer ticker.Stop()
+		var pruned time.Time
+		for {
+			select {
+			case <-r.stop:
+				return
+			case now := <-ticker.C:
+				tm.reapExpired(now)
+				tm.sweepWorkspaces(now)
+				if now.Sub(pruned) >= pruneInterval {
+					pruneRecords(now)
+					pruned = now
+				}
+			}
+		}
+	}()
+}
+
+func (tm *TaskManagerImpl) stopReaper() {
+	tm.lock.Lock()
+	r := tm.reaper
+	tm.lock.Unlock()
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+}
+
+//reapExpired fails the open tasks, which have been waiting for a webhook longer than configured.
+//Their webhook locks and cancel functions are released. It returns ids of the expired tasks
+func (tm *TaskManagerImpl) reapExpired(now time.Time) []int {
+	expiry := time.Duration(viper.GetInt(misc.OpenTaskExpiryKey)) * time.Second
+	if expiry <= 0 {
+		return nil
+	}
+	var expired []int
+	for _, t := range tm.openTasks() {
+		if now.Sub(t.GetCreated()) < expiry {
+			continue
+		}
+		gt, ok := t.(GitHubAwareTask)
+		if !ok {
+			continue
+		}
+		id := t.GetId()
+		reason := fmt.Sprintf("task has expired, because branch %s%d has not been pushed in %s", misc.TaskPrefix, id, expiry)
+		err := gt.Expire(reason)
+		if err != nil {
+			misc.Debugf("cannot expire task %d. Error: %s", id, err)
+			continue
+		}
+		err = gt.ReleaseWebhookLocks()
+		if err != nil {
+			misc.Debugf("cannot release webhook locks of task %d. Error: %s", id, err)
+		}
+		tm.lock.Lock()
+		cancel := tm.cancel[id]
+		delete(tm.cancel, id)
+		tm.lock.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+		log.Printf("Task %d has expired after waiting for a webhook for %s", id, now.Sub(t.GetCreated()).Truncate(time.Second))
+		expired = append(expired, id)
+	}
+	return expired
+}
+
+//pruneRecords removes records of the tasks completed longer than the retention period ago and the expired idempotency keys
+func pruneRecords(now time.Time) {
+	retention := time.Duration(viper.GetInt(misc.TaskRetentionKey)) * time.Second
+	if retention <= 0 {
+		return
+	}
+	n, err := storer.GetTaskStore().Prune(now.Add(-retention))
+	if n > 0 {
+		log.Printf("%d records of the tasks completed more than %s ago have been removed", n, retention)
+	}
+	if err != nil {
+		log.Printf("Cannot remove records of the completed tasks. Error: %s", err)
+	}
+}
+
+func (tm *TaskManagerImpl) openTasks() []Task {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	var open []Task
+	for _, t := range tm.tasks {
+		if t.GetStatus() == misc.OPEN {
+			open = append(open, t)
+		}
+	}
+	return open
+}
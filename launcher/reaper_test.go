@@ -0,0 +1,62 @@
+package launcher
+
+import (
+	"context"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTaskManagerImpl_reapExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-reaper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	viper.Set(misc.RepoDirKey, dir)
+	viper.Set(misc.OpenTaskExpiryKey, 3600)
+	defer viper.Set(misc.OpenTaskExpiryKey, nil)
+
+	now := time.Now()
+	tm := &TaskManagerImpl{tasks: make(map[int]Task), cancel: make(map[int]context.CancelFunc)}
+	cancelled := map[int]bool{}
+	add := func(id int, status TaskStatus, age time.Duration) *GitTask {
+		task := newTerraformTask(&TerraformTaskDefinition{Repository: "git@github.com:wix-system/reaper.git", StateLock: "reaper", Tool: ToolTerraform})
+		task.setId(id)
+		task.status = status
+		task.created = now.Add(-age)
+		if err := task.AddWebhookLocks(); err != nil {
+			t.Fatalf("AddWebhookLocks() error = %v", err)
+		}
+		tm.tasks[id] = task
+		tm.cancel[id] = func() { cancelled[id] = true }
+		return task
+	}
+	stale := add(1, misc.OPEN, 2*time.Hour)
+	fresh := add(2, misc.OPEN, time.Minute)
+	scheduled := add(3, misc.SCHEDULED, 2*time.Hour)
+
+	if got := tm.reapExpired(now); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("reapExpired() = %v, want [1]", got)
+	}
+	if stale.GetStatus() != misc.FAILED || !stale.expired {
+		t.Errorf("stale task status = %s expired = %v, want failed and expired", GetStatusString(stale.GetStatus()), stale.expired)
+	}
+	if !cancelled[1] || tm.cancel[1] != nil {
+		t.Errorf("cancel function of the stale task has not been released")
+	}
+	if stale.ReleaseWebhookLocks() == nil {
+		t.Errorf("webhook lock of the stale task is still registered")
+	}
+	if fresh.GetStatus() != misc.OPEN || scheduled.GetStatus() != misc.SCHEDULED || cancelled[2] || cancelled[3] {
+		t.Errorf("only the stale open task has to expire")
+	}
+	if got := tm.reapExpired(now); len(got) != 0 {
+		t.Errorf("second reapExpired() = %v, want nothing", got)
+	}
+}
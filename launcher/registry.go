@@ -0,0 +1,281 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/git"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"time"
+)
+
+//taskRegistry is implemented by task managers, which are able to take restored tasks back under control
+type taskRegistry interface {
+	TaskManager
+	putTask(t Task)
+	putHash(hash string, id int)
+}
+
+//persistTask saves the current state of the task to the task store
+func persistTask(t Task) {
+	if t.GetId() == 0 {
+		//Task has not been added to the task manager yet
+		return
+	}
+	err := storer.UpdateTaskRecord(t.GetId(), t.record)
+	if err != nil {
+		misc.Debugf("cannot persist task %d. Error: %s", t.GetId(), err)
+	}
+}
+
+//GetTaskRecord returns stored record of the task. It works for completed tasks as well as for the active ones
+func GetTaskRecord(id int) (*storer.TaskRecord, error) {
+	return storer.GetTaskStore().Load(id)
+}
+
+//GetTaskStatus returns the status of the task. Completed tasks of the previous runs are looked up in the task store
+func GetTaskStatus(id int) (TaskStatus, error) {
+	if t := GetTaskManager().Get(id); t != nil {
+		return t.GetStatus(), nil
+	}
+	rec, err := GetTaskRecord(id)
+	if err != nil {
+		return misc.OPEN, err
+	}
+	return TaskStatus(rec.Status), nil
+}
+
+//adoption decides which task records the instance takes under control.
+//Records of a gone instance are taken over by the replica, which gets the adoption lock of the gone instance first
+type adoption struct {
+	locker storer.StateLocker
+	//live instances. Nil means they are unknown, so only own records are taken
+	live   map[string]bool
+	owners map[string]*storer.StateLockRecord
+}
+
+func newAdoption(locker storer.StateLocker) *adoption {
+	live, err := liveInstances(locker)
+	if err != nil {
+		log.Printf("Cannot list live instances. Tasks of other instances will not be restored. Error: %s", err)
+	}
+	return &adoption{locker: locker, live: live, owners: make(map[string]*storer.StateLockRecord)}
+}
+
+//owns returns the current record if the instance controls it now
+func (a *adoption) owns(rec *storer.TaskRecord) (*storer.TaskRecord, bool) {
+	//Records without owner have been created before the owners were introduced
+	if rec.Owner == "" || rec.Owner == instanceId {
+		return rec, true
+	}
+	if a.live == nil || !instanceGone(rec.Owner, a.live) {
+		return nil, false
+	}
+	lock, tried := a.owners[rec.Owner]
+	if !tried {
+		var err error
+		lock, err = a.locker.Acquire(adoptionLockPrefix+rec.Owner, instanceId, 0, stateLockLease())
+		if err != nil {
+			misc.Debugf("tasks of gone instance %s are adopted by another one. Error: %s", rec.Owner, err)
+		}
+		a.owners[rec.Owner] = lock
+	}
+	if lock == nil {
+		return nil, false
+	}
+	//Another replica may have adopted the record before the lock has been taken
+	var current *storer.TaskRecord
+	err := storer.UpdateTaskRecord(rec.Id, func(r *storer.TaskRecord) {
+		if r.Owner == rec.Owner {
+			r.Owner = instanceId
+		}
+		current = r
+	})
+	if err != nil || current.Owner != instanceId {
+		return nil, false
+	}
+	log.Printf("Task %d of gone instance %s has been adopted", rec.Id, rec.Owner)
+	return current, true
+}
+
+func (a *adoption) release() {
+	for owner, lock := range a.owners {
+		if lock == nil {
+			continue
+		}
+		err := a.locker.Release(lock)
+		if err != nil {
+			misc.Debugf("cannot release adoption lock of instance %s. Error: %s", owner, err)
+		}
+	}
+}
+
+//rehydrate restores the tasks which were waiting for a webhook or were queued before restart.
+//Tasks which were interrupted in the middle of the run cannot be resumed safely, so they are failed explicitly.
+//Tasks of other live instances are left to them
+func rehydrate(tm taskRegistry, locker storer.StateLocker) {
+	records, err := storer.GetTaskStore().List()
+	if err != nil {
+		log.Printf("Cannot read task store. Tasks of the previous run will not be restored. Error: %s", err)
+		return
+	}
+	resume := viper.GetBool(misc.ResumeQueuedTasksKey)
+	adopt := newAdoption(locker)
+	defer adopt.release()
+	for _, rec := range records {
+		status := TaskStatus(rec.Status)
+		if IsCompletedStatus(status) {
+			//Idempotency keys of wtf tasks are kept by the task store until they expire
+			if rec.Hash != "" && rec.Kind != storer.TaskKindWtf {
+				tm.putHash(rec.Hash, rec.Id)
+			}
+			continue
+		}
+		rec, owned := adopt.owns(rec)
+		if !owned {
+			continue
+		}
+		status = TaskStatus(rec.Status)
+		if IsCompletedStatus(status) {
+			continue
+		}
+		if status == misc.STARTED {
+			failRecord(rec, "task has been interrupted by tfChek restart")
+			continue
+		}
+		if !resume {
+			failRecord(rec, fmt.Sprintf("resuming of queued tasks is disabled by %q option", misc.ResumeQueuedTasksKey))
+			continue
+		}
+		t, cancel, err := rebuildTask(rec)
+		if err != nil {
+			failRecord(rec, fmt.Sprintf("task cannot be restored. Error: %s", err))
+			continue
+		}
+		tm.putTask(t)
+		if rec.Hash != "" && rec.Kind != storer.TaskKindWtf {
+			tm.putHash(rec.Hash, rec.Id)
+		}
+		if cancel != nil {
+			err = tm.RegisterCancel(t.GetId(), cancel)
+			if err != nil {
+				misc.Debugf("cannot register cancel function of restored task %d. Error: %s", t.GetId(), err)
+			}
+		}
+		err = resumeTask(tm, t, rec)
+		if err != nil {
+			log.Printf("Cannot resume task %d. Error: %s", t.GetId(), err)
+			t.ForceFail(fmt.Sprintf("task cannot be resumed after restart. Error: %s", err))
+			continue
+		}
+		log.Printf("Task %d has been restored in %s status", t.GetId(), GetStatusString(status))
+	}
+}
+
+func failRecord(rec *storer.TaskRecord, reason string) {
+	log.Printf("Task %d (%s) is marked as failed: %s", rec.Id, GetStatusString(TaskStatus(rec.Status)), reason)
+	err := storer.UpdateTaskRecord(rec.Id, func(r *storer.TaskRecord) {
+		r.Owner = instanceId
+		r.Status = misc.FAILED
+		r.History = append(r.History, storer.StatusTransition{Status: misc.FAILED, Time: time.Now(), Reason: reason})
+	})
+	if err != nil {
+		misc.Debugf("cannot persist task %d. Error: %s", rec.Id, err)
+	}
+}
+
+func rebuildTask(rec *storer.TaskRecord) (Task, context.CancelFunc, error) {
+	t, cancel, err := newTaskFromRecord(rec, rec.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.setId(rec.Id)
+	t.restore(rec)
+	return t, cancel, nil
+}
+
+//newTaskFromRecord creates a new task from the definition kept in the record. Neither id nor runtime state is set
+func newTaskFromRecord(rec *storer.TaskRecord, hash string) (Task, context.CancelFunc, error) {
+	if len(rec.Definition) == 0 {
+		return nil, nil, fmt.Errorf("task %d record has no definition", rec.Id)
+	}
+	switch rec.Kind {
+	case storer.TaskKindRunSh:
+		var rc RunSHLaunchConfig
+		err := json.Unmarshal(rec.Definition, &rc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse launch configuration of task %d. Error: %w", rec.Id, err)
+		}
+		cmd, err := rc.GetHashedCommand(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		t, err := newRunShTask(cmd, ctx, rc.GetTimeout())
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		return t, cancel, nil
+	case storer.TaskKindWtf:
+		var payload WtfTaskDefinition
+		err := json.Unmarshal(rec.Definition, &payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse definition of task %d. Error: %w", rec.Id, err)
+		}
+		if payload.Context == nil {
+			return nil, nil, fmt.Errorf("definition of task %d has no context", rec.Id)
+		}
+		t := newWtfTask(&payload)
+		return t, t.cancel, nil
+	case storer.TaskKindTerraform:
+		var def TerraformTaskDefinition
+		err := json.Unmarshal(rec.Definition, &def)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot parse definition of task %d. Error: %w", rec.Id, err)
+		}
+		err = def.Validate()
+		if err != nil {
+			return nil, nil, fmt.Errorf("definition of task %d is invalid. Error: %w", rec.Id, err)
+		}
+		t := newTerraformTask(&def)
+		return t, t.cancel, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown kind %q of task %d", rec.Kind, rec.Id)
+	}
+}
+
+//resumeTask puts the restored task into the state it had before restart
+func resumeTask(tm TaskManager, t Task, rec *storer.TaskRecord) error {
+	if rec.Ref != "" {
+		//Re-runs do not wait for webhooks
+		return tm.Launch(t)
+	}
+	gt, ok := t.(GitHubAwareTask)
+	if !ok {
+		return fmt.Errorf("task %d is not GitHub aware", t.GetId())
+	}
+	err := gt.AddWebhookLocks()
+	if err != nil {
+		return err
+	}
+	if rec.Status != misc.SCHEDULED {
+		//Keep waiting for the webhook
+		return nil
+	}
+	//Webhook has already arrived before restart
+	for _, origin := range rec.Origins {
+		fullName, err := git.GetFullRepoName(origin)
+		if err != nil {
+			return err
+		}
+		err = gt.UnlockWebhookRepoLock(fullName)
+		if err != nil {
+			return err
+		}
+	}
+	return tm.Launch(t)
+}
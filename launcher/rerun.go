@@ -0,0 +1,65 @@
+package launcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+)
+
+//RerunTask creates a new task from the stored definition of the completed task and puts it to the queue.
+//The new task gets a fresh id, but it runs against the branch of the original task unless another ref is given
+func RerunTask(tm TaskManager, id int, ref string) (Task, error) {
+	rec, err := GetTaskRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	if !IsCompletedStatus(TaskStatus(rec.Status)) {
+		return nil, &StateError{msg: fmt.Sprintf("Task %d cannot be re-run, because it is still active. Current state is %s", id, GetStatusString(TaskStatus(rec.Status)))}
+	}
+	//Apply of the pull request runs only on the approval of the reviewer, who is allowed to push
+	if rec.Review != nil && rec.Review.Stage == storer.StageApply {
+		return nil, &StateError{msg: fmt.Sprintf("Task %d applies PR #%d and cannot be re-run. Approve the pull request again to apply it", id, rec.Review.Number)}
+	}
+	review := rec.Review
+	if ref == "" {
+		ref = rec.Ref
+	} else if ref != rec.Ref {
+		//Another ref is not the commit of the pull request
+		review = nil
+	}
+	if ref == "" {
+		ref = fmt.Sprintf("%s%d", misc.TaskPrefix, id)
+	}
+	//The hash belongs to the original submission, so the re-run is not reachable by it
+	t, cancel, err := newTaskFromRecord(rec, "")
+	if err != nil {
+		return nil, err
+	}
+	t.restore(&storer.TaskRecord{Authors: rec.Authors, Ref: ref, RerunOf: id, Drift: rec.Drift, Review: review})
+	err = tm.Add(t)
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return nil, fmt.Errorf("cannot add re-run of task %d. Error: %w", id, err)
+	}
+	persistTask(t)
+	if cancel != nil {
+		err = tm.RegisterCancel(t.GetId(), cancel)
+		if err != nil {
+			misc.Debugf("cannot register cancel function of task %d. Error: %s", t.GetId(), err)
+		}
+	}
+	err = tm.Launch(t)
+	if err != nil {
+		//Task is kept scheduled when tfChek is shutting down, so it is resumed after restart
+		if !errors.Is(err, ErrQueueFull) && !errors.Is(err, ErrDispatcherStopped) {
+			t.ForceFail(fmt.Sprintf("re-run cannot be launched. Error: %s", err))
+		}
+		return t, fmt.Errorf("cannot launch re-run of task %d. Error: %w", id, err)
+	}
+	log.Printf("Task %d has been created as a re-run of task %d against %s", t.GetId(), id, ref)
+	return t, nil
+}
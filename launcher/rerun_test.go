@@ -0,0 +1,35 @@
+package launcher
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRerunTask_reviewApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-rerun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	review := &storer.PullRequestRef{Repository: "wix-system/production_42", Number: 7, Sha: "abc", Stage: storer.StageApply}
+	rec := &storer.TaskRecord{Id: 9400, Kind: storer.TaskKindRunSh, Status: int(misc.DONE), Review: review}
+	if err := storer.GetTaskStore().Save(rec); err != nil {
+		t.Fatal(err)
+	}
+	defer storer.GetTaskStore().Delete(rec.Id)
+	for _, ref := range []string{"", "feature"} {
+		//Re-run is refused before it gets to the task manager
+		_, err := RerunTask(nil, rec.Id, ref)
+		var se *StateError
+		if !errors.As(err, &se) {
+			t.Errorf("RerunTask(%q) error = %v, want the re-run of the apply to be refused", ref, err)
+		}
+	}
+}
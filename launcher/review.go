@@ -0,0 +1,250 @@
+package launcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/git"
+	"github.com/wix-playground/tfChek/github"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"strings"
+	"time"
+)
+
+var ErrNoPullRequestCheck = errors.New("Apply -> Push flow is not configured for the repository")
+
+//PullRequestCheck configures Apply -> Push flow of a repository. Every location is planned when a pull request is opened
+//or updated and applied when the pull request is approved
+type PullRequestCheck struct {
+	//Repository is the full name of GitHub repository
+	Repository  string   `mapstructure:"repository"`
+	Locations   []string `mapstructure:"locations"`
+	RepoSources []string `mapstructure:"repo_sources"`
+	//Timeout of the run in seconds
+	Timeout string `mapstructure:"timeout"`
+}
+
+//PullRequest is the state of the pull request received with a webhook
+type PullRequest struct {
+	//Repository is the full name of GitHub repository
+	Repository string
+	Number     int
+	//Branch is the head branch of the pull request
+	Branch string
+	//Sha is the head commit of the pull request
+	Sha    string
+	Author string
+}
+
+//GetPullRequestCheck returns the configuration of Apply -> Push flow of the repository
+func GetPullRequestCheck(repository string) (*PullRequestCheck, error) {
+	var checks []PullRequestCheck
+	err := viper.UnmarshalKey(misc.PullRequestChecksKey, &checks)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pull request checks configuration. Error: %w", err)
+	}
+	for i := range checks {
+		if strings.EqualFold(checks[i].Repository, repository) {
+			return &checks[i], nil
+		}
+	}
+	return nil, ErrNoPullRequestCheck
+}
+
+//PlanPullRequest cancels the runs of the previous commits of the pull request and plans every location of the head commit
+func PlanPullRequest(tm TaskManager, pr *PullRequest) ([]Task, error) {
+	check, err := GetPullRequestCheck(pr.Repository)
+	if err != nil {
+		return nil, err
+	}
+	CancelPullRequest(tm, pr, fmt.Sprintf("tfChek (new commit %s)", pr.Sha))
+	var tasks []Task
+	for _, location := range check.Locations {
+		t, err := addReviewTask(tm, check, location, pr, storer.StagePlan)
+		if err != nil {
+			return tasks, fmt.Errorf("cannot plan %s of PR #%d. Error: %w", location, pr.Number, err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+//ApplyPullRequest applies every location of the approved head commit. All the locations have to be planned successfully first
+func ApplyPullRequest(tm TaskManager, pr *PullRequest) ([]Task, error) {
+	check, err := GetPullRequestCheck(pr.Repository)
+	if err != nil {
+		return nil, err
+	}
+	records, err := reviewRecords(pr.Repository, pr.Number)
+	if err != nil {
+		return nil, err
+	}
+	plans := latestByLocation(records, pr.Sha, storer.StagePlan)
+	applies := latestByLocation(records, pr.Sha, storer.StageApply)
+	var pending []string
+	for _, location := range check.Locations {
+		plan := plans[locationStateLock(location)]
+		if plan == nil || TaskStatus(plan.Status) != misc.DONE {
+			pending = append(pending, location)
+		}
+	}
+	if len(pending) > 0 {
+		return nil, &StateError{msg: fmt.Sprintf("commit %s of PR #%d has no successful plan of %s", pr.Sha, pr.Number, strings.Join(pending, ", "))}
+	}
+	var tasks []Task
+	for _, location := range check.Locations {
+		if a := applies[locationStateLock(location)]; a != nil && !isUnsuccessfulStatus(TaskStatus(a.Status)) {
+			log.Printf("Commit %s of PR #%d is applied to %s by task %d already", pr.Sha, pr.Number, location, a.Id)
+			continue
+		}
+		t, err := addReviewTask(tm, check, location, pr, storer.StageApply)
+		if err != nil {
+			return tasks, fmt.Errorf("cannot apply %s of PR #%d. Error: %w", location, pr.Number, err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+//CanApprovePullRequest checks that the reviewer is allowed to push to the repository of the pull request.
+//Approvals of the others must not apply anything
+func CanApprovePullRequest(pr *PullRequest, reviewer string) (bool, error) {
+	parts := strings.SplitN(pr.Repository, "/", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("repository %q is not a full name", pr.Repository)
+	}
+	return github.NewClientRunSH(parts[1], parts[0], viper.GetString(misc.TokenKey)).CanWrite(reviewer)
+}
+
+//CancelPullRequest cancels active tasks of the pull request, which run against commits other than the head one.
+//All of them are cancelled if the head commit is not set. Running applies are left to finish
+func CancelPullRequest(tm TaskManager, pr *PullRequest, by string) {
+	records, err := reviewRecords(pr.Repository, pr.Number)
+	if err != nil {
+		misc.Debugf("cannot find tasks of PR #%d. Error: %s", pr.Number, err)
+		return
+	}
+	for _, rec := range records {
+		if rec.Review.Sha == pr.Sha || IsCompletedStatus(TaskStatus(rec.Status)) {
+			continue
+		}
+		if !cancellableReview(rec) {
+			log.Printf("Task %d is applying commit %s of PR #%d. It is not cancelled, because interrupted apply may leave the state partly applied", rec.Id, rec.Review.Sha, pr.Number)
+			continue
+		}
+		err := tm.Cancel(rec.Id, by)
+		if err != nil {
+			misc.Debugf("cannot cancel task %d of PR #%d. Error: %s", rec.Id, pr.Number, err)
+		}
+	}
+}
+
+//cancellableReview tells if the active task of the pull request may be cancelled. Only the applies, which have not been started yet, and the plans may
+func cancellableReview(rec *storer.TaskRecord) bool {
+	return rec.Review.Stage != storer.StageApply || TaskStatus(rec.Status) != misc.STARTED
+}
+
+func addReviewTask(tm TaskManager, check *PullRequestCheck, location string, pr *PullRequest, stage string) (Task, error) {
+	yn := "n"
+	if stage == storer.StageApply {
+		yn = "y"
+	}
+	location = strings.TrimSpace(location)
+	rc := &RunSHLaunchConfig{RepoSources: check.RepoSources, FullCommand: fmt.Sprintf("./%s -%s %s", misc.RunshExe, yn, location),
+		CommandOptions: &RunSHOptions{YN: yn, Location: location, Timeout: check.Timeout}, Instant: time.Now().Unix()}
+	//The branch is fetched by name, but the task runs the commit of the review. A commit pushed meanwhile gets its own plan and cancels this one
+	t, err := addRunShRefTask(tm, rc, pr.Branch, func(t *GitTask, cmd *RunShCmd) {
+		t.review = &storer.PullRequestRef{Repository: pr.Repository, Number: pr.Number, Sha: pr.Sha, Stage: stage}
+		if pr.Author != "" {
+			t.authors = []string{pr.Author}
+		}
+	})
+	if err != nil {
+		if t == nil {
+			return nil, err
+		}
+		return t, err
+	}
+	log.Printf("Task %d has been created to %s %s of PR #%d at %s", t.GetId(), stage, location, pr.Number, pr.Sha)
+	return t, nil
+}
+
+//reviewRecords returns records of all the tasks of the pull request
+func reviewRecords(repository string, number int) ([]*storer.TaskRecord, error) {
+	all, err := storer.GetTaskStore().List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list tasks. Error: %w", err)
+	}
+	var records []*storer.TaskRecord
+	for _, rec := range all {
+		if rec.Review != nil && rec.Review.Number == number && strings.EqualFold(rec.Review.Repository, repository) {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+//latestByLocation maps state locks to the latest task of the stage run against the commit
+func latestByLocation(records []*storer.TaskRecord, sha, stage string) map[string]*storer.TaskRecord {
+	latest := make(map[string]*storer.TaskRecord)
+	for _, rec := range records {
+		if rec.Review.Sha != sha || rec.Review.Stage != stage {
+			continue
+		}
+		if l, ok := latest[rec.StateLock]; !ok || rec.Id > l.Id {
+			latest[rec.StateLock] = rec
+		}
+	}
+	return latest
+}
+
+//locationStateLock is the state lock run.sh task of the location gets
+func locationStateLock(location string) string {
+	location = strings.TrimSpace(location)
+	if !strings.Contains(location, "/") {
+		return location + "/"
+	}
+	return location
+}
+
+func isUnsuccessfulStatus(status TaskStatus) bool {
+	return status == misc.FAILED || status == misc.TIMEOUT || status == misc.CANCELLED
+}
+
+//reviewApplied checks that all the locations of the pull request are applied at the commit of the task
+func (t *GitTask) reviewApplied() bool {
+	check, err := GetPullRequestCheck(t.review.Repository)
+	if err != nil {
+		misc.Debugf("cannot get configuration of PR #%d. Error: %s", t.review.Number, err)
+		return false
+	}
+	records, err := reviewRecords(t.review.Repository, t.review.Number)
+	if err != nil {
+		misc.Debugf("cannot get tasks of PR #%d. Error: %s", t.review.Number, err)
+		return false
+	}
+	applies := latestByLocation(records, t.review.Sha, storer.StageApply)
+	for _, location := range check.Locations {
+		a := applies[locationStateLock(location)]
+		if a == nil || TaskStatus(a.Status) != misc.DONE {
+			return false
+		}
+	}
+	return true
+}
+
+//reportReview comments the pull request. It is merged when the last location has been applied
+func (t *GitTask) reportReview(successful bool) error {
+	merge := successful && t.review.Stage == storer.StageApply && t.reviewApplied()
+	result := github.NewReviewTaskResult(t.id, t.getBranch(), t.review, successful, merge, t.getReportOutput(), t.GetAuthors())
+	for _, origin := range t.executor.Origins() {
+		fullName, err := git.GetFullRepoName(origin)
+		if err == nil && strings.EqualFold(fullName, t.review.Repository) {
+			t.report(origin, result)
+			return nil
+		}
+	}
+	return t.reportMain(result)
+}
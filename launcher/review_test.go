@@ -0,0 +1,72 @@
+package launcher
+
+import (
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"testing"
+)
+
+func Test_latestByLocation(t *testing.T) {
+	review := func(sha, stage string) *storer.PullRequestRef {
+		return &storer.PullRequestRef{Repository: "wix-system/production_42", Number: 7, Sha: sha, Stage: stage}
+	}
+	records := []*storer.TaskRecord{
+		{Id: 10, StateLock: "prod/core", Review: review("abc", storer.StagePlan)},
+		{Id: 12, StateLock: "prod/core", Review: review("abc", storer.StagePlan)},
+		{Id: 11, StateLock: "prod/core", Review: review("abc", storer.StagePlan)},
+		{Id: 13, StateLock: "prod/core", Review: review("def", storer.StagePlan)},
+		{Id: 14, StateLock: "prod/core", Review: review("abc", storer.StageApply)},
+		{Id: 9, StateLock: "dev/", Review: review("abc", storer.StagePlan)},
+	}
+	got := latestByLocation(records, "abc", storer.StagePlan)
+	want := map[string]int{"prod/core": 12, "dev/": 9}
+	if len(got) != len(want) {
+		t.Fatalf("latestByLocation() returned %d locations, want %d", len(got), len(want))
+	}
+	for lock, id := range want {
+		if got[lock] == nil || got[lock].Id != id {
+			t.Errorf("latestByLocation()[%s] = %v, want task %d", lock, got[lock], id)
+		}
+	}
+}
+
+func Test_locationStateLock(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{"prod/core", "prod/core"},
+		{" prod/core ", "prod/core"},
+		{"dev", "dev/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			if got := locationStateLock(tt.location); got != tt.want {
+				t.Errorf("locationStateLock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cancellableReview(t *testing.T) {
+	tests := []struct {
+		name   string
+		stage  string
+		status TaskStatus
+		want   bool
+	}{
+		{"Open plan", storer.StagePlan, misc.OPEN, true},
+		{"Running plan", storer.StagePlan, misc.STARTED, true},
+		{"Open apply", storer.StageApply, misc.OPEN, true},
+		{"Scheduled apply", storer.StageApply, misc.SCHEDULED, true},
+		{"Running apply", storer.StageApply, misc.STARTED, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &storer.TaskRecord{Id: 1, Status: int(tt.status), Review: &storer.PullRequestRef{Sha: "abc", Stage: tt.stage}}
+			if got := cancellableReview(rec); got != tt.want {
+				t.Errorf("cancellableReview() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
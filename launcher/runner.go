@@ -21,6 +21,7 @@ type RunShCmd struct {
 	hash             string
 	GitOrigins       []string
 	Started          *time.Time
+	config           *RunSHLaunchConfig
 }
 
 func (rsc *RunShCmd) CommandArgs() (string, []string, error) {
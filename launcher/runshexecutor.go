@@ -0,0 +1,216 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+//runShExecutor launches run.sh of production_42 layout
+type runShExecutor struct {
+	command   string
+	args      []string
+	extraEnv  map[string]string
+	stateLock string
+	origins   []string
+	config    *RunSHLaunchConfig
+}
+
+func newRunShExecutor(rcs *RunShCmd, extraEnv map[string]string) (*runShExecutor, error) {
+	command, args, err := rcs.CommandArgs()
+	if err != nil {
+		return nil, err
+	}
+	return &runShExecutor{command: command, args: args, extraEnv: extraEnv,
+		stateLock: fmt.Sprintf("%s/%s", rcs.Env, rcs.Layer),
+		//Perhaps it is better ot transfer Git Origins via the context
+		origins: rcs.GitOrigins,
+		config:  rcs.config,
+	}, nil
+}
+
+//newRunShTask creates a task running run.sh. Extra environment variables are taken from the context
+func newRunShTask(rcs *RunShCmd, ctx context.Context, timeout time.Duration) (*GitTask, error) {
+	var extraEnv map[string]string
+	if ee, ok := ctx.Value(misc.EnvVarsKey).(*map[string]string); ok && ee != nil {
+		extraEnv = *ee
+	}
+	e, err := newRunShExecutor(rcs, extraEnv)
+	if err != nil {
+		return nil, err
+	}
+	//Timeout is counted from the start of the run, the task may wait in the queue for long
+	t := newGitTask(ctx, timeout, e)
+	t.hash = rcs.hash
+	return t, nil
+}
+
+//addRunShRefTask queues run.sh task against the ref, which is on GitHub already, so the task does not wait for a webhook.
+//init sets up the task before it is added to the task manager
+func addRunShRefTask(tm TaskManager, rc *RunSHLaunchConfig, ref string, init func(t *GitTask, cmd *RunShCmd)) (*GitTask, error) {
+	cmd, err := rc.GetCommand()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create command. Error: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t, err := newRunShTask(cmd, ctx, rc.GetTimeout())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t.ref = ref
+	if init != nil {
+		init(t, cmd)
+	}
+	err = tm.Add(t)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("cannot add task. Error: %w", err)
+	}
+	persistTask(t)
+	err = tm.RegisterCancel(t.GetId(), cancel)
+	if err != nil {
+		misc.Debugf("cannot register cancel function of task %d. Error: %s", t.GetId(), err)
+	}
+	err = tm.Launch(t)
+	if err != nil {
+		//Task is kept scheduled when tfChek is shutting down, so it is resumed after restart
+		if !errors.Is(err, ErrQueueFull) && !errors.Is(err, ErrDispatcherStopped) {
+			t.ForceFail(fmt.Sprintf("task cannot be launched. Error: %s", err))
+		}
+		return t, fmt.Errorf("cannot launch task %d. Error: %w", t.GetId(), err)
+	}
+	return t, nil
+}
+
+func (e *runShExecutor) Kind() string {
+	return storer.TaskKindRunSh
+}
+
+func (e *runShExecutor) Command() string {
+	return strings.Join(append([]string{e.command}, e.args...), " ")
+}
+
+func (e *runShExecutor) StateLock() string {
+	return e.stateLock
+}
+
+func (e *runShExecutor) Origins() []string {
+	return e.origins
+}
+
+func (e *runShExecutor) Definition() []byte {
+	if e.config == nil {
+		return nil
+	}
+	definition, err := json.Marshal(e.config)
+	if err != nil {
+		misc.Debugf("cannot serialize launch configuration. Error: %s", err)
+		return nil
+	}
+	return definition
+}
+
+func (e *runShExecutor) Labels() map[string]string {
+	if e.config == nil {
+		return nil
+	}
+	return e.config.Labels
+}
+
+func (e *runShExecutor) GitApiVersion() int {
+	return 1
+}
+
+//MainRepository returns the repository, which contains executable script run.sh
+func (e *runShExecutor) MainRepository(ws *Workspace) (string, error) {
+	if len(ws.Repositories) == 0 {
+		misc.Debugf("No git repositories were checked out for task %d", ws.TaskId)
+		return "", fmt.Errorf("No git repositories were checked out for task %d", ws.TaskId)
+	}
+	for _, exe := range []string{misc.RunshExe, misc.WtfExe} {
+		for _, r := range ws.Repositories {
+			exePath := path.Join(r.Path, exe)
+			info, err := os.Stat(exePath)
+			if os.IsNotExist(err) {
+				misc.Debugf("repository %s does not contain %s executable. Trying next one...", r.Path, exe)
+				continue
+			}
+			if err != nil {
+				misc.Debugf("cannot check %s. Error: %s. Trying next one...", exePath, err)
+				continue
+			}
+			if info.IsDir() {
+				misc.Debugf("%s cannot be directory, it should be an executable file. Trying next one...", exePath)
+				continue
+			}
+			if info.Mode()&0111 == 0 {
+				misc.Debugf("file %s should be executable. Trying next one...", exePath)
+				continue
+			}
+			misc.Debugf("found %s executable in %s repository. Using it...", exePath, r.Remote)
+			return r.Remote, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find repository with %s executable", misc.RunshExe)
+}
+
+func (e *runShExecutor) Execute(ctx context.Context, ws *Workspace) error {
+	remote, err := e.MainRepository(ws)
+	if err != nil {
+		return err
+	}
+	cwd := ws.GetPath(remote)
+	//Copy certificates to the landscape directory of the git repository which contains run.sh. Usually it is the very first one
+	//TODO: Remove it after WTF integration
+	err = deliverCerts(cwd)
+	if err != nil {
+		log.Printf("Warning! Task id %d can fail, because certificates delivery failed. Error: %s", ws.TaskId, err)
+	}
+	//TODO: Remove it after WTF integration
+	err = deliverLambdas(cwd)
+	if err != nil {
+		log.Printf("Warning! Task id %d can fail, because lambdas delivery failed. Error: %s", ws.TaskId, err)
+	}
+	log.Printf("Task id: %d working directory: %s", ws.TaskId, cwd)
+	env, err := taskEnvironment(e.stateLock, e.extraEnv)
+	if err != nil {
+		return fmt.Errorf("cannot set up environment of task %d. Error: %w", ws.TaskId, err)
+	}
+	//Inject RUNSH_PATH (important!)
+	env[misc.RunShPathEnvVar] = strings.Join(ws.GetPaths(), ":")
+	//Disable tfChek notification to avoid recursion
+	env[misc.NotifyTfChekEnvVar] = "false"
+	sysenv := envList(withFencingToken(ws, env))
+	logTaskEnv(ws.TaskId, &sysenv)
+
+	command := exec.Command(e.command, e.args...)
+	command.Dir = cwd
+	command.Env = sysenv
+	ws.Output.StartStep(misc.RunshExe)
+	return runOnBackend(ctx, ws, command)
+}
+
+func logTaskEnv(tid int, env *[]string) {
+	if viper.GetBool(misc.DebugKey) {
+		var builder strings.Builder
+		builder.Grow(50)
+		fmt.Fprintf(&builder, "Task id: %d enjvironment:\n", tid)
+		for i, s := range *env {
+			kv := strings.SplitN(s, "=", 2)
+			ms := misc.MaskEnvValue(kv[0], kv[1])
+			fmt.Fprintf(&builder, "\t#%d\t%s = %s\n", i, kv[0], ms)
+		}
+		misc.Debug(builder.String())
+	}
+}
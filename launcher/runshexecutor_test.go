@@ -0,0 +1,82 @@
+package launcher
+
+import (
+	"encoding/json"
+	"github.com/wix-playground/tfChek/storer"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_runShExecutorMainRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mkRepo := func(name, exe string, mode os.FileMode) Repository {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if exe != "" {
+			if err := ioutil.WriteFile(path.Join(p, exe), []byte("#!/bin/sh\n"), mode); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return Repository{Remote: "git@github.com:org/" + name + ".git", Path: p}
+	}
+	plain := mkRepo("plain", "", 0)
+	runsh := mkRepo("runsh", "run.sh", 0755)
+	notExecutable := mkRepo("noexec", "run.sh", 0644)
+	wtf := mkRepo("wtf", "wtf", 0755)
+	tests := []struct {
+		name    string
+		repos   []Repository
+		want    string
+		wantErr bool
+	}{
+		{"run.sh repository", []Repository{plain, runsh}, runsh.Remote, false},
+		{"run.sh is preferred to wtf", []Repository{wtf, runsh}, runsh.Remote, false},
+		{"wtf repository", []Repository{notExecutable, wtf}, wtf.Remote, false},
+		{"No executable", []Repository{plain, notExecutable}, "", true},
+		{"No repositories", nil, "", true},
+	}
+	e := &runShExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.MainRepository(&Workspace{TaskId: 1, Repositories: tt.repos})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("MainRepository() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("MainRepository() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newTaskFromRecord_runShTimeout(t *testing.T) {
+	rc := &RunSHLaunchConfig{RepoSources: []string{"git@github.com:wix-system/production_42.git"}, FullCommand: "./run.sh -n dev/core",
+		CommandOptions: &RunSHOptions{YN: "n", Location: "dev/core", Timeout: "60"}, Instant: 1600000000}
+	definition, err := json.Marshal(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, cancel, err := newTaskFromRecord(&storer.TaskRecord{Id: 9500, Kind: storer.TaskKindRunSh, Definition: definition}, "")
+	if err != nil {
+		t.Fatalf("newTaskFromRecord() error = %v", err)
+	}
+	defer cancel()
+	gt := task.(*GitTask)
+	//Restored task may wait in the queue, so the clock starts when it runs
+	if deadline, ok := gt.ctx.Deadline(); ok {
+		t.Errorf("restored task has deadline %s before the run", deadline)
+	}
+	if gt.timeout != time.Minute {
+		t.Errorf("timeout = %s, want %s", gt.timeout, time.Minute)
+	}
+}
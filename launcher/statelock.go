@@ -0,0 +1,239 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrInternalStateLock = errors.New("internal lock of tfChek cannot be broken")
+
+//stateLockRetryInterval is the period of the attempts to take the state lock held by another task
+var stateLockRetryInterval = 5 * time.Second
+
+//instanceId tells the state locks of this process from the ones of other replicas
+var instanceId = newInstanceId()
+
+//Internal locks are kept next to the state locks. The prefix cannot be a part of env/layer
+const (
+	internalLockPrefix = misc.APPNAME + ":"
+	instanceLockPrefix = internalLockPrefix + "instance/"
+	adoptionLockPrefix = internalLockPrefix + "adopt/"
+	driftLockPrefix    = internalLockPrefix + "drift/"
+)
+
+func newInstanceId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+//startInstanceLease announces the instance to the other replicas. They do not take over task records of the instance while its lease is renewed
+func startInstanceLease(locker storer.StateLocker) (*stateLease, error) {
+	lease := stateLockLease()
+	lock, err := locker.Acquire(instanceLockPrefix+instanceId, instanceId, 0, lease)
+	if err != nil {
+		return nil, fmt.Errorf("cannot acquire instance lease. Error: %w", err)
+	}
+	l := newStateLease(lock, locker)
+	go l.renew(lease, func(err error) {
+		log.Printf("Instance lease %s has been lost. Other replicas may take over the tasks of the instance after restart. Error: %s", lock.Name, err)
+	})
+	return l, nil
+}
+
+//liveInstances returns the instances, which renew their leases
+func liveInstances(locker storer.StateLocker) (map[string]bool, error) {
+	locks, err := locker.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	live := make(map[string]bool)
+	for _, l := range locks {
+		if strings.HasPrefix(l.Name, instanceLockPrefix) && !l.IsStale(now) {
+			live[l.Owner] = true
+		}
+	}
+	return live, nil
+}
+
+//splitInstanceId returns the host and the process id of the instance
+func splitInstanceId(id string) (string, int) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 {
+		return id, 0
+	}
+	pid, err := strconv.Atoi(id[i+1:])
+	if err != nil {
+		return id, 0
+	}
+	return id[:i], pid
+}
+
+//instanceGone tells if the owner of the task records does not run anymore.
+//Previous run on the same host is checked by its process, because its lease may be not expired yet after a crash
+func instanceGone(owner string, live map[string]bool) bool {
+	host, pid := splitInstanceId(owner)
+	if myHost, _ := splitInstanceId(instanceId); host == myHost && pid > 0 {
+		return syscall.Kill(pid, 0) == syscall.ESRCH
+	}
+	return !live[owner]
+}
+
+func stateLockLease() time.Duration {
+	return time.Duration(viper.GetInt(misc.StateLockLeaseKey)) * time.Second
+}
+
+//stateLease is the state lock held by the running task. It is renewed until released
+type stateLease struct {
+	lock   *storer.StateLockRecord
+	locker storer.StateLocker
+	stop   chan struct{}
+	done   chan struct{}
+	//mu serializes the renewals of the lock
+	mu sync.Mutex
+}
+
+func newStateLease(lock *storer.StateLockRecord, locker storer.StateLocker) *stateLease {
+	return &stateLease{lock: lock, locker: locker, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+//acquireStateLock waits for the state lock shared by tfChek replicas until the context is done.
+//lost is called if the lock cannot be renewed, because the task must not go on without it then
+func acquireStateLock(ctx context.Context, name string, ws *Workspace, lost func()) (*stateLease, error) {
+	locker := storer.GetStateLocker()
+	lease := stateLockLease()
+	reported := false
+	for {
+		lock, err := locker.Acquire(name, instanceId, ws.TaskId, lease)
+		if err == nil {
+			misc.Debugf("task %d has acquired state lock %s with token %d", ws.TaskId, name, lock.Token)
+			l := newStateLease(lock, locker)
+			go l.renew(lease, func(err error) {
+				msg := fmt.Sprintf("state lock %s has been lost, the run is interrupted. Error: %s", name, err)
+				log.Printf("Task %d: %s", ws.TaskId, msg)
+				_, werr := fmt.Fprintf(ws.Output.GetStdErr(), "\n%s: %s\n", misc.APPNAME, msg)
+				if werr != nil {
+					misc.Debugf("cannot report state lock loss of task %d. Error: %s", ws.TaskId, werr)
+				}
+				lost()
+			})
+			return l, nil
+		}
+		if !errors.Is(err, storer.ErrStateLocked) {
+			return nil, fmt.Errorf("cannot acquire state lock %s. Error: %w", name, err)
+		}
+		if !reported {
+			reported = true
+			_, werr := fmt.Fprintf(ws.Output.GetStdOut(), "%s: waiting for the state lock. %s\n", misc.APPNAME, err)
+			if werr != nil {
+				misc.Debugf("cannot report state lock wait of task %d. Error: %s", ws.TaskId, werr)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("task %d has not got state lock %s. Reason: %w", ws.TaskId, name, ctx.Err())
+		case <-time.After(stateLockRetryInterval):
+		}
+	}
+}
+
+//renew extends the lease until the lease is released. lost is called once the lock cannot be held anymore
+func (l *stateLease) renew(lease time.Duration, lost func(err error)) {
+	defer close(l.done)
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		err := l.locker.Renew(l.lock, lease)
+		expired := !time.Now().Before(l.lock.Expires)
+		l.mu.Unlock()
+		if err == nil {
+			continue
+		}
+		//Another replica may take the lock once the lease is over, even if it has not been renewed because of a transient error
+		if errors.Is(err, storer.ErrStateLockLost) || expired {
+			lost(err)
+			return
+		}
+		misc.Debugf("cannot renew state lock %s. Error: %s", l.lock.Name, err)
+	}
+}
+
+//verify makes sure the lock is still held with the token of the lease
+func (l *stateLease) verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.locker.Renew(l.lock, stateLockLease())
+}
+
+//release stops the renewal and frees the lock
+func (l *stateLease) release() {
+	close(l.stop)
+	<-l.done
+	err := l.locker.Release(l.lock)
+	if err != nil {
+		log.Printf("Cannot release state lock %s of task %d. Error: %s", l.lock.Name, l.lock.TaskId, err)
+	}
+}
+
+//withFencingToken adds the token of the workspace state lock to the variables.
+//tfChek checks the token itself only before reporting the result to GitHub and uploading the output to S3.
+//Writes done by the task processes are not fenced unless the tools compare the token with the last one they have seen
+func withFencingToken(ws *Workspace, env map[string]string) map[string]string {
+	if ws.Lock != nil {
+		env[misc.FencingTokenEnvVar] = strconv.FormatInt(ws.Lock.Token, 10)
+	}
+	return env
+}
+
+//GetStateLocks returns the state locks held by the tasks of all the replicas. Internal leases of the instances are not included
+func GetStateLocks() ([]*storer.StateLockRecord, error) {
+	locks, err := storer.GetStateLocker().List()
+	if err != nil {
+		return nil, err
+	}
+	var stateLocks []*storer.StateLockRecord
+	for _, l := range locks {
+		if !strings.HasPrefix(l.Name, internalLockPrefix) {
+			stateLocks = append(stateLocks, l)
+		}
+	}
+	return stateLocks, nil
+}
+
+//BreakStateLock frees the state lock held by a stale task. Forced break frees the lock of a live task as well.
+//The holder loses the lock on its next renewal. Internal leases are not state locks, breaking them would let the replicas run the same tasks
+func BreakStateLock(name, by string, force bool) error {
+	if strings.HasPrefix(name, internalLockPrefix) {
+		return fmt.Errorf("%s %w", name, ErrInternalStateLock)
+	}
+	err := storer.GetStateLocker().Break(name, force)
+	if err != nil {
+		return err
+	}
+	if force {
+		log.Printf("State lock %s has been broken by %s by force", name, by)
+	} else {
+		log.Printf("State lock %s has been broken by %s", name, by)
+	}
+	return nil
+}
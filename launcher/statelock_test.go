@@ -0,0 +1,172 @@
+package launcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireStateLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-statelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.OutDirKey, dir)
+	defer viper.Set(misc.OutDirKey, nil)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	viper.Set(misc.StateLockLeaseKey, 1)
+	defer viper.Set(misc.StateLockLeaseKey, nil)
+	defer func(interval time.Duration) { stateLockRetryInterval = interval }(stateLockRetryInterval)
+	stateLockRetryInterval = 20 * time.Millisecond
+	locker := storer.NewFileStateLocker(filepath.Join(dir, "locks"))
+	//Lock of another replica
+	other, err := locker.Acquire("production/dns", "replica-2", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newWorkspace := func(id int) *Workspace {
+		sink, err := storer.NewTaskFileSink(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &Workspace{TaskId: id, Output: sink}
+	}
+
+	ws := newWorkspace(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = acquireStateLock(ctx, "production/dns", ws, func() {})
+	if err == nil {
+		t.Fatalf("acquireStateLock() of the held lock error = nil")
+	}
+	ws.Output.Close()
+	out, err := storer.ReadTask(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "waiting for the state lock") {
+		t.Errorf("output %q does not report the wait", out)
+	}
+
+	ws = newWorkspace(3)
+	defer ws.Output.Close()
+	time.AfterFunc(50*time.Millisecond, func() { locker.Release(other) })
+	lost := make(chan struct{})
+	lease, err := acquireStateLock(context.Background(), "production/dns", ws, func() { close(lost) })
+	if err != nil {
+		t.Fatalf("acquireStateLock() error = %v", err)
+	}
+	if lease.lock.Token != other.Token+1 || lease.lock.Owner != instanceId {
+		t.Errorf("acquireStateLock() lock = %+v", lease.lock)
+	}
+	//Lease of one second is renewed every third of it
+	time.Sleep(1500 * time.Millisecond)
+	select {
+	case <-lost:
+		t.Fatalf("renewed lock has been lost")
+	default:
+	}
+	err = locker.Break("production/dns", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(2 * time.Second):
+		t.Errorf("broken lock has not been reported as lost")
+	}
+	lease.release()
+	locks, err := locker.List()
+	if err != nil || len(locks) != 0 {
+		t.Errorf("List() = %v, %v after release", locks, err)
+	}
+}
+
+func TestAdoption_owns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-adoption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	locker := storer.NewFileStateLocker(filepath.Join(dir, "locks"))
+	if _, err := locker.Acquire(instanceLockPrefix+"replica-2", "replica-2", 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	//Tasks of replica-4 are being adopted by another replica
+	if _, err := locker.Acquire(adoptionLockPrefix+"replica-4", "replica-5", 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		owner string
+		want  bool
+	}{
+		{"Own task", instanceId, true},
+		{"Task of previous version", "", true},
+		{"Task of live replica", "replica-2", false},
+		{"Task of gone replica", "replica-3", true},
+		{"Another task of gone replica", "replica-3", true},
+		{"Task adopted by another replica", "replica-4", false},
+	}
+	a := newAdoption(locker)
+	defer a.release()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := 9000 + i
+			rec := &storer.TaskRecord{Id: id, Status: int(misc.SCHEDULED), Owner: tt.owner}
+			if err := storer.GetTaskStore().Save(rec); err != nil {
+				t.Fatal(err)
+			}
+			got, owned := a.owns(rec)
+			if owned != tt.want {
+				t.Fatalf("owns() = %v, want %v", owned, tt.want)
+			}
+			if owned && tt.owner != "" && got.Owner != instanceId {
+				t.Errorf("owns() owner = %q, want %q", got.Owner, instanceId)
+			}
+		})
+	}
+}
+
+func TestInstanceGone(t *testing.T) {
+	host, _ := splitInstanceId(instanceId)
+	live := map[string]bool{"remote-1": true}
+	tests := []struct {
+		name  string
+		owner string
+		want  bool
+	}{
+		{"This instance", instanceId, false},
+		{"Dead process on the same host", fmt.Sprintf("%s-%d", host, 1<<30), true},
+		{"Live remote instance", "remote-1", false},
+		{"Remote instance without lease", "remote-2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := instanceGone(tt.owner, live); got != tt.want {
+				t.Errorf("instanceGone(%q) = %v, want %v", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakStateLock_internal(t *testing.T) {
+	for _, name := range []string{instanceLockPrefix + instanceId, adoptionLockPrefix + "42", driftLockPrefix + "production/eu@0 * * * *"} {
+		if err := BreakStateLock(name, "tester", true); !errors.Is(err, ErrInternalStateLock) {
+			t.Errorf("BreakStateLock(%q) error = %v, want %v", name, err, ErrInternalStateLock)
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
 	"io"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -34,11 +36,21 @@ type Task interface {
 	SetStatus(status TaskStatus)
 	SyncName() string
 	Schedule() error
+	//launch schedules the open task. It returns the status the task has had
+	launch() (TaskStatus, bool)
 	Start() error
 	Done() error
 	Fail() error
-	ForceFail()
+	ForceFail(reason string)
 	TimeoutFail() error
+	//Cancel records who cancelled the task. Task, which is not running yet, becomes cancelled right away
+	Cancel(by string) error
+	GetHistory() []storer.StatusTransition
+	GetCreated() time.Time
+	//record fills the fields of the stored record owned by the task
+	record(rec *storer.TaskRecord)
+	//restore takes back the runtime fields of the task from the stored record
+	restore(rec *storer.TaskRecord)
 }
 
 type GitHubAwareTask interface {
@@ -48,6 +60,10 @@ type GitHubAwareTask interface {
 	GetAuthors() *[]string
 	AddWebhookLocks() error
 	UnlockWebhookRepoLock(fullName string) error
+	//ReleaseWebhookLocks drops the webhook locks of the task, which is not going to be run
+	ReleaseWebhookLocks() error
+	//Expire fails the open task, which has not received its webhook
+	Expire(reason string) error
 }
 
 type RunSHOptions struct {
@@ -69,6 +85,24 @@ type RunSHLaunchConfig struct {
 	FullCommand    string
 	CommandOptions *RunSHOptions
 	Instant        int64
+	//Labels are stored with the task and shown in its pull request or issue
+	Labels map[string]string
+}
+
+//labelKeyPattern keeps label keys usable in query parameters
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+//validateLabels checks the labels given by a client. Values have to fit a single line, because they are rendered to GitHub
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("label %q has to start with a letter or a digit and contain only letters, digits and '.', '_', '/', '-'", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("value of label %q has to be a single line", k)
+		}
+	}
+	return nil
 }
 
 func (rc *RunSHLaunchConfig) GetHashedCommand(hash string) (*RunShCmd, error) {
@@ -91,6 +125,10 @@ func (rc *RunSHLaunchConfig) GetCommand() (*RunShCmd, error) {
 	if len(el) > 2 {
 		return nil, errors.New(fmt.Sprintf("Cannot parse environment and layer '%s'. Too many slashes", location))
 	}
+	err := validateLabels(rc.Labels)
+	if err != nil {
+		return nil, err
+	}
 	layer := ""
 	if len(el) == 2 {
 		layer = el[1]
@@ -122,7 +160,7 @@ func (rc *RunSHLaunchConfig) GetCommand() (*RunShCmd, error) {
 	startTime := time.Unix(rc.Instant, 0)
 	cmd = RunShCmd{Layer: layer, Env: env, All: all, Omit: omit,
 		UsePlan: usePlan, Filter: filter, Region: region, TerraformVersion: terraform,
-		Targets: tgts, No: no, Yes: yes, Debug: debug, GitOrigins: *gorigins, Started: &startTime}
+		Targets: tgts, No: no, Yes: yes, Debug: debug, GitOrigins: *gorigins, Started: &startTime, config: rc}
 	return &cmd, nil
 }
 
@@ -158,7 +196,21 @@ func GetStatusString(status TaskStatus) string {
 		return "timeout"
 	case misc.DONE:
 		return "done"
+	case misc.CANCELLED:
+		return "cancelled"
 	default:
 		return "unknown"
 	}
 }
+
+func IsCompleted(t Task) bool {
+	return IsCompletedStatus(t.GetStatus())
+}
+
+func IsCompletedStatus(status TaskStatus) bool {
+	if status == misc.DONE || status == misc.FAILED || status == misc.TIMEOUT || status == misc.CANCELLED {
+		return true
+	} else {
+		return false
+	}
+}
@@ -4,100 +4,191 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/misc"
 	"github.com/wix-playground/tfChek/storer"
-	"io/ioutil"
 	"log"
-	"os"
-	"path"
-	"strconv"
 	"sync"
 	"time"
 )
 
 var tm TaskManager
-var tml, al sync.Mutex
+var tml sync.Mutex
 
 type TaskManager interface {
 	Close() error
+	//Shutdown stops accepting new tasks and waits for the running ones. Tasks still running when the context is done get cancelled
+	Shutdown(ctx context.Context) error
 	Start() error
 	IsStarted() bool
 	//Create task
-	AddRunSh(rcs *RunShCmd, ctx context.Context) (Task, error)
+	AddRunSh(rcs *RunShCmd, ctx context.Context, timeout time.Duration) (Task, error)
 	Launch(bt Task) error
 	LaunchById(id int) error
 	RegisterCancel(id int, cancel context.CancelFunc) error
 	Get(id int) Task
 	GetId(hash string) (int, error)
 	Add(t Task) error
-	Cancel(id int) error
+	//Cancel removes the task from its queue or interrupts its run. by is the user, who cancelled the task
+	Cancel(id int, by string) error
 }
 
+type WtfTaskManager interface {
+	TaskManager
+	//AddWtfTask adds the task unless a task with the same idempotency key exists. The id of the existing task is returned then and created is false
+	AddWtfTask(payload *WtfTaskDefinition, key string) (id int, created bool, err error)
+}
+
+type TerraformTaskManager interface {
+	TaskManager
+	AddTerraformTask(def *TerraformTaskDefinition) (int, error)
+}
+
+//TaskManagerImpl runs tasks of all kinds. What is run is decided by the executor of the task
 type TaskManagerImpl struct {
-	sequence       int
-	sequenceFile   string
+	sequence       storer.SequenceProvider
 	started        bool
-	stop           chan bool
-	threads        map[string]chan Task
+	dispatcher     *dispatcher
 	defaultWorkDir string
 	lock           sync.Mutex
 	cancel         map[int]context.CancelFunc
 	tasks          map[int]Task
 	taskHashes     map[string]int
+	//instance is the lease telling other replicas that the instance is alive
+	instance *stateLease
+	reaper   *reaper
 }
 
-func (tm *TaskManagerImpl) Cancel(id int) error {
+func (tm *TaskManagerImpl) Cancel(id int, by string) error {
+	t := tm.Get(id)
+	if t == nil {
+		return errors.New(fmt.Sprintf("there is no task with id %d", id))
+	}
+	tm.lock.Lock()
 	cancel := tm.cancel[id]
-	if cancel == nil {
+	tm.lock.Unlock()
+	if t.GetStatus() == misc.STARTED && cancel == nil {
 		return errors.New(fmt.Sprintf("task id: %d has no registered cancel function", id))
 	}
-	log.Printf("Task id %d is set to be cancelled", id)
-	cancel()
+	err := t.Cancel(by)
+	if err != nil {
+		return err
+	}
+	//Queued task must not be picked up by a worker anymore
+	if tm.dispatcher.remove(t) {
+		misc.Debugf("task %d has been removed from the queue %s", id, t.SyncName())
+	}
+	log.Printf("Task id %d is set to be cancelled by %s", id, by)
+	if cancel != nil {
+		cancel()
+		if t.GetStatus() == misc.CANCELLED {
+			//Task is not running, so nobody else cleans it up
+			tm.lock.Lock()
+			delete(tm.cancel, id)
+			tm.lock.Unlock()
+		}
+	}
 	return nil
 }
 
 func (tm *TaskManagerImpl) IsStarted() bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
 	return tm.started
 }
 
-func (tm *TaskManagerImpl) AddRunSh(rcs *RunShCmd, ctx context.Context) (Task, error) {
-	command, args, err := rcs.CommandArgs()
+func (tm *TaskManagerImpl) AddRunSh(rcs *RunShCmd, ctx context.Context, timeout time.Duration) (Task, error) {
+	t, err := newRunShTask(rcs, ctx, timeout)
 	if err != nil {
 		return nil, err
 	}
-	//outPipeReader, outPipeWriter := io.Pipe()
-	//errPipeReader, errPipeWriter := io.Pipe()
-	//inPipeReader, inPipeWriter := io.Pipe()
 
-	t := &RunShTask{Command: command, Args: args, Context: ctx,
-		Status: misc.OPEN,
-		//Always save task output to the out dir
-		save:      true,
-		Socket:    make(chan *websocket.Conn),
-		StateLock: fmt.Sprintf("%s/%s", rcs.Env, rcs.Layer),
-		//out:       outPipeReader, err: errPipeReader, in: inPipeWriter,
-		//outW: outPipehWriter, errW: errPipeWriter, inR: inPipeReader,
-		//Perhaps it is better ot transfer Git Origins via the context
-		GitOrigins: rcs.GitOrigins,
+	err = tm.Add(t)
+	if err != nil {
+		misc.Debugf("cannot add task %q. Error: %s", t.executor.Command(), err)
+		return nil, err
 	}
-	if ee, ok := ctx.Value(misc.EnvVarsKey).(*map[string]string); ok {
-		t.ExtraEnv = *ee
+	tm.putHash(rcs.hash, t.GetId())
+	persistTask(t)
+	err = t.AddWebhookLocks()
+	if err != nil {
+		misc.Debugf("cannot add webhook locks for task %d", t.GetId())
 	}
+	return t, err
+}
 
-	err = tm.Add(t)
+func (tm *TaskManagerImpl) AddWtfTask(payload *WtfTaskDefinition, key string) (int, bool, error) {
+	ts := time.Unix(payload.Instant, 0)
+	if key == "" {
+		misc.Debugf("Creating a new task (ts: %s) ", ts.String())
+		tid, err := tm.addGitTask(newWtfTask(payload))
+		return tid, err == nil, err
+	}
+	store := storer.GetTaskStore()
+	if tid, err := store.LookupKey(key); err == nil {
+		misc.Debugf("task with idempotency key %s has already been created with id %d", key, tid)
+		return tid, false, nil
+	}
+	//The key is claimed in the task store, so a concurrent retry coming to another replica gets the same task
+	id, err := tm.sequence.Next()
 	if err != nil {
-		if viper.GetBool(misc.DebugKey) {
-			log.Printf("Cannot add task %v. Error: %s", t, err)
+		return -1, false, fmt.Errorf("cannot allocate task id. Error: %w", err)
+	}
+	tid, claimed, err := store.ClaimKey(key, id, idempotencyTTL())
+	if err != nil {
+		return -1, false, fmt.Errorf("cannot claim idempotency key. Error: %w", err)
+	}
+	if !claimed {
+		misc.Debugf("task with idempotency key %s has already been created with id %d", key, tid)
+		return tid, false, nil
+	}
+	misc.Debugf("Creating a new task %d (ts: %s, idempotency key: %s) ", id, ts.String(), key)
+	task := newWtfTask(payload)
+	task.hash = key
+	task.setId(id)
+	tid, err = tm.addGitTask(task)
+	if tid < 0 {
+		if rerr := store.ReleaseKey(key, id); rerr != nil {
+			misc.Debugf("cannot release idempotency key of task %d. Error: %s", id, rerr)
 		}
 	}
-	tm.taskHashes[rcs.hash] = t.Id
-	err = t.AddWebhookLocks()
+	return tid, err == nil, err
+}
+
+func idempotencyTTL() time.Duration {
+	return time.Duration(viper.GetInt(misc.IdempotencyTTLKey)) * time.Second
+}
+
+func (tm *TaskManagerImpl) AddTerraformTask(def *TerraformTaskDefinition) (int, error) {
+	err := def.Validate()
 	if err != nil {
-		misc.Debugf("cannot add webhook locks for task %d", t.Id)
+		return -1, fmt.Errorf("invalid task definition. Error: %w", err)
 	}
-	return t, err
+	ts := time.Unix(def.Instant, 0)
+	misc.Debugf("Creating a new %s task (ts: %s) ", def.Tool, ts.String())
+	return tm.addGitTask(newTerraformTask(def))
+}
+
+//addGitTask queues the task, which has its own cancel function, and makes it wait for the webhooks
+func (tm *TaskManagerImpl) addGitTask(task *GitTask) (int, error) {
+	err := tm.Add(task)
+	if err != nil {
+		misc.Debugf("cannot add task %q. Error: %s", task.executor.Command(), err)
+		return -1, fmt.Errorf("cannot add task %q. Error: %w", task.executor.Command(), err)
+	}
+	tid := task.GetId()
+	misc.Debugf("Task %d has been added", tid)
+	err = tm.RegisterCancel(tid, task.cancel)
+	if err != nil {
+		misc.Debugf("cannot register cancel function of task %d. Error: %s", tid, err)
+	}
+	persistTask(task)
+	err = task.AddWebhookLocks()
+	if err != nil {
+		misc.Debugf("cannot add webhook locks for task %d", tid)
+		return tid, fmt.Errorf("cannot add webhook locks for task %d Error: %w", tid, err)
+	}
+	return tid, nil
 }
 
 func (tm *TaskManagerImpl) Add(t Task) error {
@@ -107,15 +198,18 @@ func (tm *TaskManagerImpl) Add(t Task) error {
 		}
 		return errors.New("cannot add nil task")
 	}
-	//Sequence should be unique. So synchronizing is required now
-	al.Lock()
-	//Simple increment is not enough now. Need to update common value each time
-	tm.sequence = readSequence()
-	tm.sequence++
-	t.setId(tm.sequence)
-	writeSequence(tm.sequence)
-	al.Unlock()
-	tm.tasks[t.GetId()] = t
+	if tm.dispatcher.isStopped() {
+		return fmt.Errorf("task manager is shutting down %w", ErrDispatcherStopped)
+	}
+	//Id must be unique across the replicas, so it is allocated by the shared sequence unless the caller has done it already
+	if t.GetId() == 0 {
+		id, err := tm.sequence.Next()
+		if err != nil {
+			return fmt.Errorf("cannot allocate task id. Error: %w", err)
+		}
+		t.setId(id)
+	}
+	tm.putTask(t)
 	return nil
 }
 
@@ -128,13 +222,34 @@ func (tm *TaskManagerImpl) LaunchById(id int) error {
 }
 
 func (tm *TaskManagerImpl) Get(id int) Task {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
 	return tm.tasks[id]
 }
 
+func (tm *TaskManagerImpl) putTask(t Task) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.tasks[t.GetId()] = t
+}
+
+func (tm *TaskManagerImpl) putHash(hash string, id int) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	tm.taskHashes[hash] = id
+}
+
+//GetId returns the task of the run.sh hash or of the idempotency key. The keys are looked up in the task store
 func (tm *TaskManagerImpl) GetId(hash string) (int, error) {
-	if h, ok := tm.taskHashes[hash]; ok {
+	tm.lock.Lock()
+	h, ok := tm.taskHashes[hash]
+	tm.lock.Unlock()
+	if ok {
 		return h, nil
 	}
+	if id, err := storer.GetTaskStore().LookupKey(hash); err == nil {
+		return id, nil
+	}
 	return -1, errors.New(fmt.Sprintf("No task were registered with hash %s", hash))
 }
 
@@ -142,7 +257,9 @@ func (tm *TaskManagerImpl) RegisterCancel(id int, cancel context.CancelFunc) err
 	if tm.Get(id) == nil {
 		return errors.New(fmt.Sprintf("there is no task with id %d", id))
 	}
+	tm.lock.Lock()
 	tm.cancel[id] = cancel
+	tm.lock.Unlock()
 	return nil
 }
 
@@ -150,7 +267,7 @@ func GetTaskManager() TaskManager {
 	if tm == nil {
 		tml.Lock()
 		if tm == nil {
-			tm = NewWtfTaskManager()
+			tm = NewTaskManager()
 		}
 		tml.Unlock()
 	}
@@ -162,113 +279,29 @@ func GetWtfTaskManager() WtfTaskManager {
 	return GetTaskManager().(WtfTaskManager)
 }
 
-func readSequence() int {
-	if viper.GetBool(misc.UseExternalSequence) {
-		sequence, err := storer.GetSequence()
-		if err != nil {
-			emsg := err.Error()
-			if emsg == "ResourceNotFoundException: Requested resource not found" {
-				misc.Debug("Looks like there is no external sequence storage. I am going to create it now...")
-				err := storer.EnsureSequenceTable()
-				if err != nil {
-					misc.Debug(err.Error())
-				} else {
-					misc.Debug("External sequence storage has been successfully created")
-				}
-			} else {
-				misc.Debugf("Cannot get external sequence. Error: %s. Falling back to the local one.", err)
-			}
-			return readSequenceFromFile()
-		} else {
-			return sequence
-		}
-	} else {
-		return readSequenceFromFile()
-	}
-}
-
-func readSequenceFromFile() int {
-	rd := viper.GetString(misc.RunDirKey)
-	if _, err := os.Stat(rd); os.IsNotExist(err) {
-		log.Printf("Run directory %s does not exist. Creating one", rd)
-		err := os.MkdirAll(rd, 0755)
-		if err != nil {
-			log.Printf("Cannot create run directory %s Error: %s", rd, err)
-		}
-	}
-	rdf := path.Join(rd, "sequence")
-	seqFile, err := os.Open(rdf)
-	var seq int
-	if err != nil {
-		log.Printf("Cannot open sequence file %s Error: %s", rdf, err)
-		return 0
-	}
-	defer seqFile.Close()
-	seqBytes, err := ioutil.ReadAll(seqFile)
-	if err != nil {
-		log.Printf("Cannot read sequence file %s Error: %s", rdf, err)
-		return 0
-	}
-	seq, err = strconv.Atoi(string(seqBytes))
-	if err != nil {
-		log.Printf("Cannot convert sequence %s form file %s Error: %s", seqBytes, rdf, err)
-		return 0
-	}
-	log.Printf("Task counter value %d", seq)
-	return seq
-}
-
-func writeSequence(i int) {
-	if viper.GetBool(misc.UseExternalSequence) {
-		err := storer.UpdateSequence(i)
-		if err != nil {
-			misc.Debug(err.Error())
-		}
-	}
-	writeSequence2file(i)
-
-}
-
-func writeSequence2file(i int) {
-	rundir := viper.GetString(misc.RunDirKey)
-	if _, err := os.Stat(rundir); os.IsNotExist(err) {
-		err := os.MkdirAll(rundir, 0755)
-		if err != nil {
-			log.Printf("Cannot create run directory %s Error: %s", rundir, err)
-		}
-	}
-	var seqFile *os.File
-	rdf := path.Join(rundir, "sequence")
-	seqFile, err := os.OpenFile(rdf, os.O_CREATE|os.O_WRONLY, 0755)
-	if err != nil {
-		log.Printf("Cannot open sequence file %s Error %s", rdf, err)
-		return
-	}
-
-	defer seqFile.Close()
-	_, err = seqFile.Write([]byte(strconv.Itoa(i)))
-	if err != nil {
-		if viper.GetBool(misc.DebugKey) {
-			log.Printf("Cannot save sequence %d to file %s Error: %s", i, rdf, err)
-		}
-	}
-
+func GetTerraformTaskManager() TerraformTaskManager {
+	return GetTaskManager().(TerraformTaskManager)
 }
 
 func NewTaskManager() TaskManager {
-	return &TaskManagerImpl{started: false,
-		stop:       make(chan bool),
-		sequence:   readSequence(),
-		threads:    make(map[string]chan Task),
+	m := &TaskManagerImpl{started: false,
+		sequence:   storer.GetSequenceProvider(),
 		cancel:     make(map[int]context.CancelFunc),
 		tasks:      make(map[int]Task),
 		taskHashes: make(map[string]int),
 	}
+	m.dispatcher = newDispatcher(viper.GetInt(misc.QueueLengthKey), newWorkerPoolFromConfig(), m.runTask)
+	return m
 }
 
 func (tm *TaskManagerImpl) Launch(bt Task) error {
-	if bt.GetStatus() != misc.OPEN {
-		if bt.GetStatus() == misc.SCHEDULED {
+	//Cancel and Expire may change the status concurrently, so it is checked and changed at once
+	if current, ok := bt.launch(); !ok {
+		if current == misc.CANCELLED {
+			misc.Debugf("task %d has been cancelled. It will not be launched", bt.GetId())
+			return nil
+		}
+		if current == misc.SCHEDULED {
 			if viper.GetBool(misc.DebugKey) {
 				log.Printf("Task %d has already been scheduled. Perhaps more than one webhook were precessed", bt.GetId())
 			}
@@ -276,71 +309,98 @@ func (tm *TaskManagerImpl) Launch(bt Task) error {
 		}
 		return errors.New("cannot launch task in not scheduled status")
 	}
-	if tm.threads[bt.SyncName()] == nil {
-		tm.lock.Lock()
-		if tm.threads[bt.SyncName()] == nil {
-			tm.threads[bt.SyncName()] = make(chan Task, viper.GetInt(misc.QueueLengthKey))
-		}
-		tm.lock.Unlock()
-	}
-	bt.SetStatus(misc.SCHEDULED)
 	if viper.GetBool(misc.DebugKey) {
 		log.Printf("Task %d has been scheduled", bt.GetId())
 	}
-	tm.threads[bt.SyncName()] <- bt
-
-	return nil
+	err := tm.dispatcher.enqueue(bt)
+	if errors.Is(err, ErrQueueFull) {
+		//Reject the task right away instead of blocking the caller (GitHub would time the webhook delivery out)
+		bt.ForceFail(fmt.Sprintf("task cannot be queued. Error: %s", err))
+	}
+	return err
 }
 
 func (tm *TaskManagerImpl) Close() error {
-	close(tm.stop)
+	tm.stopReaper()
+	tm.dispatcher.shutdown()
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
 	for id, c := range tm.cancel {
 		log.Printf("Cancelling task %d", id)
 		c()
-		tm.cancel[id] = nil
+		delete(tm.cancel, id)
+	}
+	//Queued tasks of the instance can be taken over by other replicas once it has gone
+	if tm.instance != nil {
+		tm.instance.release()
+		tm.instance = nil
 	}
 	return nil
 }
 
-func (tm *TaskManagerImpl) Start() error {
-	go tm.starter()
-	//Perhaps I should handle errors...
-	//TODO: implement readiness check
-	return nil
+func (tm *TaskManagerImpl) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down task manager")
+	tm.stopReaper()
+	tm.dispatcher.shutdown()
+	//Queued tasks are not going to be run by this instance. Make sure the store has them to resume after restart
+	for _, t := range tm.pendingTasks() {
+		persistTask(t)
+	}
+	err := tm.dispatcher.waitContext(ctx)
+	if err != nil {
+		log.Printf("Running tasks have not finished in time. Cancelling them")
+		tm.Close()
+		tm.dispatcher.wait()
+		return fmt.Errorf("task manager has not been shut down gracefully %w", err)
+	}
+	log.Println("All running tasks have finished")
+	return tm.Close()
 }
 
-func (tm *TaskManagerImpl) starter() error {
+func (tm *TaskManagerImpl) pendingTasks() []Task {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	var pending []Task
+	for _, t := range tm.tasks {
+		if s := t.GetStatus(); s == misc.OPEN || s == misc.SCHEDULED {
+			pending = append(pending, t)
+		}
+	}
+	return pending
+}
+
+func (tm *TaskManagerImpl) Start() error {
+	tm.lock.Lock()
 	if tm.started {
+		tm.lock.Unlock()
 		return errors.New("dispatcher already has been Started")
 	}
-	started := make(map[string]bool)
-	for {
-		for s, tasks := range tm.threads {
-			if !started[s] {
-				go tm.runTasks(tasks)
-				started[s] = true
-			}
-		}
-		//Event sourcing
-		select {
-		case <-tm.stop:
-			for _, tasks := range tm.threads {
-				close(tasks)
-			}
-			break
-		default:
-			time.Sleep(time.Second)
-		}
+	tm.started = true
+	tm.lock.Unlock()
+	//Workers have to be running before restored tasks get to the queues, otherwise a full queue would block the start
+	tm.dispatcher.start()
+	//Other replicas must see the instance alive before it restores its tasks
+	locker := storer.GetStateLocker()
+	instance, err := startInstanceLease(locker)
+	if err != nil {
+		log.Printf("Tasks of the instance may be taken over by other replicas after restart. Error: %s", err)
 	}
+	tm.lock.Lock()
+	tm.instance = instance
+	tm.lock.Unlock()
+	//Take the tasks of the previous run back under control
+	rehydrate(tm, locker)
+	tm.startReaper()
+	return nil
 }
 
-func (tm *TaskManagerImpl) runTasks(tasks <-chan Task) {
-	for t := range tasks {
-		err := t.Run()
-		if err != nil {
-			log.Printf("Task failed: %s", err)
-		}
-		//Clean up task cancel functions
-		tm.cancel[t.GetId()] = nil
+func (tm *TaskManagerImpl) runTask(t Task) {
+	err := t.Run()
+	if err != nil {
+		log.Printf("Task failed: %s", err)
 	}
+	//Clean up task cancel functions
+	tm.lock.Lock()
+	delete(tm.cancel, t.GetId())
+	tm.lock.Unlock()
 }
@@ -0,0 +1,225 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/git"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ToolTerraform  = "terraform"
+	ToolTerragrunt = "terragrunt"
+	planFile       = "tfchek.tfplan"
+)
+
+//TerraformTaskDefinition describes a plain terraform (or terragrunt) run in a directory of a git repository
+type TerraformTaskDefinition struct {
+	//Repository is the git remote, which has to be checked out
+	Repository string
+	//Directory is relative to the repository root
+	Directory string
+	//Tool is either terraform (default) or terragrunt
+	Tool string
+	//Apply the plan. Only plan is done otherwise
+	Apply   bool
+	Targets []string
+	//VarFiles are relative to Directory
+	VarFiles []string
+	//StateLock is optional. Repository name with the directory is used by default
+	StateLock string
+	//Timeout of the run in seconds
+	Timeout string
+	Instant int64
+	//Labels are stored with the task and shown in its pull request or issue
+	Labels map[string]string
+}
+
+//Validate checks the definition and fills in default values
+func (d *TerraformTaskDefinition) Validate() error {
+	if d.Repository == "" {
+		return errors.New("repository is not set")
+	}
+	fullName, err := git.GetFullRepoName(d.Repository)
+	if err != nil {
+		return fmt.Errorf("cannot parse repository %q. Error: %w", d.Repository, err)
+	}
+	if !insideRepository(d.Directory) {
+		return fmt.Errorf("directory %q has to be inside of the repository", d.Directory)
+	}
+	d.Directory = strings.TrimPrefix(path.Clean("/"+d.Directory), "/")
+	if d.Apply && viper.GetBool(misc.Fuse) {
+		return fmt.Errorf("apply is disabled due to %s option is set to true", misc.Fuse)
+	}
+	switch d.Tool {
+	case "":
+		d.Tool = ToolTerraform
+	case ToolTerraform, ToolTerragrunt:
+	default:
+		return fmt.Errorf("unsupported tool %q", d.Tool)
+	}
+	//Terraform resolves var files relative to the directory it runs in
+	for _, vf := range d.VarFiles {
+		if vf == "" || path.IsAbs(vf) || !insideRepository(path.Join(d.Directory, vf)) {
+			return fmt.Errorf("var file %q has to be inside of the repository", vf)
+		}
+	}
+	err = validateLabels(d.Labels)
+	if err != nil {
+		return err
+	}
+	if d.StateLock == "" {
+		d.StateLock = strings.TrimSuffix(fmt.Sprintf("%s/%s", fullName, d.Directory), "/")
+	}
+	return nil
+}
+
+//insideRepository checks that the relative path does not escape the repository
+func insideRepository(p string) bool {
+	if path.IsAbs(p) {
+		return false
+	}
+	c := path.Clean(p)
+	return c != ".." && !strings.HasPrefix(c, "../")
+}
+
+//GetTimeout returns the timeout of the run. The timeout from configuration is used if the definition has none
+func (d *TerraformTaskDefinition) GetTimeout() time.Duration {
+	timeout := time.Duration(viper.GetInt(misc.TimeoutKey)) * time.Second
+	if d.Timeout == "" {
+		return timeout
+	}
+	t, err := strconv.Atoi(d.Timeout)
+	if err != nil || t <= 0 {
+		misc.Debugf("cannot parse timeout %s. Using default value from confguration file %d", d.Timeout, viper.GetInt(misc.TimeoutKey))
+		return timeout
+	}
+	return time.Duration(t) * time.Second
+}
+
+//terraformExecutor runs terraform or terragrunt directly without run.sh
+type terraformExecutor struct {
+	definition *TerraformTaskDefinition
+}
+
+func newTerraformTask(def *TerraformTaskDefinition) *GitTask {
+	return newGitTask(context.Background(), def.GetTimeout(), &terraformExecutor{definition: def})
+}
+
+func (e *terraformExecutor) Kind() string {
+	return storer.TaskKindTerraform
+}
+
+func (e *terraformExecutor) Command() string {
+	var steps []string
+	for _, args := range e.steps() {
+		steps = append(steps, strings.Join(append([]string{e.definition.Tool}, args...), " "))
+	}
+	return fmt.Sprintf("cd %s && %s", e.dir(), strings.Join(steps, " && "))
+}
+
+func (e *terraformExecutor) StateLock() string {
+	return e.definition.StateLock
+}
+
+func (e *terraformExecutor) Origins() []string {
+	return []string{e.definition.Repository}
+}
+
+func (e *terraformExecutor) Definition() []byte {
+	definition, err := json.Marshal(e.definition)
+	if err != nil {
+		misc.Debugf("cannot serialize task definition. Error: %s", err)
+		return nil
+	}
+	return definition
+}
+
+func (e *terraformExecutor) Labels() map[string]string {
+	return e.definition.Labels
+}
+
+func (e *terraformExecutor) GitApiVersion() int {
+	return getApiVersionForRepomanager()
+}
+
+func (e *terraformExecutor) MainRepository(ws *Workspace) (string, error) {
+	if ws.GetPath(e.definition.Repository) == "" {
+		return "", fmt.Errorf("repository %s was not checked out for task %d", e.definition.Repository, ws.TaskId)
+	}
+	return e.definition.Repository, nil
+}
+
+func (e *terraformExecutor) Execute(ctx context.Context, ws *Workspace) error {
+	//The option may have been switched on after the task was accepted
+	if e.definition.Apply && viper.GetBool(misc.Fuse) {
+		return fmt.Errorf("task %d cannot be applied, because apply is disabled due to %s option is set to true", ws.TaskId, misc.Fuse)
+	}
+	remote, err := e.MainRepository(ws)
+	if err != nil {
+		return err
+	}
+	cwd := filepath.Join(ws.GetPath(remote), filepath.FromSlash(e.definition.Directory))
+	info, err := os.Stat(cwd)
+	if err != nil {
+		return fmt.Errorf("cannot access directory %s. Error: %w", e.definition.Directory, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", e.definition.Directory)
+	}
+	env, err := taskEnvironment(e.StateLock(), map[string]string{"TF_IN_AUTOMATION": "1", "TF_INPUT": "0"})
+	if err != nil {
+		return fmt.Errorf("cannot set up environment of task %d. Error: %w", ws.TaskId, err)
+	}
+	sysenv := envList(withFencingToken(ws, env))
+	logTaskEnv(ws.TaskId, &sysenv)
+	for _, args := range e.steps() {
+		ws.Output.StartStep(e.definition.Tool + " " + args[0])
+		_, err := fmt.Fprintf(ws.Output.GetStdOut(), "\n>>> %s %s\n", e.definition.Tool, strings.Join(args, " "))
+		if err != nil {
+			misc.Debugf("cannot write step header of task %d. Error: %s", ws.TaskId, err)
+		}
+		command := exec.Command(e.definition.Tool, args...)
+		command.Dir = cwd
+		command.Env = sysenv
+		err = runOnBackend(ctx, ws, command)
+		if err != nil {
+			return fmt.Errorf("%s %s failed. Error: %w", e.definition.Tool, args[0], err)
+		}
+	}
+	return nil
+}
+
+//steps returns arguments of every tool invocation
+func (e *terraformExecutor) steps() [][]string {
+	plan := []string{"plan", "-input=false", "-out=" + planFile}
+	for _, t := range e.definition.Targets {
+		plan = append(plan, "-target="+t)
+	}
+	for _, vf := range e.definition.VarFiles {
+		plan = append(plan, "-var-file="+vf)
+	}
+	steps := [][]string{{"init", "-input=false"}, plan}
+	if e.definition.Apply {
+		steps = append(steps, []string{"apply", "-input=false", planFile})
+	}
+	return steps
+}
+
+func (e *terraformExecutor) dir() string {
+	if e.definition.Directory == "" {
+		return "."
+	}
+	return e.definition.Directory
+}
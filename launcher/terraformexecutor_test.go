@@ -0,0 +1,76 @@
+package launcher
+
+import (
+	"context"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTerraformTaskDefinition_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		def       TerraformTaskDefinition
+		wantErr   bool
+		wantDir   string
+		wantTool  string
+		wantState string
+	}{
+		{"Repository root", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git"}, false, "", ToolTerraform, "wix/infra"},
+		{"Subdirectory", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "./envs//prod/"}, false, "envs/prod", ToolTerraform, "wix/infra/envs/prod"},
+		{"Terragrunt with lock", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "live", Tool: ToolTerragrunt, StateLock: "live"}, false, "live", ToolTerragrunt, "live"},
+		{"Dots in name", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "..live"}, false, "..live", ToolTerraform, "wix/infra/..live"},
+		{"No repository", TerraformTaskDefinition{Directory: "live"}, true, "", "", ""},
+		{"Escaping directory", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "live/../../etc"}, true, "", "", ""},
+		{"Absolute directory", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "/etc"}, true, "", "", ""},
+		{"Escaping var file", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", VarFiles: []string{"../secret.tfvars"}}, true, "", "", ""},
+		{"Shared var file", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "envs/prod", VarFiles: []string{"../common.tfvars"}}, false, "envs/prod", ToolTerraform, "wix/infra/envs/prod"},
+		{"Var file escaping from directory", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "envs/prod", VarFiles: []string{"../../../etc/x.tfvars"}}, true, "", "", ""},
+		{"Absolute var file", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Directory: "envs/prod", VarFiles: []string{"/etc/x.tfvars"}}, true, "", "", ""},
+		{"Unknown tool", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Tool: "pulumi"}, true, "", "", ""},
+		{"Plan with fuse", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git"}, false, "", ToolTerraform, "wix/infra"},
+		{"Apply with fuse", TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Apply: true}, true, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.HasSuffix(tt.name, "with fuse") {
+				viper.Set(misc.Fuse, true)
+				defer viper.Set(misc.Fuse, nil)
+			}
+			d := tt.def
+			err := d.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if d.Directory != tt.wantDir || d.Tool != tt.wantTool || d.StateLock != tt.wantState {
+				t.Errorf("Validate() got directory %q tool %q state lock %q, want %q %q %q", d.Directory, d.Tool, d.StateLock, tt.wantDir, tt.wantTool, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestTerraformExecutorSteps(t *testing.T) {
+	def := &TerraformTaskDefinition{Tool: ToolTerraform, Apply: true, Targets: []string{"module.a"}, VarFiles: []string{"prod.tfvars"}}
+	e := &terraformExecutor{definition: def}
+	plan := []string{"plan", "-input=false", "-out=" + planFile, "-target=module.a", "-var-file=prod.tfvars"}
+	want := [][]string{{"init", "-input=false"}, plan, {"apply", "-input=false", planFile}}
+	if got := e.steps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("steps() = %v, want %v", got, want)
+	}
+}
+
+func TestTerraformExecutor_ExecuteWithFuse(t *testing.T) {
+	viper.Set(misc.Fuse, true)
+	defer viper.Set(misc.Fuse, nil)
+	e := &terraformExecutor{definition: &TerraformTaskDefinition{Repository: "git@github.com:wix/infra.git", Tool: ToolTerraform, Apply: true}}
+	//Nothing is run, so the repository does not have to be checked out
+	err := e.Execute(context.Background(), &Workspace{TaskId: 42})
+	if err == nil || !strings.Contains(err.Error(), misc.Fuse) {
+		t.Errorf("Execute() error = %v, want apply to be refused", err)
+	}
+}
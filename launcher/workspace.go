@@ -0,0 +1,175 @@
+package launcher
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const workspacePrefix = "task-"
+
+//newTaskWorkspace creates the private workspace of the task from the shared checkouts, which serve as a cache.
+//Git objects, which are never modified, are hard linked unless it is disabled, so the bulk of the repository is not copied.
+//Other files are copied. A run can neither see the leftovers of the previous runs nor leave its own to the next ones
+func newTaskWorkspace(taskId int, checkouts []Repository) (*Workspace, error) {
+	root := filepath.Join(viper.GetString(misc.WorkspaceDirKey), fmt.Sprintf("%s%d", workspacePrefix, taskId))
+	//Workspace can be left by the task interrupted with the server restart
+	err := os.RemoveAll(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot remove stale workspace %s. Error: %w", root, err)
+	}
+	hardlinks := viper.GetBool(misc.WorkspaceHardlinksKey)
+	ws := &Workspace{TaskId: taskId, Root: root}
+	names := make(map[string]bool)
+	for _, c := range checkouts {
+		name := repositoryDirName(c.Remote)
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%s-%d", repositoryDirName(c.Remote), i)
+		}
+		names[name] = true
+		dest := filepath.Join(root, name)
+		err := linkTree(c.Path, dest, hardlinks)
+		if err != nil {
+			removeWorkspace(ws)
+			return nil, fmt.Errorf("cannot create workspace of %s from %s. Error: %w", c.Remote, c.Path, err)
+		}
+		ws.Repositories = append(ws.Repositories, Repository{Remote: c.Remote, Path: dest})
+	}
+	misc.Debugf("workspace %s has been created for task %d", root, taskId)
+	return ws, nil
+}
+
+//releaseWorkspace removes the workspace of the completed task. It is kept for the retention period if one is configured
+func releaseWorkspace(ws *Workspace) {
+	if ws == nil || ws.Root == "" {
+		return
+	}
+	retention := time.Duration(viper.GetInt(misc.WorkspaceRetentionKey)) * time.Second
+	if retention <= 0 {
+		removeWorkspace(ws)
+		return
+	}
+	//Retention is counted from the task completion
+	now := time.Now()
+	err := os.Chtimes(ws.Root, now, now)
+	if err != nil {
+		misc.Debugf("cannot mark workspace %s of task %d as released. Error: %s", ws.Root, ws.TaskId, err)
+	}
+	log.Printf("Workspace %s of task %d is kept for %s", ws.Root, ws.TaskId, retention)
+}
+
+func removeWorkspace(ws *Workspace) {
+	err := os.RemoveAll(ws.Root)
+	if err != nil {
+		log.Printf("Cannot remove workspace %s of task %d. Error: %s", ws.Root, ws.TaskId, err)
+		return
+	}
+	misc.Debugf("workspace %s of task %d has been removed", ws.Root, ws.TaskId)
+}
+
+//sweepWorkspaces removes workspaces of the inactive tasks, which retention period is over. It returns ids of their tasks
+func (tm *TaskManagerImpl) sweepWorkspaces(now time.Time) []int {
+	dir := viper.GetString(misc.WorkspaceDirKey)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			misc.Debugf("cannot list workspaces in %s. Error: %s", dir, err)
+		}
+		return nil
+	}
+	retention := time.Duration(viper.GetInt(misc.WorkspaceRetentionKey)) * time.Second
+	var swept []int
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), workspacePrefix) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(e.Name(), workspacePrefix))
+		if err != nil || now.Sub(e.ModTime()) < retention {
+			continue
+		}
+		if t := tm.Get(id); t != nil && !IsCompleted(t) {
+			continue
+		}
+		removeWorkspace(&Workspace{TaskId: id, Root: filepath.Join(dir, e.Name())})
+		swept = append(swept, id)
+	}
+	return swept
+}
+
+//repositoryDirName returns the repository name of the remote, which scripts may rely on
+func repositoryDirName(remote string) string {
+	name := strings.TrimSuffix(strings.TrimRight(remote, "/"), ".git")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" {
+		return "repository"
+	}
+	return name
+}
+
+//gitObjectsDir keeps the files git writes once and never modifies. The working tree, the index, HEAD and the refs are modified in place
+var gitObjectsDir = filepath.Join(".git", "objects") + string(filepath.Separator)
+
+//linkTree recreates the directory tree of src at dst. Git objects are hard linked if it is requested and possible, other files are copied
+func linkTree(src, dst string, hardlinks bool) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return os.MkdirAll(target, mode.Perm()|0700)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			if hardlinks && strings.HasPrefix(rel, gitObjectsDir) {
+				err := os.Link(p, target)
+				if err == nil {
+					return nil
+				}
+				//Linking fails for all the files if the cache is on another file system
+				misc.Debugf("cannot link %s, copying the rest of %s. Error: %s", p, src, err)
+				hardlinks = false
+			}
+			return copyFile(p, target, mode.Perm())
+		default:
+			//Sockets, pipes and devices do not belong to the repository
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package launcher
+
+import (
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewTaskWorkspace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-workspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "cache")
+	for name, data := range map[string]string{"run.sh": "#!/bin/sh\n", "env/layer/main.tf": "terraform {}\n",
+		".git/HEAD": "ref: refs/heads/master\n", ".git/objects/ab/cdef": "blob"} {
+		p := filepath.Join(cache, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("env/layer", filepath.Join(cache, "current")); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set(misc.WorkspaceDirKey, filepath.Join(dir, "workspaces"))
+	defer viper.Set(misc.WorkspaceDirKey, nil)
+	defer viper.Set(misc.WorkspaceHardlinksKey, nil)
+	tests := []struct {
+		name      string
+		hardlinks bool
+	}{
+		{name: "hardlinks", hardlinks: true},
+		{name: "copies"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set(misc.WorkspaceHardlinksKey, tt.hardlinks)
+			checkouts := []Repository{{Remote: "git@github.com:wix-system/production_42.git", Path: cache},
+				{Remote: "https://github.com/other/production_42", Path: cache}}
+			ws, err := newTaskWorkspace(i+1, checkouts)
+			if err != nil {
+				t.Fatalf("newTaskWorkspace() error = %v", err)
+			}
+			if len(ws.Repositories) != 2 || filepath.Base(ws.Repositories[0].Path) != "production_42" || filepath.Base(ws.Repositories[1].Path) != "production_42-2" {
+				t.Fatalf("newTaskWorkspace() repositories = %v", ws.Repositories)
+			}
+			path := ws.GetPath(checkouts[0].Remote)
+			info, err := os.Stat(filepath.Join(path, "run.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode()&0111 == 0 {
+				t.Errorf("run.sh is not executable")
+			}
+			original, err := os.Stat(filepath.Join(cache, "run.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			//Files modified in place must never be shared with the cache
+			if os.SameFile(info, original) {
+				t.Errorf("run.sh is linked to the cache")
+			}
+			for name, linked := range map[string]bool{".git/HEAD": false, ".git/objects/ab/cdef": tt.hardlinks} {
+				info, err := os.Stat(filepath.Join(path, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				original, err := os.Stat(filepath.Join(cache, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if os.SameFile(info, original) != linked {
+					t.Errorf("%s is linked = %v, want %v", name, !linked, linked)
+				}
+			}
+			if link, err := os.Readlink(filepath.Join(path, "current")); err != nil || link != "env/layer" {
+				t.Errorf("symlink = %q, %v", link, err)
+			}
+			//Files created by the run stay in the workspace
+			if err := ioutil.WriteFile(filepath.Join(path, "env/layer/tfchek.tfplan"), []byte("plan"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(cache, "env/layer/tfchek.tfplan")); !os.IsNotExist(err) {
+				t.Errorf("plan has leaked to the cache. Error: %v", err)
+			}
+			releaseWorkspace(ws)
+			if _, err := os.Stat(ws.Root); !os.IsNotExist(err) {
+				t.Errorf("workspace %s has not been removed. Error: %v", ws.Root, err)
+			}
+		})
+	}
+}
+
+func TestSweepWorkspaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-workspaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.WorkspaceDirKey, dir)
+	defer viper.Set(misc.WorkspaceDirKey, nil)
+	viper.Set(misc.WorkspaceRetentionKey, 3600)
+	defer viper.Set(misc.WorkspaceRetentionKey, nil)
+	now := time.Now()
+	for _, name := range []string{"task-1", "task-2", "other"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(dir, name), now.Add(-2*time.Hour), now.Add(-2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	releaseWorkspace(&Workspace{TaskId: 2, Root: filepath.Join(dir, "task-2")})
+	tm := &TaskManagerImpl{tasks: make(map[int]Task)}
+	swept := tm.sweepWorkspaces(now)
+	if len(swept) != 1 || swept[0] != 1 {
+		t.Errorf("sweepWorkspaces() = %v, want [1]", swept)
+	}
+	for name, exists := range map[string]bool{"task-1": false, "task-2": true, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == exists {
+			t.Errorf("%s exists = %v, want %v", name, !exists, exists)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"github.com/wix-playground/tfChek/tfChekLog"
+	"github.com/wix-system/tfResDif/v3/apiv2"
+	"github.com/wix-system/tfResDif/v3/core"
+	"github.com/wix-system/tfResDif/v3/launcher"
+	wtfmisc "github.com/wix-system/tfResDif/v3/misc"
+	"github.com/wix-system/tfResDif/v3/modes"
+	"os"
+	"strconv"
+	"time"
+)
+
+//WtfTaskDefinition is the tfResDif task definition extended with the options of tfChek
+type WtfTaskDefinition struct {
+	apiv2.TaskDefinition
+	//Timeout of the run in seconds
+	Timeout string
+	//Labels are stored with the task and shown in its pull request or issue
+	Labels map[string]string
+}
+
+//Validate checks the options of tfChek. The tfResDif part is checked by the library
+func (d *WtfTaskDefinition) Validate() error {
+	if d.Context == nil {
+		return errors.New("context is not set")
+	}
+	return validateLabels(d.Labels)
+}
+
+//GetTimeout returns the timeout of the run. The timeout from configuration is used if the definition has none
+func (d *WtfTaskDefinition) GetTimeout() time.Duration {
+	timeout := time.Duration(viper.GetInt(misc.TimeoutKey)) * time.Second
+	if d.Timeout == "" {
+		return timeout
+	}
+	t, err := strconv.Atoi(d.Timeout)
+	if err != nil || t <= 0 {
+		misc.Debugf("cannot parse timeout %s. Using default value from confguration file %d", d.Timeout, viper.GetInt(misc.TimeoutKey))
+		return timeout
+	}
+	return time.Duration(t) * time.Second
+}
+
+//wtfExecutor runs terraform by means of tfResDif
+type wtfExecutor struct {
+	context    *core.RunShContext
+	definition []byte
+	labels     map[string]string
+}
+
+func newWtfExecutor(payload *WtfTaskDefinition) *wtfExecutor {
+	e := &wtfExecutor{context: payload.Context, labels: payload.Labels}
+	//Keep the original definition before the context gets its runtime fields
+	definition, err := json.Marshal(payload)
+	if err != nil {
+		misc.Debugf("cannot serialize task definition. Error: %s", err)
+	} else {
+		e.definition = definition
+	}
+	return e
+}
+
+func newWtfTask(payload *WtfTaskDefinition) *GitTask {
+	return newGitTask(context.Background(), payload.GetTimeout(), newWtfExecutor(payload))
+}
+
+func (e *wtfExecutor) Kind() string {
+	return storer.TaskKindWtf
+}
+
+func (e *wtfExecutor) Command() string {
+	return e.context.FullCommand
+}
+
+func (e *wtfExecutor) StateLock() string {
+	return e.context.Location.GetLocationString()
+}
+
+func (e *wtfExecutor) Origins() []string {
+	var origins []string
+	for _, cs := range e.context.ConfigSources {
+		origins = append(origins, cs.RemoteUrl)
+	}
+	return origins
+}
+
+func (e *wtfExecutor) Definition() []byte {
+	return e.definition
+}
+
+func (e *wtfExecutor) Labels() map[string]string {
+	return e.labels
+}
+
+func (e *wtfExecutor) GitApiVersion() int {
+	return getApiVersionForRepomanager()
+}
+
+//In this implementation I return production_42 repository always, because RG can be obsoleted in a future
+//TODO: return a repository where modifications has been made
+func (e *wtfExecutor) MainRepository(ws *Workspace) (string, error) {
+	if ws.GetPath(misc.PROD42) != "" {
+		return misc.PROD42, nil
+	}
+	misc.Debugf("failed to get %s repository. Falling back to %s one", misc.PROD42, misc.RG)
+	if ws.GetPath(misc.RG) != "" {
+		return misc.RG, nil
+	}
+	return "", fmt.Errorf("failed to obtain git repository manager from task %d", ws.TaskId)
+}
+
+func (e *wtfExecutor) Execute(ctx context.Context, ws *Workspace) error {
+	//The library launches its processes itself, so they cannot be moved to another backend
+	if backend := viper.GetString(misc.ExecutionBackendKey); backend != BackendLocal && backend != "" {
+		return fmt.Errorf("wtf tasks can run only on %s backend, but %s is configured", BackendLocal, backend)
+	}
+	logger := tfChekLog.NewTaskLogger(ws.TaskId, ws.Output.GetStdErr())
+	signals := make(chan os.Signal, 1)
+	e.context.Launcher = launcher.NewSinkSignallauncher(ws.Output, signals, logger)
+	e.context.DoGitUpdate = false
+	e.context.DoNotify = false
+	e.context.Debug = true
+	e.context.Logger = logger
+	//Inject RUNSH_PATH (important!)
+	var paths []core.ConfigSource
+	for _, cs := range e.context.ConfigSources {
+		paths = append(paths, core.ConfigSource{ws.GetPath(cs.RemoteUrl), cs.RemoteUrl})
+	}
+	misc.Debugf("setting configuration sources for task %d to %v", ws.TaskId, paths)
+	e.context.ConfigSources = paths
+	env, err := taskEnvironment(e.StateLock(), e.context.ExtraEnv)
+	if err != nil {
+		return fmt.Errorf("cannot set up environment of task %d. Error: %w", ws.TaskId, err)
+	}
+	env = withFencingToken(ws, env)
+	//The library starts its processes with the server environment added to the extra variables, so the variables beyond the allow list are cleared by them
+	e.context.ExtraEnv = withServerEnvCleared(env)
+	taskEnv := envList(env)
+	logTaskEnv(ws.TaskId, &taskEnv)
+
+	ws.Output.StartStep(misc.WtfExe)
+	finished := make(chan struct{})
+	go interruptOnDone(ctx, ws.TaskId, signals, finished)
+	runtimeError := modes.TerraformMode(wtfmisc.TerraformMode, e.context)
+	close(finished)
+	if wtfmisc.CheckRuntimeError(runtimeError) {
+		ws.Output.FinishStep(exitStatus(runtimeError))
+		return fmt.Errorf("Task failed. Error: %w", runtimeError)
+	}
+	ws.Output.FinishStep(exitStatus(nil))
+	return nil
+}
+
+//interruptOnDone passes interrupt signal to the running process when the task is cancelled or timed out.
+//The process is killed if it does not exit in the grace period
+func interruptOnDone(ctx context.Context, taskId int, signals chan<- os.Signal, finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+	misc.Debugf("interrupting task %d. Reason: %s", taskId, ctx.Err())
+	grace := interruptGracePeriod()
+	for _, sig := range []os.Signal{os.Interrupt, os.Kill} {
+		select {
+		case signals <- sig:
+		case <-finished:
+			return
+		}
+		select {
+		case <-finished:
+			return
+		case <-time.After(grace):
+			misc.Debugf("task %d has not exited in %s after %s signal", taskId, grace, sig)
+		}
+	}
+}
+
+func getApiVersionForRepomanager() int {
+	if viper.GetBool(misc.GitHubDownload) {
+		return 2
+	} else {
+		return 1
+	}
+}
@@ -0,0 +1,126 @@
+package launcher
+
+import (
+	"context"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/storer"
+	"github.com/wix-system/tfResDif/v3/apiv2"
+	"github.com/wix-system/tfResDif/v3/core"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWtfTaskDefinition_GetTimeout(t *testing.T) {
+	viper.Set(misc.TimeoutKey, 300)
+	defer viper.Set(misc.TimeoutKey, nil)
+	tests := []struct {
+		name    string
+		timeout string
+		want    time.Duration
+	}{
+		{"Configured timeout", "", 300 * time.Second},
+		{"Own timeout", "3600", time.Hour},
+		{"Broken timeout", "1h", 300 * time.Second},
+		{"Negative timeout", "-5", 300 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &WtfTaskDefinition{Timeout: tt.timeout}
+			if got := d.GetTimeout(); got != tt.want {
+				t.Errorf("GetTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskManagerImpl_AddWtfTask(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-idempotent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	viper.Set(misc.RepoDirKey, dir)
+	viper.Set(misc.IdempotencyTTLKey, 60)
+	defer viper.Set(misc.IdempotencyTTLKey, nil)
+	tm := &TaskManagerImpl{
+		sequence:   storer.NewFileSequence(filepath.Join(dir, "sequence")),
+		dispatcher: newDispatcher(10, newWorkerPool(0, nil), func(task Task) {}),
+		cancel:     make(map[int]context.CancelFunc),
+		tasks:      make(map[int]Task),
+		taskHashes: make(map[string]int),
+	}
+	newPayload := func() *WtfTaskDefinition {
+		return &WtfTaskDefinition{TaskDefinition: apiv2.TaskDefinition{Context: &core.RunShContext{
+			Location:      &core.Location{Env: "production", Layer: "idempotent"},
+			ConfigSources: []core.ConfigSource{{RemoteUrl: "git@github.com:wix-system/idempotent.git"}},
+		}}}
+	}
+	tests := []struct {
+		name        string
+		key         string
+		wantId      int
+		wantCreated bool
+	}{
+		{"First request", "request-1", 1, true},
+		{"Retried request", "request-1", 1, false},
+		{"Another request", "request-2", 2, true},
+		{"No key", "", 3, true},
+		{"No key again", "", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := tt.key
+			if key != "" {
+				//Keys are kept by the task store, which is shared by the tests
+				key = filepath.Base(dir) + key
+			}
+			id, created, err := tm.AddWtfTask(newPayload(), key)
+			if err != nil {
+				t.Fatalf("AddWtfTask() error = %v", err)
+			}
+			if id != tt.wantId || created != tt.wantCreated {
+				t.Errorf("AddWtfTask() = %d, %v, want %d, %v", id, created, tt.wantId, tt.wantCreated)
+			}
+		})
+	}
+	//The key is kept by the task record to be restored after restart
+	rec, err := storer.GetTaskStore().Load(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Hash != filepath.Base(dir)+"request-1" {
+		t.Errorf("task record hash = %q, want %q", rec.Hash, filepath.Base(dir)+"request-1")
+	}
+	//Retry coming to another replica is found in the task store
+	other := &TaskManagerImpl{taskHashes: make(map[string]int)}
+	if id, err := other.GetId(filepath.Base(dir) + "request-2"); err != nil || id != 2 {
+		t.Errorf("GetId() of another replica = %d, %v, want 2", id, err)
+	}
+}
+
+func TestWtfTaskDefinition_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr bool
+	}{
+		{"No labels", nil, false},
+		{"Labels", map[string]string{"jira": "OPS-1", "ci/job": "https://ci.example.com/job/42", "hotfix": ""}, false},
+		{"Empty key", map[string]string{"": "OPS-1"}, true},
+		{"Key with spaces", map[string]string{"jira ticket": "OPS-1"}, true},
+		{"Multiline value", map[string]string{"jira": "OPS-1\nOPS-2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &WtfTaskDefinition{TaskDefinition: apiv2.TaskDefinition{Context: &core.RunShContext{}}, Labels: tt.labels}
+			if err := d.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
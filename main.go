@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/spf13/pflag"
@@ -13,6 +19,7 @@ import (
 	"github.com/wix-playground/tfChek/github"
 	"github.com/wix-playground/tfChek/launcher"
 	"github.com/wix-playground/tfChek/misc"
+	"github.com/wix-playground/tfChek/scheduler"
 	"github.com/wix-system/tfResDif/v3/helpers"
 )
 
@@ -22,6 +29,11 @@ const (
 	Revision     = -1
 )
 
+const (
+	serverShutdownTimeout = 10 * time.Second
+	gitHubFlushTimeout    = 60 * time.Second
+)
+
 func config() {
 
 	//Initialize configuration for wtf first
@@ -40,13 +52,16 @@ func config() {
 	if err != nil {
 		log.Fatalf("Cannot bind flags. Error: %s", err)
 	}
-	viper.SetDefault(misc.QueueLengthKey, 10)
+	viper.SetDefault(misc.QueueLengthKey, 10) //Maximal number of pending tasks per state lock. Zero means no limit
 	viper.SetDefault(misc.TimeoutKey, 300)
 	viper.SetDefault(misc.RepoOwnerKey, "wix-system")
 	viper.SetDefault(misc.WebHookSecretKey, "notAsecretAtAll:)")
 	viper.SetDefault(misc.RepoDirKey, "/var/tfChek/repos_by_state/")
 	viper.SetDefault(misc.CertSourceKey, "")
 	viper.SetDefault(misc.RunDirKey, "/var/run/tfChek/")
+	viper.SetDefault(misc.WorkspaceDirKey, "/var/tfChek/workspaces/") //Tasks run in their own copies of the repositories here. It should be on the same file system as repo_dir
+	viper.SetDefault(misc.WorkspaceRetentionKey, 0)                   //Seconds to keep the workspace of the completed task for debugging. Zero removes it right away
+	viper.SetDefault(misc.WorkspaceHardlinksKey, true)                //Workspaces hard link git objects of the repositories. They are copied if linking fails. Other files are always copied
 	viper.SetDefault(misc.AvatarDir, "/var/tfChek/avatars")
 	viper.SetDefault(misc.GitHubClientId, "client_id_here")
 	viper.SetDefault(misc.GitHubClientSecret, "client_secret_here")
@@ -59,9 +74,41 @@ func config() {
 	viper.SetDefault(misc.AWSSecretKey, "") //Configures your AWS secret key
 	viper.SetDefault(misc.AWSSequenceTable, "tfChek-sequence")
 	viper.SetDefault(misc.UseExternalSequence, true)
+	viper.SetDefault(misc.AWSTaskTable, "tfChek-tasks")
+	viper.SetDefault(misc.UseExternalTaskStore, false)
+	viper.SetDefault(misc.AWSLockTable, "tfChek-locks")
+	viper.SetDefault(misc.AWSKeyTable, "tfChek-keys")
+	viper.SetDefault(misc.UseExternalLocks, false) //Share state locks between replicas via DynamoDB. Otherwise they are shared by the processes of the node only
+	viper.SetDefault(misc.StateLockLeaseKey, 60)   //Seconds a state lock is held without renewal. The holder renews it three times per lease
+	viper.SetDefault(misc.ResumeQueuedTasksKey, true)
+	viper.SetDefault(misc.MaxConcurrencyKey, 0) //Zero means no global limit of concurrently running tasks
+	viper.SetDefault(misc.ConcurrencyLimitsKey, map[string]int{})
+	viper.SetDefault(misc.ShutdownGraceKey, 1800) //Seconds to wait for running tasks on shutdown before cancelling them
+	viper.SetDefault(misc.InterruptGraceKey, 30)  //Seconds a cancelled or timed out process group has after interrupt signal before it gets killed
 	viper.SetDefault(misc.WebhookWaitTimeoutKey, 180)
+	viper.SetDefault(misc.OpenTaskExpiryKey, 3600)   //Seconds an open task waits for its webhook before it expires. Zero disables expiration
+	viper.SetDefault(misc.IdempotencyTTLKey, 86400)  //Seconds a retry with the same idempotency key gets the task created by the first request
+	viper.SetDefault(misc.TaskRetentionKey, 2592000) //Seconds to keep records of the completed tasks. Zero keeps them forever
 	viper.SetDefault(misc.SkipPullFastForward, true) //TODO: set it to false when wtf is ready for fast forward pull of the branch
 	viper.SetDefault(misc.GitHubDownload, true)
+	viper.SetDefault(misc.DriftChecksKey, []interface{}{})         //List of scheduled plans of env/layers (schedule, location, repo_sources, branch, timeout)
+	viper.SetDefault(misc.PullRequestChecksKey, []interface{}{})   //Apply -> Push flow configuration per repository (repository, locations, repo_sources, timeout)
+	viper.SetDefault(misc.WebhookWaitPolicyKey, "lenient")         //What to do with a task, which webhook has not come in time: strict, lenient or poll
+	viper.SetDefault(misc.WebhookPoliciesKey, map[string]string{}) //Webhook wait policies per repository full name
+	viper.SetDefault(misc.EnvAllowKey, []string{"PATH", "HOME", "USER", "SHELL", "LANG", "LC_*", "TZ", "TMPDIR", "TERM", "SSL_CERT_*",
+		"*_PROXY", "*_proxy", "GEM_*", "BUNDLE_*", "TF_*"}) //Patterns of the server environment variables passed to the tasks
+	viper.SetDefault(misc.EnvVarsListKey, []string{"TFRESDIF_NOPB=true", "NOTIFY_TFCHEK=false"}) //NAME=value variables of every task
+	viper.SetDefault(misc.EnvSetsKey, []interface{}{})                                           //Variable sets per env/layer (locations, vars, aws_account)
+	viper.SetDefault(misc.AWSAccountsKey, map[string]interface{}{})                              //AWS credentials per account name (access_key_id, secret_access_key, session_token, profile, region)
+	viper.SetDefault(misc.ExecutionBackendKey, "local")                                          //Where task processes run: local, docker or kubernetes
+	viper.SetDefault(misc.BackendImageKey, "")                                                   //Image of the docker and kubernetes backends. It has to contain the tools the tasks run
+	viper.SetDefault(misc.DockerCommandKey, "docker")
+	viper.SetDefault(misc.DockerArgsKey, []string{}) //Extra arguments of docker run, e.g. --network or --memory
+	viper.SetDefault(misc.KubeApiKey, "")            //Kubernetes API URL. In-cluster service is used if it is empty
+	viper.SetDefault(misc.KubeNamespaceKey, "default")
+	viper.SetDefault(misc.KubeTokenFileKey, "/var/run/secrets/kubernetes.io/serviceaccount/token")
+	viper.SetDefault(misc.KubeCAFileKey, "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt")
+	viper.SetDefault(misc.KubeVolumeClaimKey, "") //Persistent volume claim mounted at workspace_dir of the server
 	viper.SetEnvPrefix(misc.EnvPrefix)
 	viper.AutomaticEnv()
 	viper.SetConfigName(misc.APPNAME)
@@ -91,6 +138,13 @@ func setupRoutes() *mux.Router {
 	router.Path(misc.APIRUNSH).Methods(http.MethodPost).Name("run.sh universal task accepting endpoint").HandlerFunc(api.RunShPost)
 	router.Path(misc.API2RUNSH).Methods(http.MethodPost).Name("run.sh universal task accepting endpoint").HandlerFunc(api.RunShPost)
 	router.Path(misc.APIWTF).Methods(http.MethodPost).Name("wtf task accepting endpoint").HandlerFunc(api.WtfPost)
+	router.Path(misc.APITERRAFORM).Methods(http.MethodPost).Name("terraform task accepting endpoint").HandlerFunc(api.TerraformPost)
+	router.Path(misc.APITASKS).Methods(http.MethodGet).Name("Task list").HandlerFunc(api.ListTasks)
+	router.Path(misc.APITASKS + "/" + api.FormatIdParam()).Methods(http.MethodGet).Name("Task details").HandlerFunc(api.GetTask)
+	router.Path(misc.APITASKS + "/" + api.FormatIdParam() + "/output").Methods(http.MethodGet).Name("Task output lines").HandlerFunc(api.GetTaskOutput)
+	router.Path(misc.APITASKS + "/" + api.FormatIdParam() + "/rerun").Methods(http.MethodPost).Name("Task re-run").HandlerFunc(api.RerunTask)
+	router.Path(misc.APILOCKS).Methods(http.MethodGet).Name("State locks").HandlerFunc(api.ListStateLocks)
+	router.Path(misc.APILOCKS + "/{" + misc.LockNameParam + ":.+}").Methods(http.MethodDelete).Name("Break state lock").Handler(middleware.Auth(http.HandlerFunc(api.BreakStateLock)))
 	router.Path(misc.APICANCEL + api.FormatIdParam()).Methods(http.MethodGet).Name("Cancel").HandlerFunc(api.Cancel)
 	router.Path(misc.APIDELETEBRANCH + "{id}").Methods(http.MethodDelete).Name("DeleteBranch").HandlerFunc(api.DeleteCIBranch)
 	router.Path(misc.APICLEANUPBRANCH).Methods(http.MethodPost).Name("Clean-up branches").HandlerFunc(api.Cleanupbranches)
@@ -136,6 +190,10 @@ func initialize() {
 	tm := launcher.GetTaskManager()
 	fmt.Println("Starting task manager")
 	go tm.Start()
+	err := scheduler.Start(tm)
+	if err != nil {
+		log.Printf("Cannot start drift checks. Error: %s", err)
+	}
 }
 
 func showVersion() {
@@ -149,9 +207,56 @@ func getVersion() string {
 func main() {
 	log.Printf("Starting tfChek version: %s", getVersion())
 	initialize()
-	defer launcher.GetTaskManager().Close()
-	defer github.CloseAll()
 	fmt.Println("Starting server")
 	router := setupRoutes()
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", viper.GetInt(misc.PortKey)), router))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", viper.GetInt(misc.PortKey)), Handler: router}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	exitCode := 0
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s signal", sig)
+	case err := <-serverErr:
+		log.Printf("Server has stopped. Error: %s", err)
+		exitCode = 1
+	}
+	if !shutdown(server) {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+//shutdown stops accepting requests, waits for the running tasks and reports results of the finished ones to GitHub
+func shutdown(server *http.Server) bool {
+	graceful := true
+	sctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(sctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Cannot shut down server gracefully. Error: %s", err)
+	}
+	//No new drift checks should be queued while the task manager is stopping
+	scheduler.Stop()
+	grace := time.Duration(viper.GetInt(misc.ShutdownGraceKey)) * time.Second
+	log.Printf("Waiting up to %s for the running tasks", grace)
+	tctx, tcancel := context.WithTimeout(context.Background(), grace)
+	defer tcancel()
+	err = launcher.GetTaskManager().Shutdown(tctx)
+	if err != nil {
+		log.Printf("Task manager has not been shut down gracefully. Error: %s", err)
+		graceful = false
+	}
+	gctx, gcancel := context.WithTimeout(context.Background(), gitHubFlushTimeout)
+	defer gcancel()
+	err = github.FlushAll(gctx)
+	if err != nil {
+		log.Printf("Not all the task results have been reported to GitHub. Error: %s", err)
+		graceful = false
+	}
+	log.Println("tfChek has been stopped")
+	return graceful
 }
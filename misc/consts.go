@@ -8,6 +8,7 @@ const (
 	FAILED            //Task failed
 	TIMEOUT           //Task failed to finish in time
 	DONE              //Task completed
+	CANCELLED         //Task has been cancelled by a user
 )
 
 const (
@@ -17,6 +18,7 @@ const (
 	AwsAccessKeyVar    = "AWS_ACCESS_KEY_ID"
 	AwsSecretKeyVar    = "AWS_SECRET_ACCESS_KEY"
 	NotifyTfChekEnvVar = "NOTIFY_TFCHEK"
+	FencingTokenEnvVar = "TFCHEK_FENCING_TOKEN"
 	OutDirKey          = "out_dir"
 	DebugKey           = "debug"
 	PortKey            = "port"
@@ -36,6 +38,9 @@ const (
 	CertSourceKey         = "certs_source"
 	LambdaSourceKey       = "lambdas_source"
 	RunDirKey             = "run_dir"
+	WorkspaceDirKey       = "workspace_dir"
+	WorkspaceRetentionKey = "workspace_retention"
+	WorkspaceHardlinksKey = "workspace_hardlinks"
 	RunshExe              = "run.sh"
 	WtfExe                = "wtf"
 	GitHubDownload        = "github_download"
@@ -51,7 +56,38 @@ const (
 	AWSSecretKey          = "aws_secret_key"
 	AWSSequenceTable      = "aws_sequence_table"
 	UseExternalSequence   = "use_external_sequence"
+	AWSTaskTable          = "aws_task_table"
+	UseExternalTaskStore  = "use_external_task_store"
+	AWSLockTable          = "aws_lock_table"
+	AWSKeyTable           = "aws_key_table"
+	IdempotencyTTLKey     = "idempotency_ttl"
+	UseExternalLocks      = "use_external_state_locks"
+	StateLockLeaseKey     = "state_lock_lease"
+	ResumeQueuedTasksKey  = "resume_queued_tasks"
+	MaxConcurrencyKey     = "max_concurrency"
+	ConcurrencyLimitsKey  = "concurrency_limits"
+	ShutdownGraceKey      = "shutdown_grace"
+	InterruptGraceKey     = "interrupt_grace"
 	WebhookWaitTimeoutKey = "webhook_timeout"
+	WebhookWaitPolicyKey  = "webhook_wait_policy"
+	WebhookPoliciesKey    = "webhook_wait_policies"
+	DriftChecksKey        = "drift_checks"
+	PullRequestChecksKey  = "pull_request_checks"
+	OpenTaskExpiryKey     = "open_task_expiry"
+	TaskRetentionKey      = "task_retention"
+	EnvAllowKey           = "env_allow"
+	EnvVarsListKey        = "env_vars"
+	EnvSetsKey            = "env_sets"
+	AWSAccountsKey        = "aws_accounts"
+	ExecutionBackendKey   = "execution_backend"
+	BackendImageKey       = "backend_image"
+	DockerCommandKey      = "docker_command"
+	DockerArgsKey         = "docker_args"
+	KubeApiKey            = "kubernetes_api"
+	KubeNamespaceKey      = "kubernetes_namespace"
+	KubeTokenFileKey      = "kubernetes_token_file"
+	KubeCAFileKey         = "kubernetes_ca_file"
+	KubeVolumeClaimKey    = "kubernetes_volume_claim"
 	GitSectionRemote      = "remote"
 	GitSectionBranch      = "branch"
 	GitSectionOptionFetch = "fetch"
@@ -62,11 +98,16 @@ const (
 	IssueLabelDesc        = "tfChek managed issue"
 	IssueAllFilter        = "all"
 	IdParam               = "id"
+	LockNameParam         = "name"
+	ApiForceKey           = "force"
 	ApiMergeKey           = "merged"
 	ApiBeforeKey          = "before"
+	ApiFormatKey          = "format"
+	OutputFormatLines     = "lines"
 	ContentTypeKey        = "Content-Type"
 	ContentTypeJson       = "application/json"
 	ContentTypeMarkdown   = "text/markdown"
+	IdempotencyKeyHeader  = "Idempotency-Key"
 )
 
 const (
@@ -81,6 +122,7 @@ const (
 	APPNAME          = "tfChek"
 	runshchunk       = "runsh/"
 	wtfchunk         = "wtf/"
+	terraformchunk   = "terraform/"
 	hash512Query     = runshchunk + "by-sha512/"
 	APIV1            = "/api/v1/"
 	APIV2            = "/api/v2/"
@@ -90,6 +132,9 @@ const (
 	APIDELETEBRANCH  = APIV2 + "delete/branch/"
 	APICLEANUPBRANCH = APIV2 + "cleanup"
 	APIWTF           = APIV2 + wtfchunk
+	APITERRAFORM     = APIV2 + terraformchunk
+	APITASKS         = APIV2 + "tasks"
+	APILOCKS         = APIV2 + "locks"
 	API2RUNSH        = APIV2 + runshchunk
 	WEBSOCKETPATH    = "/ws/"
 	WSRUNSH          = WEBSOCKETPATH + runshchunk
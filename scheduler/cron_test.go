@@ -0,0 +1,64 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr bool
+	}{
+		{"Every minute", "* * * * *", false},
+		{"Nightly", "0 3 * * *", false},
+		{"Lists ranges and steps", "0,30 */4 1-15 1-12/2 *", false},
+		{"Day names", "0 0 * * mon", true},
+		{"Working days", "15 9 * * 1-5", false},
+		{"Sunday as seven", "0 0 * * 7", false},
+		{"Too few fields", "0 3 * *", true},
+		{"Out of range", "60 * * * *", true},
+		{"Reversed range", "* 5-1 * * *", true},
+		{"Zero step", "*/0 * * * *", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSchedule(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchedule_Next(t *testing.T) {
+	//Wednesday
+	from := time.Date(2020, time.January, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{"Every minute", "* * * * *", time.Date(2020, time.January, 15, 10, 21, 0, 0, time.UTC)},
+		{"Later today", "0 12 * * *", time.Date(2020, time.January, 15, 12, 0, 0, 0, time.UTC)},
+		{"Tomorrow", "0 3 * * *", time.Date(2020, time.January, 16, 3, 0, 0, 0, time.UTC)},
+		{"Every quarter of hour", "*/15 * * * *", time.Date(2020, time.January, 15, 10, 30, 0, 0, time.UTC)},
+		{"Sunday", "0 0 * * 7", time.Date(2020, time.January, 19, 0, 0, 0, 0, time.UTC)},
+		{"Next month", "0 0 1 * *", time.Date(2020, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"Either day of month or Friday", "0 0 20 * 5", time.Date(2020, time.January, 17, 0, 0, 0, 0, time.UTC)},
+		{"Leap day", "0 0 29 2 *", time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"Never", "0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseSchedule() error = %v", err)
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/launcher"
+	"github.com/wix-playground/tfChek/misc"
+	"log"
+	"sync"
+	"time"
+)
+
+var scheduler *Scheduler
+var sl sync.Mutex
+
+//Scheduler launches drift checks through the task manager queue at the times of their schedules
+type Scheduler struct {
+	entries []*entry
+	launch  func(check *launcher.DriftCheck) (launcher.Task, error)
+	//claim tells if the run scheduled at the time is launched by this replica
+	claim func(check *launcher.DriftCheck, scheduled, next time.Time) (bool, error)
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type entry struct {
+	check    launcher.DriftCheck
+	schedule *Schedule
+	next     time.Time
+	//last is the latest task of the check. A new one is not launched while it is active
+	last launcher.Task
+}
+
+//NewScheduler validates the drift checks. Tasks are added to the given task manager
+func NewScheduler(tm launcher.TaskManager, checks []launcher.DriftCheck) (*Scheduler, error) {
+	s := &Scheduler{launch: func(check *launcher.DriftCheck) (launcher.Task, error) {
+		return launcher.AddDriftTask(tm, check)
+	}, claim: launcher.ClaimDriftRun}
+	for i := range checks {
+		c := checks[i]
+		if c.Location == "" {
+			return nil, fmt.Errorf("drift check #%d has no location", i)
+		}
+		if len(c.RepoSources) == 0 {
+			return nil, fmt.Errorf("drift check of %s has no repositories", c.Location)
+		}
+		schedule, err := ParseSchedule(c.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("drift check of %s has wrong schedule. Error: %w", c.Location, err)
+		}
+		s.entries = append(s.entries, &entry{check: c, schedule: schedule})
+	}
+	return s, nil
+}
+
+//Start runs the configured drift checks until Stop is called. Nothing is done if no checks are configured
+func Start(tm launcher.TaskManager) error {
+	var checks []launcher.DriftCheck
+	err := viper.UnmarshalKey(misc.DriftChecksKey, &checks)
+	if err != nil {
+		return fmt.Errorf("cannot read drift checks configuration. Error: %w", err)
+	}
+	if len(checks) == 0 {
+		misc.Debug("no drift checks are configured")
+		return nil
+	}
+	s, err := NewScheduler(tm, checks)
+	if err != nil {
+		return err
+	}
+	sl.Lock()
+	defer sl.Unlock()
+	if scheduler != nil {
+		return fmt.Errorf("drift checks scheduler has been started already")
+	}
+	scheduler = s
+	s.Start(time.Now())
+	log.Printf("Drift checks scheduler has been started with %d checks", len(checks))
+	return nil
+}
+
+//Stop stops the started scheduler. Already launched checks are left to the task manager
+func Stop() {
+	sl.Lock()
+	defer sl.Unlock()
+	if scheduler != nil {
+		scheduler.Stop()
+		scheduler = nil
+	}
+}
+
+func (s *Scheduler) Start(now time.Time) {
+	for _, e := range s.entries {
+		e.next = e.schedule.Next(now)
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.loop()
+}
+
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Scheduler) loop() {
+	defer close(s.done)
+	for {
+		next := s.nextRun()
+		if next.IsZero() {
+			log.Printf("Drift checks will never run again")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			s.runDue(now)
+		}
+	}
+}
+
+func (s *Scheduler) nextRun() time.Time {
+	var next time.Time
+	for _, e := range s.entries {
+		if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+			next = e.next
+		}
+	}
+	return next
+}
+
+//runDue launches all the checks, which time has come, and moves them to their next run.
+//Every replica runs the scheduler, so the run is launched by the one, which claims it first
+func (s *Scheduler) runDue(now time.Time) {
+	for _, e := range s.entries {
+		if e.next.IsZero() || e.next.After(now) {
+			continue
+		}
+		scheduled := e.next
+		e.next = e.schedule.Next(now)
+		if e.last != nil && !launcher.IsCompleted(e.last) {
+			log.Printf("Skipping drift check of %s, because the previous task %d is still %s", e.check.Location, e.last.GetId(), launcher.GetStatusString(e.last.GetStatus()))
+			continue
+		}
+		claimed, err := s.claim(&e.check, scheduled, e.next)
+		if err != nil {
+			log.Printf("Skipping drift check of %s, because it cannot be claimed. Error: %s", e.check.Location, err)
+			continue
+		}
+		if !claimed {
+			misc.Debugf("drift check of %s scheduled at %s has been launched by another replica", e.check.Location, scheduled)
+			continue
+		}
+		t, err := s.launch(&e.check)
+		if err != nil {
+			log.Printf("Cannot launch drift check of %s. Error: %s", e.check.Location, err)
+		}
+		if t != nil {
+			e.last = t
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"github.com/wix-playground/tfChek/launcher"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler_runDueOnce(t *testing.T) {
+	checks := []launcher.DriftCheck{
+		{Schedule: "0 * * * *", Location: "production/eu", RepoSources: []string{"git@github.com:wix-system/production.git"}},
+		{Schedule: "30 * * * *", Location: "staging/us", RepoSources: []string{"git@github.com:wix-system/staging.git"}},
+	}
+	var mu sync.Mutex
+	claimed := make(map[string]bool)
+	launched := make(map[string]int)
+	//Replicas share the claims like they share the state lock store
+	claim := func(check *launcher.DriftCheck, scheduled, next time.Time) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := check.Location + "@" + scheduled.String()
+		if claimed[key] {
+			return false, nil
+		}
+		claimed[key] = true
+		return true, nil
+	}
+	launch := func(check *launcher.DriftCheck) (launcher.Task, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		launched[check.Location]++
+		return nil, nil
+	}
+	start := time.Date(2020, 5, 1, 10, 10, 0, 0, time.UTC)
+	var replicas []*Scheduler
+	for i := 0; i < 3; i++ {
+		s, err := NewScheduler(nil, checks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.launch, s.claim = launch, claim
+		for _, e := range s.entries {
+			e.next = e.schedule.Next(start)
+		}
+		replicas = append(replicas, s)
+	}
+	//Replicas fire a bit apart, but still run the same schedule
+	for i, s := range replicas {
+		s.runDue(time.Date(2020, 5, 1, 11, 0, i, 0, time.UTC))
+	}
+	want := map[string]int{"staging/us": 1, "production/eu": 1}
+	for location, n := range want {
+		if launched[location] != n {
+			t.Errorf("drift check of %s launched %d times, want %d", location, launched[location], n)
+		}
+	}
+	for i, s := range replicas {
+		s.runDue(time.Date(2020, 5, 1, 11, 30, i, 0, time.UTC))
+	}
+	want["staging/us"] = 2
+	for location, n := range want {
+		if launched[location] != n {
+			t.Errorf("drift check of %s launched %d times, want %d", location, launched[location], n)
+		}
+	}
+}
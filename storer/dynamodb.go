@@ -312,3 +312,62 @@ func getSequence(name string) (int, error) {
 		return -1, errors.New("sequence field is absent")
 	}
 }
+
+//DynamoDBSequence increments the sequence item in place, so the replicas never get the same value
+type DynamoDBSequence struct {
+	table string
+}
+
+func NewDynamoDBSequence(table string) *DynamoDBSequence {
+	return &DynamoDBSequence{table: table}
+}
+
+func (d *DynamoDBSequence) update(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	input.TableName = aws.String(d.table)
+	input.Key = map[string]*dynamodb.AttributeValue{SEQUENCENAMEKEY: {S: aws.String(SEQUENCENAME)}}
+	input.ExpressionAttributeNames = map[string]*string{"#seq": aws.String(SEQUENCEKEY)}
+	result, err := svc.UpdateItem(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	return result, nil
+}
+
+func (d *DynamoDBSequence) Next() (int, error) {
+	result, err := d.update(&dynamodb.UpdateItemInput{
+		UpdateExpression:          aws.String("ADD #seq :one"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}},
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot increment sequence. Error: %w", err)
+	}
+	seqItem, ok := result.Attributes[SEQUENCEKEY]
+	if !ok || seqItem.N == nil {
+		return 0, errors.New("sequence field is absent")
+	}
+	seq, err := strconv.Atoi(*seqItem.N)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert value %s to integer. Error: %w", *seqItem.N, err)
+	}
+	return seq, nil
+}
+
+//advance sets the sequence to the value unless it is already greater
+func (d *DynamoDBSequence) advance(seq int) error {
+	_, err := d.update(&dynamodb.UpdateItemInput{
+		UpdateExpression:          aws.String("SET #seq = :seq"),
+		ConditionExpression:       aws.String("attribute_not_exists(#seq) OR #seq < :seq"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":seq": {N: aws.String(strconv.Itoa(seq))}},
+	})
+	if err != nil && !isConditionFailed(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package storer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Attributes of the state lock items. Times are kept as unix milliseconds to be compared in conditions
+const (
+	LOCKNAMEKEY     = "name"
+	lockOwnerKey    = "owner"
+	lockTaskKey     = "task_id"
+	lockTokenKey    = "token"
+	lockAcquiredKey = "acquired"
+	lockExpiresKey  = "expires"
+)
+
+//DynamoDBStateLocker keeps state locks in the DynamoDB table next to the sequence table.
+//Every change is a conditional write, so the replicas never hold the same lock at once
+type DynamoDBStateLocker struct {
+	table string
+}
+
+func NewDynamoDBStateLocker(table string) *DynamoDBStateLocker {
+	return &DynamoDBStateLocker{table: table}
+}
+
+func EnsureLockTable() error {
+	tableName := viper.GetString(misc.AWSLockTable)
+	exists, err := listSequenceTable(tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return createLockTable(tableName)
+	}
+	return nil
+}
+
+func createLockTable(name string) error {
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	svc := dynamodb.New(s)
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(LOCKNAMEKEY),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(LOCKNAMEKEY),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		TableName:   aws.String(name),
+	}
+	_, err = svc.CreateTable(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return err
+	}
+	err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	if err != nil {
+		misc.Debugf("Failed to wait until table exists. Error: %s", err)
+		return err
+	}
+	return nil
+}
+
+//lockAttributeNames are placeholders of the attributes, some of them are reserved words
+var lockAttributeNames = map[string]*string{
+	"#owner":    aws.String(lockOwnerKey),
+	"#task":     aws.String(lockTaskKey),
+	"#token":    aws.String(lockTokenKey),
+	"#acquired": aws.String(lockAcquiredKey),
+	"#expires":  aws.String(lockExpiresKey),
+}
+
+func (d *DynamoDBStateLocker) update(name, update, condition string, values map[string]*dynamodb.AttributeValue, returnNew bool) (map[string]*dynamodb.AttributeValue, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	names := make(map[string]*string)
+	for k, v := range lockAttributeNames {
+		//DynamoDB rejects unused placeholders
+		if strings.Contains(update, k) || strings.Contains(condition, k) {
+			names[k] = v
+		}
+	}
+	input := &dynamodb.UpdateItemInput{
+		Key:                       map[string]*dynamodb.AttributeValue{LOCKNAMEKEY: {S: aws.String(name)}},
+		TableName:                 aws.String(d.table),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	if returnNew {
+		input.ReturnValues = aws.String(dynamodb.ReturnValueAllNew)
+	}
+	result, err := svc.UpdateItem(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	return result.Attributes, nil
+}
+
+func (d *DynamoDBStateLocker) Acquire(name, owner string, taskId int, lease time.Duration) (*StateLockRecord, error) {
+	now := time.Now()
+	item, err := d.update(name,
+		"SET #owner = :owner, #task = :task, #acquired = :now, #expires = :expires ADD #token :one",
+		"attribute_not_exists(#owner) OR #owner = :free OR #expires <= :now",
+		map[string]*dynamodb.AttributeValue{
+			":owner":   {S: aws.String(owner)},
+			":task":    {N: aws.String(strconv.Itoa(taskId))},
+			":now":     unixMillis(now),
+			":expires": unixMillis(now.Add(lease)),
+			":one":     {N: aws.String("1")},
+			":free":    {S: aws.String("")},
+		}, true)
+	if err != nil {
+		if isConditionFailed(err) {
+			return nil, fmt.Errorf("%s is held by another task %w", name, ErrStateLocked)
+		}
+		return nil, err
+	}
+	return lockRecord(item)
+}
+
+func (d *DynamoDBStateLocker) Renew(lock *StateLockRecord, lease time.Duration) error {
+	expires := time.Now().Add(lease)
+	_, err := d.update(lock.Name, "SET #expires = :expires", "#owner = :owner AND #token = :token",
+		map[string]*dynamodb.AttributeValue{
+			":expires": unixMillis(expires),
+			":owner":   {S: aws.String(lock.Owner)},
+			":token":   {N: aws.String(strconv.FormatInt(lock.Token, 10))},
+		}, false)
+	if err != nil {
+		if isConditionFailed(err) {
+			return fmt.Errorf("%s token %d %w", lock.Name, lock.Token, ErrStateLockLost)
+		}
+		return err
+	}
+	lock.Expires = expires
+	return nil
+}
+
+func (d *DynamoDBStateLocker) Release(lock *StateLockRecord) error {
+	_, err := d.update(lock.Name, "SET #owner = :free, #task = :zero, #expires = :zero", "#owner = :owner AND #token = :token",
+		map[string]*dynamodb.AttributeValue{
+			":free":  {S: aws.String("")},
+			":zero":  {N: aws.String("0")},
+			":owner": {S: aws.String(lock.Owner)},
+			":token": {N: aws.String(strconv.FormatInt(lock.Token, 10))},
+		}, false)
+	if err != nil && isConditionFailed(err) {
+		return fmt.Errorf("%s token %d %w", lock.Name, lock.Token, ErrStateLockLost)
+	}
+	return err
+}
+
+func (d *DynamoDBStateLocker) List() ([]*StateLockRecord, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	var locks []*StateLockRecord
+	var parseErr error
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(d.table),
+		ConsistentRead:            aws.Bool(true),
+		FilterExpression:          aws.String("#owner <> :free"),
+		ExpressionAttributeNames:  map[string]*string{"#owner": aws.String(lockOwnerKey)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":free": {S: aws.String("")}},
+	}
+	err = svc.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			lock, err := lockRecord(item)
+			if err != nil {
+				parseErr = err
+				return false
+			}
+			locks = append(locks, lock)
+		}
+		return true
+	})
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks, nil
+}
+
+func (d *DynamoDBStateLocker) Break(name string, force bool) error {
+	condition := "attribute_exists(#owner) AND #owner <> :free"
+	values := map[string]*dynamodb.AttributeValue{
+		":free": {S: aws.String("")},
+		":zero": {N: aws.String("0")},
+	}
+	if !force {
+		condition += " AND #expires <= :now"
+		values[":now"] = unixMillis(time.Now())
+	}
+	_, err := d.update(name, "SET #owner = :free, #task = :zero, #expires = :zero", condition, values, false)
+	if err == nil || !isConditionFailed(err) {
+		return err
+	}
+	if force {
+		return fmt.Errorf("%s %w", name, ErrStateLockNotFound)
+	}
+	//The condition does not tell the free lock from the live one
+	lock, err := d.get(name)
+	if err != nil {
+		return err
+	}
+	if lock == nil || lock.Owner == "" {
+		return fmt.Errorf("%s %w", name, ErrStateLockNotFound)
+	}
+	return fmt.Errorf("%s is renewed by %s %w", name, lock.Owner, ErrStateLockHeld)
+}
+
+func (d *DynamoDBStateLocker) get(name string) (*StateLockRecord, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key:            map[string]*dynamodb.AttributeValue{LOCKNAMEKEY: {S: aws.String(name)}},
+		TableName:      aws.String(d.table),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	return lockRecord(result.Item)
+}
+
+func lockRecord(item map[string]*dynamodb.AttributeValue) (*StateLockRecord, error) {
+	lock := &StateLockRecord{}
+	if v, ok := item[LOCKNAMEKEY]; ok && v.S != nil {
+		lock.Name = *v.S
+	}
+	if v, ok := item[lockOwnerKey]; ok && v.S != nil {
+		lock.Owner = *v.S
+	}
+	numbers := map[string]*int64{lockTaskKey: new(int64), lockTokenKey: &lock.Token, lockAcquiredKey: new(int64), lockExpiresKey: new(int64)}
+	for k, n := range numbers {
+		v, ok := item[k]
+		if !ok || v.N == nil {
+			continue
+		}
+		parsed, err := strconv.ParseInt(*v.N, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %s of state lock %s Error: %w", k, lock.Name, err)
+		}
+		*n = parsed
+	}
+	lock.TaskId = int(*numbers[lockTaskKey])
+	lock.Acquired = fromUnixMillis(*numbers[lockAcquiredKey])
+	lock.Expires = fromUnixMillis(*numbers[lockExpiresKey])
+	return lock, nil
+}
+
+func unixMillis(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
+
+func fromUnixMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func isConditionFailed(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
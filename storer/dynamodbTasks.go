@@ -0,0 +1,387 @@
+package storer
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const TASKIDKEY = "id"
+
+//Attributes of the idempotency key items. Expiration is kept in unix seconds, so DynamoDB removes expired keys itself
+const (
+	KEYNAMEKEY    = "key"
+	keyTaskKey    = "task_id"
+	keyExpiresKey = "expires"
+)
+
+//DynamoDBTaskStore keeps task records in the DynamoDB table next to the sequence table.
+//Idempotency keys are kept in their own table, so the retried requests are deduplicated by all the replicas
+type DynamoDBTaskStore struct {
+	table    string
+	keyTable string
+}
+
+func NewDynamoDBTaskStore(table, keyTable string) *DynamoDBTaskStore {
+	return &DynamoDBTaskStore{table: table, keyTable: keyTable}
+}
+
+func EnsureTaskTable() error {
+	tableName := viper.GetString(misc.AWSTaskTable)
+	exists, err := listSequenceTable(tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return createTaskTable(tableName)
+	}
+	return nil
+}
+
+func EnsureKeyTable() error {
+	tableName := viper.GetString(misc.AWSKeyTable)
+	exists, err := listSequenceTable(tableName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return createKeyTable(tableName)
+	}
+	return nil
+}
+
+func createKeyTable(name string) error {
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	svc := dynamodb.New(s)
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(KEYNAMEKEY),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeS),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(KEYNAMEKEY),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		TableName:   aws.String(name),
+	}
+	_, err = svc.CreateTable(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return err
+	}
+	err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	if err != nil {
+		misc.Debugf("Failed to wait until table exists. Error: %s", err)
+		return err
+	}
+	//Conditions check the expiration anyway, the removal only keeps the table small
+	_, err = svc.UpdateTimeToLive(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(name),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(keyExpiresKey),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		debugDynamoDBError(err)
+		misc.Debugf("cannot enable expiration of idempotency keys in %s. Error: %s", name, err)
+	}
+	return nil
+}
+
+func createTaskTable(name string) error {
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	svc := dynamodb.New(s)
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String(TASKIDKEY),
+				AttributeType: aws.String(dynamodb.ScalarAttributeTypeN),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(TASKIDKEY),
+				KeyType:       aws.String(dynamodb.KeyTypeHash),
+			},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		TableName:   aws.String(name),
+	}
+	_, err = svc.CreateTable(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return err
+	}
+	err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+	if err != nil {
+		misc.Debugf("Failed to wait until table exists. Error: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (d *DynamoDBTaskStore) Save(record *TaskRecord) error {
+	if record == nil {
+		return fmt.Errorf("cannot save nil task record")
+	}
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	item, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return fmt.Errorf("cannot serialize task %d record. Error: %w", record.Id, err)
+	}
+	svc := dynamodb.New(s)
+	_, err = svc.PutItem(&dynamodb.PutItemInput{Item: item, TableName: aws.String(d.table)})
+	if err != nil {
+		debugDynamoDBError(err)
+		return err
+	}
+	return nil
+}
+
+func (d *DynamoDBTaskStore) Load(id int) (*TaskRecord, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	input := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			TASKIDKEY: {N: aws.String(strconv.Itoa(id))},
+		},
+		TableName:      aws.String(d.table),
+		ConsistentRead: aws.Bool(true),
+	}
+	result, err := svc.GetItem(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("task %d record is absent %w", id, ErrTaskRecordNotFound)
+	}
+	var record TaskRecord
+	err = dynamodbattribute.UnmarshalMap(result.Item, &record)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse task %d record. Error: %w", id, err)
+	}
+	return &record, nil
+}
+
+func (d *DynamoDBTaskStore) List() ([]*TaskRecord, error) {
+	s, err := getSession()
+	if err != nil {
+		return nil, err
+	}
+	svc := dynamodb.New(s)
+	var records []*TaskRecord
+	var parseErr error
+	err = svc.ScanPages(&dynamodb.ScanInput{TableName: aws.String(d.table), ConsistentRead: aws.Bool(true)},
+		func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			var chunk []*TaskRecord
+			parseErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &chunk)
+			if parseErr != nil {
+				return false
+			}
+			records = append(records, chunk...)
+			return true
+		})
+	if err != nil {
+		debugDynamoDBError(err)
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("cannot parse task records. Error: %w", parseErr)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	return records, nil
+}
+
+func (d *DynamoDBTaskStore) Delete(id int) error {
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	svc := dynamodb.New(s)
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			TASKIDKEY: {N: aws.String(strconv.Itoa(id))},
+		},
+		TableName: aws.String(d.table),
+	}
+	_, err = svc.DeleteItem(input)
+	if err != nil {
+		debugDynamoDBError(err)
+		return err
+	}
+	return nil
+}
+
+//Prune removes the records one by one. Expired idempotency keys are removed by DynamoDB itself
+func (d *DynamoDBTaskStore) Prune(before time.Time) (int, error) {
+	s, err := getSession()
+	if err != nil {
+		return 0, err
+	}
+	svc := dynamodb.New(s)
+	//Only the fields needed to decide are read, definitions and run records may be large
+	var candidates []*TaskRecord
+	var parseErr error
+	err = svc.ScanPages(&dynamodb.ScanInput{
+		TableName:                aws.String(d.table),
+		ProjectionExpression:     aws.String("#id, #status, #updated"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String(TASKIDKEY), "#status": aws.String("status"), "#updated": aws.String("updated")},
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		var chunk []*TaskRecord
+		parseErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &chunk)
+		if parseErr != nil {
+			return false
+		}
+		candidates = append(candidates, chunk...)
+		return true
+	})
+	if err != nil {
+		debugDynamoDBError(err)
+		return 0, err
+	}
+	if parseErr != nil {
+		return 0, fmt.Errorf("cannot parse task records. Error: %w", parseErr)
+	}
+	pruned := 0
+	for _, r := range candidates {
+		if !prunable(r, before) {
+			continue
+		}
+		err := d.Delete(r.Id)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+//keyAttributeNames are placeholders of the attributes, key is a reserved word
+var keyAttributeNames = map[string]*string{
+	"#key":     aws.String(KEYNAMEKEY),
+	"#task":    aws.String(keyTaskKey),
+	"#expires": aws.String(keyExpiresKey),
+}
+
+func unixSeconds(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
+func (d *DynamoDBTaskStore) ClaimKey(key string, id int, ttl time.Duration) (int, bool, error) {
+	s, err := getSession()
+	if err != nil {
+		return 0, false, err
+	}
+	svc := dynamodb.New(s)
+	now := time.Now()
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(d.keyTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			KEYNAMEKEY:    {S: aws.String(key)},
+			keyTaskKey:    {N: aws.String(strconv.Itoa(id))},
+			keyExpiresKey: unixSeconds(now.Add(ttl)),
+		},
+		ConditionExpression:       aws.String("attribute_not_exists(#key) OR #expires <= :now"),
+		ExpressionAttributeNames:  map[string]*string{"#key": keyAttributeNames["#key"], "#expires": keyAttributeNames["#expires"]},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":now": unixSeconds(now)},
+	})
+	if err == nil {
+		return id, true, nil
+	}
+	if !isConditionFailed(err) {
+		debugDynamoDBError(err)
+		return 0, false, err
+	}
+	owner, err := d.LookupKey(key)
+	if err != nil {
+		return 0, false, fmt.Errorf("idempotency key has been claimed by another task, but cannot be read. Error: %w", err)
+	}
+	return owner, false, nil
+}
+
+func (d *DynamoDBTaskStore) LookupKey(key string) (int, error) {
+	s, err := getSession()
+	if err != nil {
+		return 0, err
+	}
+	svc := dynamodb.New(s)
+	result, err := svc.GetItem(&dynamodb.GetItemInput{
+		Key:            map[string]*dynamodb.AttributeValue{KEYNAMEKEY: {S: aws.String(key)}},
+		TableName:      aws.String(d.keyTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		debugDynamoDBError(err)
+		return 0, err
+	}
+	if result.Item == nil {
+		return 0, fmt.Errorf("%s %w", key, ErrKeyNotFound)
+	}
+	var k struct {
+		TaskId  int   `json:"task_id"`
+		Expires int64 `json:"expires"`
+	}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &k)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse idempotency key %s. Error: %w", key, err)
+	}
+	//Expired items are removed by DynamoDB with a delay
+	if k.Expires <= time.Now().Unix() {
+		return 0, fmt.Errorf("%s has expired %w", key, ErrKeyNotFound)
+	}
+	return k.TaskId, nil
+}
+
+func (d *DynamoDBTaskStore) ReleaseKey(key string, id int) error {
+	s, err := getSession()
+	if err != nil {
+		return err
+	}
+	svc := dynamodb.New(s)
+	_, err = svc.DeleteItem(&dynamodb.DeleteItemInput{
+		Key:                       map[string]*dynamodb.AttributeValue{KEYNAMEKEY: {S: aws.String(key)}},
+		TableName:                 aws.String(d.keyTable),
+		ConditionExpression:       aws.String("#task = :task"),
+		ExpressionAttributeNames:  map[string]*string{"#task": keyAttributeNames["#task"]},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":task": {N: aws.String(strconv.Itoa(id))}},
+	})
+	if err != nil && !isConditionFailed(err) {
+		debugDynamoDBError(err)
+		return err
+	}
+	return nil
+}
+
+func debugDynamoDBError(err error) {
+	if aerr, ok := err.(awserr.Error); ok {
+		misc.Debug(fmt.Sprint(aerr.Code(), aerr.Error()))
+	} else {
+		misc.Debug(err.Error())
+	}
+}
@@ -3,10 +3,19 @@ package storer
 import (
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/misc"
+	"os"
 	"testing"
 )
 
+//requireAWS skips tests which create real DynamoDB tables
+func requireAWS(t *testing.T) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" && os.Getenv("AWS_PROFILE") == "" && viper.GetString(misc.AWSAccessKey) == "" {
+		t.Skip("AWS credentials are not configured")
+	}
+}
+
 func Test_createSequenceTable(t *testing.T) {
+	requireAWS(t)
 	type args struct {
 		name string
 		wait bool
@@ -33,6 +42,7 @@ func Test_createSequenceTable(t *testing.T) {
 }
 
 func Test_listSequenceTable(t *testing.T) {
+	requireAWS(t)
 	type args struct {
 		name string
 	}
@@ -63,6 +73,7 @@ func Test_listSequenceTable(t *testing.T) {
 }
 
 func Test_updateSequence(t *testing.T) {
+	requireAWS(t)
 	type args struct {
 		seq  int
 		name string
@@ -92,6 +103,7 @@ func Test_updateSequence(t *testing.T) {
 }
 
 func Test_getSequence(t *testing.T) {
+	requireAWS(t)
 	type args struct {
 		name string
 	}
@@ -125,6 +137,7 @@ func Test_getSequence(t *testing.T) {
 }
 
 func Test_deleteSequenceTable(t *testing.T) {
+	requireAWS(t)
 	type args struct {
 		name string
 	}
@@ -1,14 +1,77 @@
 package storer
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/wix-system/tfResDif/v3/wtflog"
 	"io"
+	"sync"
+	"time"
 )
 
+//TaskFileSink writes both output streams to the task file as they are and to the lines file as tagged and timestamped lines
 type TaskFileSink struct {
-	out, err io.WriteCloser
+	out, err *streamWriter
 	tid      int
+	file     io.WriteCloser
+	lines    io.WriteCloser
+	encoder  *json.Encoder
+	mu       sync.Mutex
+	run      RunRecord
+	closed   bool
+}
+
+//streamWriter splits the stream into lines. An unfinished line is kept until it gets its end or the sink is closed
+type streamWriter struct {
+	sink    *TaskFileSink
+	stream  string
+	pending []byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	n, err := w.sink.file.Write(p)
+	if err != nil {
+		return n, err
+	}
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.sink.writeLine(w.stream, string(bytes.TrimSuffix(w.pending[:i], []byte("\r"))))
+		w.pending = w.pending[i+1:]
+	}
+	return n, nil
+}
+
+//Close only flushes the unfinished line, because the process launcher may close the streams of every process it runs
+func (w *streamWriter) Close() error {
+	w.sink.mu.Lock()
+	defer w.sink.mu.Unlock()
+	w.flush()
+	return nil
+}
+
+func (w *streamWriter) flush() {
+	if len(w.pending) > 0 {
+		w.sink.writeLine(w.stream, string(w.pending))
+		w.pending = nil
+	}
+}
+
+//writeLine has to be called under the sink lock
+func (f *TaskFileSink) writeLine(stream, text string) {
+	if f.closed {
+		return
+	}
+	err := f.encoder.Encode(&OutputLine{Time: time.Now(), Stream: stream, Step: len(f.run.Steps), Text: text})
+	if err != nil {
+		wtflog.GetLogger().Debugf("cannot write output line of task %d. Error: %s", f.tid, err)
+	}
 }
 
 func (f *TaskFileSink) GetStdErr() io.WriteCloser {
@@ -24,16 +87,61 @@ func (f *TaskFileSink) GetStdIn() io.Reader {
 	return nil
 }
 
+//StartStep starts a new step of the run. Lines written after it belong to the step
+func (f *TaskFileSink) StartStep(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.out.flush()
+	f.err.flush()
+	f.run.Steps = append(f.run.Steps, RunStep{Name: name, Started: time.Now()})
+	f.writeLine(StreamStep, name)
+}
+
+//FinishStep records how the process of the current step has exited
+func (f *TaskFileSink) FinishStep(exitCode *int, signal string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.run.Steps) == 0 {
+		return
+	}
+	f.out.flush()
+	f.err.flush()
+	now := time.Now()
+	step := &f.run.Steps[len(f.run.Steps)-1]
+	step.Finished = &now
+	step.ExitCode = exitCode
+	step.Signal = signal
+	f.run.ExitCode = exitCode
+	f.run.Signal = signal
+}
+
+//GetRunRecord returns a copy of the run record
+func (f *TaskFileSink) GetRunRecord() *RunRecord {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	run := f.run
+	run.Steps = append([]RunStep(nil), f.run.Steps...)
+	return &run
+}
+
 func (f *TaskFileSink) Close() {
-	err := f.out.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.out.flush()
+	f.err.flush()
+	now := time.Now()
+	f.run.Finished = &now
+	f.closed = true
+	err := f.file.Close()
 	if err != nil {
-		wtflog.GetLogger().Debugf("cannot close sink standard out for task %d", f.tid)
+		wtflog.GetLogger().Debugf("cannot close sink output for task %d", f.tid)
 	}
-	if f.err != f.out {
-		err = f.err.Close()
-		if err != nil {
-			wtflog.GetLogger().Debugf("cannot close sink standard err for task %d", f.tid)
-		}
+	err = f.lines.Close()
+	if err != nil {
+		wtflog.GetLogger().Debugf("cannot close sink output lines for task %d", f.tid)
 	}
 }
 
@@ -42,6 +150,17 @@ func NewTaskFileSink(taskId int) (*TaskFileSink, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a file sink for a task %d Error: %w", taskId, err)
 	}
-	fileSink := &TaskFileSink{tid: taskId, out: fout, err: fout}
-	return fileSink, err
+	flines, err := getTaskLinesWriteCloser(taskId)
+	if err != nil {
+		fout.Close()
+		return nil, fmt.Errorf("failed to create a file sink for a task %d Error: %w", taskId, err)
+	}
+	return newTaskFileSink(taskId, fout, flines), nil
+}
+
+func newTaskFileSink(taskId int, file, lines io.WriteCloser) *TaskFileSink {
+	fileSink := &TaskFileSink{tid: taskId, file: file, lines: lines, encoder: json.NewEncoder(lines), run: RunRecord{Started: time.Now()}}
+	fileSink.out = &streamWriter{sink: fileSink, stream: StreamStdout}
+	fileSink.err = &streamWriter{sink: fileSink, stream: StreamStderr}
+	return fileSink
 }
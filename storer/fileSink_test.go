@@ -0,0 +1,105 @@
+package storer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error {
+	return nil
+}
+
+func TestTaskFileSink(t *testing.T) {
+	type write struct {
+		stream string
+		data   string
+		//step is started before the write if it is set
+		step string
+	}
+	code := 2
+	tests := []struct {
+		name      string
+		writes    []write
+		finish    *int
+		wantFile  string
+		wantLines []string
+		wantSteps int
+	}{
+		{name: "streams",
+			writes:    []write{{stream: StreamStdout, data: "one\ntwo\n"}, {stream: StreamStderr, data: "three\n"}},
+			wantFile:  "one\ntwo\nthree\n",
+			wantLines: []string{"0 stdout one", "0 stdout two", "0 stderr three"}},
+		{name: "partial lines",
+			writes:    []write{{stream: StreamStdout, data: "on"}, {stream: StreamStderr, data: "err\r\n"}, {stream: StreamStdout, data: "e\ntail"}},
+			wantFile:  "onerr\r\ne\ntail",
+			wantLines: []string{"0 stderr err", "0 stdout one", "0 stdout tail"}},
+		{name: "steps",
+			writes: []write{{stream: StreamStdout, data: "header\n"}, {step: "init", stream: StreamStdout, data: "initialized\n"},
+				{step: "plan", stream: StreamStderr, data: "unfinished"}},
+			finish:    &code,
+			wantFile:  "header\ninitialized\nunfinished",
+			wantLines: []string{"0 stdout header", "1 step init", "1 stdout initialized", "2 step plan", "2 stderr unfinished"},
+			wantSteps: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, lines := &bufferCloser{}, &bufferCloser{}
+			sink := newTaskFileSink(1, file, lines)
+			for _, w := range tt.writes {
+				if w.step != "" {
+					sink.StartStep(w.step)
+				}
+				out := sink.GetStdOut()
+				if w.stream == StreamStderr {
+					out = sink.GetStdErr()
+				}
+				_, err := out.Write([]byte(w.data))
+				if err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+			}
+			if tt.finish != nil {
+				sink.FinishStep(tt.finish, "")
+			}
+			sink.Close()
+			if got := file.String(); got != tt.wantFile {
+				t.Errorf("file = %q, want %q", got, tt.wantFile)
+			}
+			var got []string
+			dec := json.NewDecoder(lines)
+			for dec.More() {
+				var l OutputLine
+				if err := dec.Decode(&l); err != nil {
+					t.Fatalf("cannot decode line. Error: %v", err)
+				}
+				if l.Time.IsZero() {
+					t.Errorf("line %q has no time", l.Text)
+				}
+				got = append(got, fmt.Sprintf("%d %s %s", l.Step, l.Stream, l.Text))
+			}
+			if !reflect.DeepEqual(got, tt.wantLines) {
+				t.Errorf("lines = %v, want %v", got, tt.wantLines)
+			}
+			run := sink.GetRunRecord()
+			if len(run.Steps) != tt.wantSteps {
+				t.Fatalf("steps = %d, want %d", len(run.Steps), tt.wantSteps)
+			}
+			if run.Finished == nil {
+				t.Errorf("run has no finish time")
+			}
+			if !reflect.DeepEqual(run.ExitCode, tt.finish) {
+				t.Errorf("exit code = %v, want %v", run.ExitCode, tt.finish)
+			}
+			if tt.finish != nil && run.Steps[len(run.Steps)-1].Finished == nil {
+				t.Errorf("last step has no finish time")
+			}
+		})
+	}
+}
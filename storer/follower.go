@@ -57,7 +57,7 @@ func (f *follower) Follow(lines chan<- string, errs chan<- error) {
 	for {
 		s, err := reader.ReadBytes('\n')
 		counter += len(s)
-		if counter > 0 {
+		if len(s) > 0 {
 			lines <- string(s)
 		}
 		if err != nil {
@@ -92,7 +92,9 @@ func (f *follower) Follow(lines chan<- string, errs chan<- error) {
 				for {
 					s, err := reader.ReadBytes('\n')
 					counter += len(s)
-					lines <- string(s)
+					if len(s) > 0 {
+						lines <- string(s)
+					}
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -120,7 +122,9 @@ func (f *follower) Follow(lines chan<- string, errs chan<- error) {
 				for {
 					s, err := reader.ReadBytes('\n')
 					counter += len(s)
-					lines <- string(s)
+					if len(s) > 0 {
+						lines <- string(s)
+					}
 					if err != nil {
 						if err == io.EOF {
 							break
@@ -88,8 +88,10 @@ func Test_follower_Follow(t *testing.T) {
 				control:  tt.fields.control,
 			}
 			itemCounter := 0
+			done := make(chan struct{})
 
 			go func(ic *int) {
+				defer close(done)
 				for {
 					select {
 					case line, ok := <-lines:
@@ -108,6 +110,7 @@ func Test_follower_Follow(t *testing.T) {
 				t.Log("Follower has been stopped")
 			}()
 			flwr.Follow(lines, errs)
+			<-done
 			t.Logf("Items: %d\tCounter: %d", items, itemCounter)
 			if itemCounter != items {
 				t.Log("Item quantity differs")
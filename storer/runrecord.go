@@ -0,0 +1,96 @@
+package storer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"os"
+	"time"
+)
+
+//Streams of the task output lines
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	//StreamStep marks the start of the executor step. The text of the line is the step name
+	StreamStep = "step"
+)
+
+const taskLinesExt = ".lines"
+
+//OutputLine is a line of the task output tagged with its stream and the time it has been written at
+type OutputLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	//Step is the number of the step the line belongs to. Zero means the line has been written before the first step
+	Step int    `json:"step"`
+	Text string `json:"text"`
+}
+
+//RunStep is a single process run by the task executor
+type RunStep struct {
+	Name     string     `json:"name"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	//ExitCode is not set if the process has not exited by itself
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+}
+
+//RunRecord is the outcome of the task run. The exit code and the signal are the ones of the last step
+type RunRecord struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	ExitCode *int       `json:"exit_code,omitempty"`
+	Signal   string     `json:"signal,omitempty"`
+	Steps    []RunStep  `json:"steps,omitempty"`
+}
+
+//GetTaskLinesPath returns the path of the file with the tagged output lines of the task
+func GetTaskLinesPath(id int) (string, error) {
+	path, err := GetTaskPath(id)
+	if err != nil {
+		return "", err
+	}
+	return path + taskLinesExt, nil
+}
+
+//ReadTaskLines returns tagged output lines of the task
+func ReadTaskLines(id int) ([]OutputLine, error) {
+	path, err := GetTaskLinesPath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		misc.Debugf("cannot find task %d output lines. Error: %s", id, err)
+		return nil, err
+	}
+	defer f.Close()
+	var lines []OutputLine
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line OutputLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			return lines, fmt.Errorf("cannot parse output line %d of task %d. Error: %w", len(lines)+1, id, err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return lines, fmt.Errorf("cannot read output lines of task %d. Error: %w", id, err)
+	}
+	return lines, nil
+}
+
+func getTaskLinesWriteCloser(id int) (*os.File, error) {
+	dir := viper.GetString(misc.OutDirKey)
+	file, err := os.Create(getTaskPath(dir, id) + taskLinesExt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create output lines file of task %d. Error: %w", id, err)
+	}
+	return file, nil
+}
@@ -1,6 +1,8 @@
 package storer
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -9,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/spf13/viper"
 	"github.com/wix-playground/tfChek/misc"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -22,7 +25,6 @@ func S3UploadTask(bucket string, id int, suffix *string) error {
 
 func S3UploadTaskWithSuffix(bucket string, id int, suffix *string) error {
 	dir := viper.GetString(misc.OutDirKey)
-	awsRegion := viper.GetString(misc.AWSRegion)
 	filename := getTaskPath(dir, id)
 	file, err := os.Open(filename)
 	if err != nil {
@@ -30,6 +32,46 @@ func S3UploadTaskWithSuffix(bucket string, id int, suffix *string) error {
 	}
 	defer file.Close()
 
+	key := filepath.Base(filename)
+	if suffix != nil {
+		key = fmt.Sprintf("%s-%s", key, *suffix)
+	}
+	err = s3Upload(bucket, key, file)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool(misc.DebugKey) {
+		log.Printf("Successfully uploaded %s to %s\n", filename, bucket)
+	}
+	return nil
+}
+
+//S3UploadTaskRecord stores the task record next to the task output, so the status timeline of a completed task is archived too
+func S3UploadTaskRecord(bucket string, record *TaskRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot serialize task %d record. Error: %w", record.Id, err)
+	}
+	key := fmt.Sprintf("%s%d%s", taskFilePfx, record.Id, taskFileExt)
+	return s3Upload(bucket, key, bytes.NewReader(data))
+}
+
+//S3UploadTaskLines stores the tagged output lines next to the task output
+func S3UploadTaskLines(bucket string, id int) error {
+	filename, err := GetTaskLinesPath(id)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s for upload to S3 bucket. Error: %w", filename, err)
+	}
+	defer file.Close()
+	return s3Upload(bucket, filepath.Base(filename), file)
+}
+
+func s3Upload(bucket, key string, body io.Reader) error {
+	awsRegion := viper.GetString(misc.AWSRegion)
 	credentialsProvider, err := getCredentialsProvider()
 	if err != nil {
 		misc.Debugf("could not obtain AWS credentials provider. Error: %s", err)
@@ -46,14 +88,10 @@ func S3UploadTaskWithSuffix(bucket string, id int, suffix *string) error {
 	if viper.GetBool(misc.DebugKey) {
 		fmt.Println("Uploading file to S3")
 	}
-	key := filepath.Base(filename)
-	if suffix != nil {
-		key = fmt.Sprintf("%s-%s", key, *suffix)
-	}
 	result, err := svc.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-		Body:   file,
+		Body:   body,
 	})
 	if err != nil {
 		if viper.GetBool(misc.DebugKey) {
@@ -61,9 +99,7 @@ func S3UploadTaskWithSuffix(bucket string, id int, suffix *string) error {
 		}
 		return err
 	}
-	if viper.GetBool(misc.DebugKey) {
-		log.Printf("Successfully uploaded %s to %s\n", filename, result.Location)
-	}
+	misc.Debugf("uploaded %s to %s", key, result.Location)
 	return nil
 }
 
@@ -78,6 +78,6 @@ func getCredentialsProvider() (credentials.Provider, error) {
 	}
 
 	secretValue := credentials.Value{AccessKeyID: ak, SecretAccessKey: sk, ProviderName: providerName}
-	provider := credentials.StaticProvider{secretValue}
+	provider := credentials.StaticProvider{Value: secretValue}
 	return &provider, nil
 }
@@ -0,0 +1,152 @@
+package storer
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const sequenceFileName = "sequence"
+
+//sequenceRetryInterval limits how often the unavailable external sequence is checked again
+const sequenceRetryInterval = 10 * time.Second
+
+var sequenceProvider SequenceProvider
+var spl sync.Mutex
+
+//sequenceFailure is the last failed check of the external sequence. It is not cached as the provider, so the check is retried
+var sequenceFailure *unavailableSequence
+
+//SequenceProvider allocates task ids. Every id is returned once, even to the different tfChek instances sharing the provider
+type SequenceProvider interface {
+	//Next increments the sequence and returns the new value
+	Next() (int, error)
+}
+
+//GetSequenceProvider returns configured sequence provider.
+//The DynamoDB table is checked and created once it is available. Until then no ids are allocated and the check is retried.
+//Falling back to the local file is not safe, because the replicas would allocate the same ids then
+func GetSequenceProvider() SequenceProvider {
+	spl.Lock()
+	defer spl.Unlock()
+	if sequenceProvider != nil {
+		return sequenceProvider
+	}
+	if sequenceFailure != nil && time.Since(sequenceFailure.checked) < sequenceRetryInterval {
+		return sequenceFailure
+	}
+	local := NewFileSequence(path.Join(viper.GetString(misc.RunDirKey), sequenceFileName))
+	if !viper.GetBool(misc.UseExternalSequence) {
+		sequenceProvider = local
+		return sequenceProvider
+	}
+	tableName := viper.GetString(misc.AWSSequenceTable)
+	err := EnsureSequenceTable()
+	if err != nil {
+		log.Printf("Cannot use external sequence %s. Tasks cannot be added. Error: %s", tableName, err)
+		sequenceFailure = &unavailableSequence{err: fmt.Errorf("sequence table %s is not available. Error: %w", tableName, err), checked: time.Now()}
+		return sequenceFailure
+	}
+	sequenceFailure = nil
+	external := NewDynamoDBSequence(tableName)
+	//The ids allocated by this node before the table has been introduced must not be issued again
+	last, err := local.Current()
+	if err != nil {
+		misc.Debugf("cannot read local sequence. Error: %s", err)
+	} else if err := external.advance(last); err != nil {
+		misc.Debugf("cannot advance external sequence to %d. Error: %s", last, err)
+	}
+	sequenceProvider = external
+	return sequenceProvider
+}
+
+//FileSequence keeps the sequence in a file. The file is locked while the value is incremented,
+//so the processes of the same node can share it
+type FileSequence struct {
+	path string
+}
+
+func NewFileSequence(path string) *FileSequence {
+	return &FileSequence{path: path}
+}
+
+func parseSequence(data []byte) (int, error) {
+	v := strings.TrimSpace(string(data))
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(v)
+}
+
+//Current returns the last allocated value
+func (f *FileSequence) Current() (int, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return parseSequence(data)
+}
+
+func (f *FileSequence) Next() (int, error) {
+	err := os.MkdirAll(path.Dir(f.path), 0755)
+	if err != nil {
+		return 0, fmt.Errorf("cannot create sequence directory %s Error: %w", path.Dir(f.path), err)
+	}
+	sf, err := os.OpenFile(f.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("cannot open sequence file %s Error: %w", f.path, err)
+	}
+	defer sf.Close()
+	err = syscall.Flock(int(sf.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return 0, fmt.Errorf("cannot lock sequence file %s Error: %w", f.path, err)
+	}
+	defer syscall.Flock(int(sf.Fd()), syscall.LOCK_UN)
+	data, err := ioutil.ReadAll(sf)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read sequence file %s Error: %w", f.path, err)
+	}
+	seq, err := parseSequence(data)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse sequence file %s Error: %w", f.path, err)
+	}
+	seq++
+	err = sf.Truncate(0)
+	if err == nil {
+		_, err = sf.WriteAt([]byte(strconv.Itoa(seq)), 0)
+	}
+	if err == nil {
+		err = sf.Sync()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("cannot save sequence %d to file %s Error: %w", seq, f.path, err)
+	}
+	return seq, nil
+}
+
+//unavailableSequence is returned while the external sequence cannot be reached.
+//The callers may keep it, so every allocation checks the external sequence again
+type unavailableSequence struct {
+	err     error
+	checked time.Time
+}
+
+func (u *unavailableSequence) Next() (int, error) {
+	p := GetSequenceProvider()
+	if f, ok := p.(*unavailableSequence); ok {
+		return 0, f.err
+	}
+	return p.Next()
+}
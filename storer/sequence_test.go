@@ -0,0 +1,126 @@
+package storer
+
+import (
+	"errors"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileSequence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{name: "absent", want: 1},
+		{name: "empty", content: "", want: 1},
+		{name: "written by previous version", content: "41", want: 42},
+		{name: "trailing newline", content: "7\n", want: 8},
+		{name: "corrupted", content: "forty", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.name, sequenceFileName)
+			if tt.name != "absent" {
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(p, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := NewFileSequence(p).Next()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Next() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileSequenceConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, sequenceFileName)
+	const workers, perWorker = 8, 25
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//Every worker opens the file itself like a separate process would
+			s := NewFileSequence(p)
+			for i := 0; i < perWorker; i++ {
+				id, err := s.Next()
+				if err != nil {
+					t.Errorf("Next() error = %v", err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("Next() returned %d twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	last, err := NewFileSequence(p).Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != workers*perWorker || last != workers*perWorker {
+		t.Errorf("allocated %d ids, last %d, want %d", len(seen), last, workers*perWorker)
+	}
+}
+
+func TestUnavailableSequenceRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set(misc.RunDirKey, dir)
+	defer viper.Set(misc.RunDirKey, nil)
+	viper.Set(misc.UseExternalSequence, false)
+	defer viper.Set(misc.UseExternalSequence, nil)
+	failure := &unavailableSequence{err: errors.New("table is not reachable"), checked: time.Now()}
+	spl.Lock()
+	sequenceProvider, sequenceFailure = nil, failure
+	spl.Unlock()
+	defer func() {
+		spl.Lock()
+		sequenceProvider, sequenceFailure = nil, nil
+		spl.Unlock()
+	}()
+	if _, err := failure.Next(); err == nil {
+		t.Fatalf("Next() right after the failure has to fail without checking again")
+	}
+	spl.Lock()
+	failure.checked = time.Now().Add(-sequenceRetryInterval)
+	spl.Unlock()
+	//The provider kept by the task manager gets the ids once the sequence is available
+	if id, err := failure.Next(); err != nil || id != 1 {
+		t.Errorf("Next() after the retry interval = %d, %v, want 1", id, err)
+	}
+}
@@ -0,0 +1,279 @@
+package storer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	lockStoreDir = "locks"
+	lockFileExt  = ".json"
+)
+
+var stateLocker StateLocker
+var sll sync.Mutex
+
+var ErrStateLocked = errors.New("state is locked")
+var ErrStateLockLost = errors.New("state lock has been lost")
+var ErrStateLockNotFound = errors.New("state lock not found")
+var ErrStateLockHeld = errors.New("state lock is held by a live task")
+
+//StateLockRecord is the lease of the terraform state lock held by a task of a tfChek instance
+type StateLockRecord struct {
+	Name   string `json:"name"`
+	Owner  string `json:"owner"`
+	TaskId int    `json:"task_id"`
+	//Token is the fencing token. It grows with every acquisition of the lock, so a stale holder can be told from the current one
+	Token    int64     `json:"token"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+//IsStale tells if the lease has expired. Stale lock can be acquired by anyone
+func (l *StateLockRecord) IsStale(now time.Time) bool {
+	return !now.Before(l.Expires)
+}
+
+//StateLocker keeps state locks shared by tfChek instances
+type StateLocker interface {
+	//Acquire takes the lock if it is free or stale. ErrStateLocked is returned otherwise
+	Acquire(name, owner string, taskId int, lease time.Duration) (*StateLockRecord, error)
+	//Renew extends the lease. ErrStateLockLost is returned if the lock has been broken or taken by someone else
+	Renew(lock *StateLockRecord, lease time.Duration) error
+	//Release frees the lock if it is still held with the same token
+	Release(lock *StateLockRecord) error
+	//List returns held locks including the stale ones
+	List() ([]*StateLockRecord, error)
+	//Break frees the stale lock. Forced break frees the lock regardless of its holder.
+	//ErrStateLockNotFound is returned if the lock is not held, ErrStateLockHeld if it is not stale and the break is not forced
+	Break(name string, force bool) error
+}
+
+//GetStateLocker returns configured state locker.
+//DynamoDB based locker is used only if it is enabled explicitly, otherwise the locks are shared by the instances of the node only
+func GetStateLocker() StateLocker {
+	sll.Lock()
+	defer sll.Unlock()
+	if stateLocker != nil {
+		return stateLocker
+	}
+	if !viper.GetBool(misc.UseExternalLocks) {
+		stateLocker = NewFileStateLocker(path.Join(viper.GetString(misc.RunDirKey), lockStoreDir))
+		return stateLocker
+	}
+	tableName := viper.GetString(misc.AWSLockTable)
+	err := EnsureLockTable()
+	if err != nil {
+		//Replicas would not see the locks of each other, so falling back to the local locks is not safe. The table is checked again next time
+		misc.Debugf("cannot use external state locks %s. Error: %s", tableName, err)
+		return &unavailableStateLocker{err: fmt.Errorf("state lock table %s is not available. Error: %w", tableName, err)}
+	}
+	stateLocker = NewDynamoDBStateLocker(tableName)
+	return stateLocker
+}
+
+//FileStateLocker keeps every lock as a separate json file in the given directory.
+//Changes are done under the file lock, so the processes of the same node can share the directory
+type FileStateLocker struct {
+	dir string
+}
+
+func NewFileStateLocker(dir string) *FileStateLocker {
+	return &FileStateLocker{dir: dir}
+}
+
+func (f *FileStateLocker) lockPath(name string) string {
+	return path.Join(f.dir, url.PathEscape(name)+lockFileExt)
+}
+
+//exclusive runs the function holding the directory lock
+func (f *FileStateLocker) exclusive(fn func() error) error {
+	err := os.MkdirAll(f.dir, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot create state lock directory %s Error: %w", f.dir, err)
+	}
+	lf, err := os.OpenFile(path.Join(f.dir, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open state lock directory lock. Error: %w", err)
+	}
+	defer lf.Close()
+	err = syscall.Flock(int(lf.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return fmt.Errorf("cannot lock state lock directory %s Error: %w", f.dir, err)
+	}
+	defer syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+func (f *FileStateLocker) read(name string) (*StateLockRecord, error) {
+	data, err := ioutil.ReadFile(f.lockPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &StateLockRecord{Name: name}, nil
+		}
+		return nil, err
+	}
+	var lock StateLockRecord
+	err = json.Unmarshal(data, &lock)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse state lock %s Error: %w", name, err)
+	}
+	return &lock, nil
+}
+
+func (f *FileStateLocker) write(lock *StateLockRecord) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("cannot serialize state lock %s Error: %w", lock.Name, err)
+	}
+	lp := f.lockPath(lock.Name)
+	tmp := lp + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write state lock %s Error: %w", lock.Name, err)
+	}
+	return os.Rename(tmp, lp)
+}
+
+func (f *FileStateLocker) Acquire(name, owner string, taskId int, lease time.Duration) (*StateLockRecord, error) {
+	var acquired *StateLockRecord
+	err := f.exclusive(func() error {
+		lock, err := f.read(name)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if lock.Owner != "" && !lock.IsStale(now) {
+			return fmt.Errorf("%s is held by task %d of %s till %s %w", name, lock.TaskId, lock.Owner, lock.Expires.Format(time.RFC3339), ErrStateLocked)
+		}
+		lock.Owner, lock.TaskId, lock.Token, lock.Acquired, lock.Expires = owner, taskId, lock.Token+1, now, now.Add(lease)
+		acquired = lock
+		return f.write(lock)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acquired, nil
+}
+
+func (f *FileStateLocker) Renew(lock *StateLockRecord, lease time.Duration) error {
+	return f.exclusive(func() error {
+		current, err := f.read(lock.Name)
+		if err != nil {
+			return err
+		}
+		if current.Owner != lock.Owner || current.Token != lock.Token {
+			return fmt.Errorf("%s token %d %w", lock.Name, lock.Token, ErrStateLockLost)
+		}
+		current.Expires = time.Now().Add(lease)
+		err = f.write(current)
+		if err == nil {
+			lock.Expires = current.Expires
+		}
+		return err
+	})
+}
+
+func (f *FileStateLocker) Release(lock *StateLockRecord) error {
+	return f.exclusive(func() error {
+		current, err := f.read(lock.Name)
+		if err != nil {
+			return err
+		}
+		if current.Owner != lock.Owner || current.Token != lock.Token {
+			return fmt.Errorf("%s token %d %w", lock.Name, lock.Token, ErrStateLockLost)
+		}
+		return f.write(freeStateLock(current))
+	})
+}
+
+func (f *FileStateLocker) List() ([]*StateLockRecord, error) {
+	var locks []*StateLockRecord
+	err := f.exclusive(func() error {
+		files, err := ioutil.ReadDir(f.dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if fi.IsDir() || !strings.HasSuffix(fi.Name(), lockFileExt) {
+				continue
+			}
+			name, err := url.PathUnescape(strings.TrimSuffix(fi.Name(), lockFileExt))
+			if err != nil {
+				continue
+			}
+			lock, err := f.read(name)
+			if err != nil {
+				misc.Debugf("skipping state lock %s. Error: %s", name, err)
+				continue
+			}
+			if lock.Owner != "" {
+				locks = append(locks, lock)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+	return locks, nil
+}
+
+func (f *FileStateLocker) Break(name string, force bool) error {
+	return f.exclusive(func() error {
+		lock, err := f.read(name)
+		if err != nil {
+			return err
+		}
+		if lock.Owner == "" {
+			return fmt.Errorf("%s %w", name, ErrStateLockNotFound)
+		}
+		if !force && !lock.IsStale(time.Now()) {
+			return fmt.Errorf("%s is renewed by %s %w", name, lock.Owner, ErrStateLockHeld)
+		}
+		return f.write(freeStateLock(lock))
+	})
+}
+
+//freeStateLock clears the holder of the lock. The token is kept, so it keeps growing
+func freeStateLock(lock *StateLockRecord) *StateLockRecord {
+	return &StateLockRecord{Name: lock.Name, Token: lock.Token}
+}
+
+//unavailableStateLocker fails all the operations. It is used when the configured locker cannot be reached
+type unavailableStateLocker struct {
+	err error
+}
+
+func (u *unavailableStateLocker) Acquire(string, string, int, time.Duration) (*StateLockRecord, error) {
+	return nil, u.err
+}
+
+func (u *unavailableStateLocker) Renew(*StateLockRecord, time.Duration) error {
+	return u.err
+}
+
+func (u *unavailableStateLocker) Release(*StateLockRecord) error {
+	return u.err
+}
+
+func (u *unavailableStateLocker) List() ([]*StateLockRecord, error) {
+	return nil, u.err
+}
+
+func (u *unavailableStateLocker) Break(string, bool) error {
+	return u.err
+}
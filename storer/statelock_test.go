@@ -0,0 +1,84 @@
+package storer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileStateLocker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfchek-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locker := NewFileStateLocker(dir)
+	const name = "production/dns"
+	first, err := locker.Acquire(name, "replica-1", 1, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		run     func() error
+		wantErr error
+	}{
+		{name: "held", run: func() error {
+			_, err := locker.Acquire(name, "replica-2", 2, time.Minute)
+			return err
+		}, wantErr: ErrStateLocked},
+		{name: "other lock", run: func() error {
+			_, err := locker.Acquire("production/web", "replica-2", 2, time.Minute)
+			return err
+		}},
+		{name: "renew", run: func() error { return locker.Renew(first, time.Millisecond) }},
+		{name: "stale taken over", run: func() error {
+			time.Sleep(5 * time.Millisecond)
+			second, err := locker.Acquire(name, "replica-2", 3, time.Minute)
+			if err == nil && second.Token != first.Token+1 {
+				t.Errorf("Acquire() token = %d, want %d", second.Token, first.Token+1)
+			}
+			return err
+		}},
+		{name: "stale holder renews", run: func() error { return locker.Renew(first, time.Minute) }, wantErr: ErrStateLockLost},
+		{name: "stale holder releases", run: func() error { return locker.Release(first) }, wantErr: ErrStateLockLost},
+		{name: "break live", run: func() error { return locker.Break(name, false) }, wantErr: ErrStateLockHeld},
+		{name: "break by force", run: func() error { return locker.Break(name, true) }},
+		{name: "break free", run: func() error { return locker.Break(name, true) }, wantErr: ErrStateLockNotFound},
+		{name: "break stale", run: func() error {
+			if _, err := locker.Acquire("production/stale", "replica-3", 5, time.Millisecond); err != nil {
+				return err
+			}
+			time.Sleep(5 * time.Millisecond)
+			return locker.Break("production/stale", false)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			if (err != nil) != (tt.wantErr != nil) || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+	locks, err := locker.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(locks) != 1 || locks[0].Name != "production/web" || locks[0].TaskId != 2 {
+		t.Errorf("List() = %v, want production/web held by task 2", locks)
+	}
+	//Token keeps growing after the lock has been broken
+	third, err := locker.Acquire(name, "replica-1", 4, time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if third.Token != first.Token+2 {
+		t.Errorf("Acquire() token = %d, want %d", third.Token, first.Token+2)
+	}
+	if err := locker.Release(third); err != nil {
+		t.Errorf("Release() error = %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+package storer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TaskKindRunSh     = "runsh"
+	TaskKindWtf       = "wtf"
+	TaskKindTerraform = "terraform"
+	StagePlan         = "plan"
+	StageApply        = "apply"
+	taskStoreDir      = "tasks"
+	taskFilePfx       = "task-"
+	taskFileExt       = ".json"
+	keyStoreDir       = "keys"
+	keyFilePfx        = "key-"
+)
+
+var taskStore TaskStore
+var tsl, trl sync.Mutex
+
+var ErrTaskRecordNotFound = errors.New("task record not found")
+var ErrKeyNotFound = errors.New("idempotency key not found")
+
+//GitHubRef points to a pull request or an issue created for a task
+type GitHubRef struct {
+	Repository string `json:"repository"`
+	Number     int    `json:"number"`
+}
+
+//PullRequestRef ties the task to the pull request it plans or applies in Apply -> Push flow
+type PullRequestRef struct {
+	//Repository is the full name of GitHub repository
+	Repository string `json:"repository"`
+	Number     int    `json:"number"`
+	//Sha is the head commit of the pull request the task runs against
+	Sha   string `json:"sha"`
+	Stage string `json:"stage"`
+}
+
+//StatusTransition is a single change of the task status
+type StatusTransition struct {
+	Status int       `json:"status"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+//TaskRecord is a persistent representation of a task.
+//Definition keeps the original payload the task has been created from, so the task can be rebuilt after restart
+type TaskRecord struct {
+	Id           int                `json:"id"`
+	Kind         string             `json:"kind"`
+	Status       int                `json:"status"`
+	StateLock    string             `json:"state_lock"`
+	Hash         string             `json:"hash,omitempty"`
+	Command      string             `json:"command,omitempty"`
+	Authors      []string           `json:"authors,omitempty"`
+	Origins      []string           `json:"origins,omitempty"`
+	Definition   json.RawMessage    `json:"definition,omitempty"`
+	Created      time.Time          `json:"created"`
+	Updated      time.Time          `json:"updated"`
+	PullRequests []GitHubRef        `json:"pull_requests,omitempty"`
+	Issues       []GitHubRef        `json:"issues,omitempty"`
+	History      []StatusTransition `json:"history,omitempty"`
+	Ref          string             `json:"ref,omitempty"`
+	RerunOf      int                `json:"rerun_of,omitempty"`
+	CancelledBy  string             `json:"cancelled_by,omitempty"`
+	Drift        string             `json:"drift,omitempty"`
+	Review       *PullRequestRef    `json:"review,omitempty"`
+	//Expired is set when the task has never received its webhook
+	Expired bool `json:"expired,omitempty"`
+	//Run is the exit status and the steps of the completed run. Output lines are stored next to the output
+	Run *RunRecord `json:"run,omitempty"`
+	//LockToken is the fencing token of the state lock held by the run
+	LockToken int64 `json:"lock_token,omitempty"`
+	//Labels are free-form metadata given by the client, like a ticket or a CI job URL
+	Labels map[string]string `json:"labels,omitempty"`
+	//Owner is the tfChek instance, which runs the task. Other replicas do not restore the task while the owner is alive
+	Owner string `json:"owner,omitempty"`
+}
+
+type TaskStore interface {
+	Save(record *TaskRecord) error
+	Load(id int) (*TaskRecord, error)
+	List() ([]*TaskRecord, error)
+	Delete(id int) error
+	//ClaimKey binds the idempotency key to the task for the ttl. If the key is bound to another task, the id of that task is returned and nothing is changed
+	ClaimKey(key string, id int, ttl time.Duration) (int, bool, error)
+	//LookupKey returns the task the idempotency key is bound to
+	LookupKey(key string) (int, error)
+	//ReleaseKey unbinds the key from the task, which has not been created
+	ReleaseKey(key string, id int) error
+	//Prune removes records of the tasks completed before the time and the expired idempotency keys. It returns the number of removed records
+	Prune(before time.Time) (int, error)
+}
+
+//prunable tells if the record of the completed task is older than the time
+func prunable(record *TaskRecord, before time.Time) bool {
+	switch record.Status {
+	case misc.DONE, misc.FAILED, misc.TIMEOUT, misc.CANCELLED:
+		return record.Updated.Before(before)
+	}
+	return false
+}
+
+//idempotencyKey binds the key of the request to the task created by it
+type idempotencyKey struct {
+	Key     string    `json:"key"`
+	TaskId  int       `json:"task_id"`
+	Expires time.Time `json:"expires"`
+}
+
+//GetTaskStore returns configured task store.
+//DynamoDB based store is used only if it is enabled explicitly, otherwise the local file store is used
+func GetTaskStore() TaskStore {
+	tsl.Lock()
+	defer tsl.Unlock()
+	if taskStore == nil {
+		taskStore = newTaskStore()
+	}
+	return taskStore
+}
+
+//UpdateTaskRecord applies the change to the stored task record.
+//Tasks and GitHub managers update different fields of the same record, so the read and write are done under the lock
+func UpdateTaskRecord(id int, update func(record *TaskRecord)) error {
+	trl.Lock()
+	defer trl.Unlock()
+	store := GetTaskStore()
+	record, err := store.Load(id)
+	if err != nil {
+		if !errors.Is(err, ErrTaskRecordNotFound) {
+			return err
+		}
+		record = &TaskRecord{Id: id}
+	}
+	update(record)
+	record.Id = id
+	record.Updated = time.Now()
+	return store.Save(record)
+}
+
+func newTaskStore() TaskStore {
+	fileStore := NewFileTaskStore(path.Join(viper.GetString(misc.RunDirKey), taskStoreDir))
+	if viper.GetBool(misc.UseExternalTaskStore) {
+		tableName := viper.GetString(misc.AWSTaskTable)
+		err := EnsureTaskTable()
+		if err == nil {
+			err = EnsureKeyTable()
+		}
+		if err != nil {
+			misc.Debugf("cannot use external task store %s. Falling back to the local one. Error: %s", tableName, err)
+			return fileStore
+		}
+		return NewDynamoDBTaskStore(tableName, viper.GetString(misc.AWSKeyTable))
+	}
+	return fileStore
+}
+
+//FileTaskStore keeps every task record as a separate json file in the given directory
+type FileTaskStore struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func NewFileTaskStore(dir string) *FileTaskStore {
+	return &FileTaskStore{dir: dir}
+}
+
+func (f *FileTaskStore) recordPath(id int) string {
+	return path.Join(f.dir, fmt.Sprintf("%s%d%s", taskFilePfx, id, taskFileExt))
+}
+
+func (f *FileTaskStore) Save(record *TaskRecord) error {
+	if record == nil {
+		return fmt.Errorf("cannot save nil task record")
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("cannot serialize task %d record. Error: %w", record.Id, err)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := os.Stat(f.dir); os.IsNotExist(err) {
+		err := os.MkdirAll(f.dir, 0755)
+		if err != nil {
+			return fmt.Errorf("cannot create task store directory %s Error: %w", f.dir, err)
+		}
+	}
+	//Write to a temporary file first, so a crash cannot leave a truncated record behind
+	rp := f.recordPath(record.Id)
+	tmp := rp + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write task %d record to %s Error: %w", record.Id, tmp, err)
+	}
+	err = os.Rename(tmp, rp)
+	if err != nil {
+		return fmt.Errorf("cannot move task %d record to %s Error: %w", record.Id, rp, err)
+	}
+	return nil
+}
+
+func (f *FileTaskStore) Load(id int) (*TaskRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.load(f.recordPath(id))
+}
+
+func (f *FileTaskStore) load(file string) (*TaskRecord, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s does not exist %w", file, ErrTaskRecordNotFound)
+		}
+		return nil, err
+	}
+	var record TaskRecord
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse task record %s Error: %w", file, err)
+	}
+	return &record, nil
+}
+
+func (f *FileTaskStore) List() ([]*TaskRecord, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list task store directory %s Error: %w", f.dir, err)
+	}
+	var records []*TaskRecord
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, taskFilePfx) || !strings.HasSuffix(name, taskFileExt) {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, taskFilePfx), taskFileExt)); err != nil {
+			misc.Debugf("skipping unknown file %s in task store", name)
+			continue
+		}
+		record, err := f.load(path.Join(f.dir, name))
+		if err != nil {
+			misc.Debugf("skipping broken task record %s Error: %s", name, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Id < records[j].Id })
+	return records, nil
+}
+
+func (f *FileTaskStore) Delete(id int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := os.Remove(f.recordPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete task %d record. Error: %w", id, err)
+	}
+	return nil
+}
+
+//keyPath does not depend on the characters of the key, which is given by the client
+func (f *FileTaskStore) keyPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(f.dir, keyStoreDir, keyFilePfx+hex.EncodeToString(sum[:])+taskFileExt)
+}
+
+func (f *FileTaskStore) loadKey(key string) (*idempotencyKey, error) {
+	data, err := ioutil.ReadFile(f.keyPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s %w", key, ErrKeyNotFound)
+		}
+		return nil, err
+	}
+	var k idempotencyKey
+	err = json.Unmarshal(data, &k)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse idempotency key %s Error: %w", key, err)
+	}
+	if !time.Now().Before(k.Expires) {
+		return nil, fmt.Errorf("%s has expired %w", key, ErrKeyNotFound)
+	}
+	return &k, nil
+}
+
+func (f *FileTaskStore) ClaimKey(key string, id int, ttl time.Duration) (int, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	existing, err := f.loadKey(key)
+	if err == nil {
+		return existing.TaskId, false, nil
+	}
+	if !errors.Is(err, ErrKeyNotFound) {
+		misc.Debugf("overwriting broken idempotency key. Error: %s", err)
+	}
+	data, err := json.Marshal(&idempotencyKey{Key: key, TaskId: id, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return 0, false, err
+	}
+	p := f.keyPath(key)
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot create key store directory %s Error: %w", path.Dir(p), err)
+	}
+	err = ioutil.WriteFile(p, data, 0644)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot save idempotency key of task %d. Error: %w", id, err)
+	}
+	return id, true, nil
+}
+
+func (f *FileTaskStore) LookupKey(key string) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	k, err := f.loadKey(key)
+	if err != nil {
+		return 0, err
+	}
+	return k.TaskId, nil
+}
+
+func (f *FileTaskStore) ReleaseKey(key string, id int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	k, err := f.loadKey(key)
+	if err != nil || k.TaskId != id {
+		return nil
+	}
+	err = os.Remove(f.keyPath(key))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot release idempotency key of task %d. Error: %w", id, err)
+	}
+	return nil
+}
+
+func (f *FileTaskStore) Prune(before time.Time) (int, error) {
+	records, err := f.List()
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, r := range records {
+		if !prunable(r, before) {
+			continue
+		}
+		err := f.Delete(r.Id)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, f.pruneKeys()
+}
+
+//pruneKeys removes the files of the expired idempotency keys. Broken files are removed too, they are overwritten on the next claim anyway
+func (f *FileTaskStore) pruneKeys() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	dir := path.Join(f.dir, keyStoreDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot list key store directory %s Error: %w", dir, err)
+	}
+	now := time.Now()
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, keyFilePfx) || !strings.HasSuffix(name, taskFileExt) {
+			continue
+		}
+		p := path.Join(dir, name)
+		var k idempotencyKey
+		data, err := ioutil.ReadFile(p)
+		if err == nil {
+			err = json.Unmarshal(data, &k)
+		}
+		if err == nil && now.Before(k.Expires) {
+			continue
+		}
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove expired idempotency key %s Error: %w", name, err)
+		}
+	}
+	return nil
+}
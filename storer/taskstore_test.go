@@ -0,0 +1,166 @@
+package storer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/wix-playground/tfChek/misc"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileTaskStore(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "task_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	created := time.Unix(1600000000, 0).UTC()
+	records := []*TaskRecord{
+		{Id: 12, Kind: TaskKindWtf, Status: 1, StateLock: "prod/core", Created: created, Updated: created,
+			Definition: json.RawMessage(`{"Instant":1600000000}`)},
+		{Id: 3, Kind: TaskKindRunSh, Status: 6, StateLock: "dev/core", Hash: "abc", Command: "./run.sh -n dev/core",
+			Authors: []string{"someone"}, Origins: []string{"git@github.com:wix-system/tfChek-testrepo.git"},
+			Created: created, Updated: created},
+	}
+	store := NewFileTaskStore(dir)
+	for _, r := range records {
+		if err := store.Save(r); err != nil {
+			t.Errorf("Save() error = %v", err)
+		}
+	}
+	//Garbage in the directory has to be ignored
+	if err := ioutil.WriteFile(dir+"/task-x.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Load(3)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, records[1]) {
+		t.Errorf("Load() got = %v, want %v", got, records[1])
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Id != 3 || list[1].Id != 12 {
+		t.Errorf("List() got %v, want records 3 and 12", list)
+	}
+	if string(list[1].Definition) != string(records[0].Definition) {
+		t.Errorf("List() definition got = %s, want %s", list[1].Definition, records[0].Definition)
+	}
+	if err := store.Delete(3); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, err := store.Load(3); err == nil {
+		t.Errorf("Load() of deleted record should fail")
+	}
+	if err := store.Delete(3); err != nil {
+		t.Errorf("Delete() of absent record error = %v", err)
+	}
+}
+
+func TestFileTaskStore_ClaimKey(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "task_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileTaskStore(dir)
+	tests := []struct {
+		name        string
+		key         string
+		id          int
+		ttl         time.Duration
+		wantId      int
+		wantClaimed bool
+	}{
+		{name: "new key", key: "request/1", id: 1, ttl: time.Minute, wantId: 1, wantClaimed: true},
+		{name: "retry", key: "request/1", id: 2, ttl: time.Minute, wantId: 1},
+		{name: "short lived key", key: "request-2", id: 3, ttl: -time.Second, wantId: 3, wantClaimed: true},
+		{name: "expired key", key: "request-2", id: 4, ttl: time.Minute, wantId: 4, wantClaimed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, claimed, err := store.ClaimKey(tt.key, tt.id, tt.ttl)
+			if err != nil {
+				t.Fatalf("ClaimKey() error = %v", err)
+			}
+			if id != tt.wantId || claimed != tt.wantClaimed {
+				t.Errorf("ClaimKey() = %d, %v, want %d, %v", id, claimed, tt.wantId, tt.wantClaimed)
+			}
+		})
+	}
+	if id, err := store.LookupKey("request/1"); err != nil || id != 1 {
+		t.Errorf("LookupKey() = %d, %v, want 1", id, err)
+	}
+	//Key of another task is kept
+	if err := store.ReleaseKey("request/1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReleaseKey("request-2", 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LookupKey("request/1"); err != nil {
+		t.Errorf("LookupKey() of the key of another task error = %v", err)
+	}
+	if _, err := store.LookupKey("request-2"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("LookupKey() of released key error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestFileTaskStore_Prune(t *testing.T) {
+	dir, err := ioutil.TempDir("/tmp", "task_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileTaskStore(dir)
+	now := time.Now()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	records := []*TaskRecord{
+		{Id: 1, Status: misc.DONE, Updated: old},
+		{Id: 2, Status: misc.FAILED, Updated: old},
+		{Id: 3, Status: misc.DONE, Updated: recent},
+		{Id: 4, Status: misc.STARTED, Updated: old},
+		{Id: 5, Status: misc.OPEN, Updated: old},
+	}
+	for _, r := range records {
+		if err := store.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := store.ClaimKey("expired", 1, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.ClaimKey("live", 3, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := store.Prune(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Prune() error = %v", err)
+	}
+	if pruned != 2 {
+		t.Errorf("Prune() = %d, want 2", pruned)
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, r := range list {
+		ids = append(ids, r.Id)
+	}
+	if !reflect.DeepEqual(ids, []int{3, 4, 5}) {
+		t.Errorf("records left after Prune() = %v, want [3 4 5]", ids)
+	}
+	if _, err := os.Stat(store.keyPath("expired")); !os.IsNotExist(err) {
+		t.Errorf("expired idempotency key file has not been removed. Error: %v", err)
+	}
+	if id, err := store.LookupKey("live"); err != nil || id != 3 {
+		t.Errorf("LookupKey() of live key = %d, %v, want 3", id, err)
+	}
+}
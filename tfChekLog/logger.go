@@ -29,7 +29,7 @@ func (t *TaskLogger) Debug(msg string) {
 
 func (t *TaskLogger) Debugf(format string, args ...interface{}) {
 	if t.IsDebug {
-		t.Logf(format, args)
+		t.Logf(format, args...)
 	}
 }
 
@@ -38,7 +38,7 @@ func (t *TaskLogger) Log(msg string) {
 }
 
 func (t *TaskLogger) Logf(format string, args ...interface{}) {
-	t.log.Print(fmt.Sprintf(format, args))
+	t.log.Print(fmt.Sprintf(format, args...))
 }
 
 func (t *TaskLogger) Fatal(exitCode int, msg string) {
@@ -47,7 +47,7 @@ func (t *TaskLogger) Fatal(exitCode int, msg string) {
 }
 
 func (t *TaskLogger) Fatalf(exitCode int, format string, args ...interface{}) {
-	t.Logf(format, args)
+	t.Logf(format, args...)
 	os.Exit(exitCode)
 }
 